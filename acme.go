@@ -0,0 +1,1163 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"filippo.io/mkcert/ca"
+)
+
+// This file implements a minimal, in-memory ACME (RFC 8555) server, meant
+// to let ACME clients obtain certificates from the local CA. State is lost
+// when the process exits, which is fine since clients will just register
+// again. Only the http-01 and tls-alpn-01 (RFC 8737) challenges are
+// supported, so wildcard names can't be requested.
+
+const (
+	acmeErrorPrefix = "urn:ietf:params:acme:error:"
+
+	acmeStatusPending    = "pending"
+	acmeStatusReady      = "ready"
+	acmeStatusProcessing = "processing"
+	acmeStatusValid      = "valid"
+	acmeStatusInvalid    = "invalid"
+)
+
+// idPeACMEIdentifier is the tls-alpn-01 certificate extension from RFC 8737.
+var idPeACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status,omitempty"`
+}
+
+func acmeError(status int, typ, format string, a ...interface{}) *acmeProblem {
+	return &acmeProblem{Type: acmeErrorPrefix + typ, Detail: fmt.Sprintf(format, a...), Status: status}
+}
+
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type acmeAccount struct {
+	id         string
+	key        crypto.PublicKey
+	thumbprint string
+	status     string
+	contact    []string
+}
+
+type acmeOrder struct {
+	id          string
+	account     *acmeAccount
+	status      string
+	expires     time.Time
+	identifiers []acmeIdentifier
+	authzs      []*acmeAuthz
+	cert        []byte
+	err         *acmeProblem
+}
+
+type acmeAuthz struct {
+	id         string
+	account    *acmeAccount
+	identifier acmeIdentifier
+	status     string
+	expires    time.Time
+	challenges []*acmeChallenge
+}
+
+type acmeChallenge struct {
+	id        string
+	authz     *acmeAuthz
+	typ       string
+	token     string
+	status    string
+	validated time.Time
+	err       *acmeProblem
+}
+
+type acmeServer struct {
+	m       *mkcert
+	baseURL string
+
+	nonceMu    sync.Mutex
+	nonces     map[string]time.Time // issue time of the unused nonces
+	nonceQueue []string             // issued nonces, oldest first
+
+	mu         sync.Mutex
+	accounts   map[string]*acmeAccount
+	orders     map[string]*acmeOrder
+	authzs     map[string]*acmeAuthz
+	challenges map[string]*acmeChallenge
+	certs      map[string]*acmeOrder
+}
+
+func (m *mkcert) serveACME() {
+	m.checkSigner()
+
+	host, port, err := net.SplitHostPort(m.acmeAddr)
+	fatalIfErr(err, "invalid -acme-server address")
+	if host == "" {
+		host = "localhost"
+	}
+
+	s := &acmeServer{
+		m:          m,
+		baseURL:    "https://" + net.JoinHostPort(host, port),
+		nonces:     make(map[string]time.Time),
+		accounts:   make(map[string]*acmeAccount),
+		orders:     make(map[string]*acmeOrder),
+		authzs:     make(map[string]*acmeAuthz),
+		challenges: make(map[string]*acmeChallenge),
+		certs:      make(map[string]*acmeOrder),
+	}
+
+	tlsCert, err := m.acmeServerCertificate(host)
+	var constraintErr *ca.NameConstraintError
+	if errors.As(err, &constraintErr) {
+		log.Fatalf("ERROR: the ACME server needs a certificate for %q, but %s\nUse an -acme-server address with a host the constraints permit.", host, err)
+	}
+	fatalIfErr(err, "failed to generate the ACME server certificate")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/directory", s.handleDirectory)
+	mux.HandleFunc("/acme/new-nonce", s.handleNewNonce)
+	mux.HandleFunc("/acme/new-account", s.handleNewAccount)
+	mux.HandleFunc("/acme/account/", s.handleAccount)
+	mux.HandleFunc("/acme/new-order", s.handleNewOrder)
+	mux.HandleFunc("/acme/order/", s.handleOrder)
+	mux.HandleFunc("/acme/authz/", s.handleAuthz)
+	mux.HandleFunc("/acme/chall/", s.handleChallenge)
+	mux.HandleFunc("/acme/finalize/", s.handleFinalize)
+	mux.HandleFunc("/acme/cert/", s.handleCert)
+	mux.HandleFunc("/acme/revoke-cert", s.handleRevokeCert)
+	mux.HandleFunc("/acme/key-change", s.handleKeyChange)
+
+	srv := &http.Server{
+		Addr:    m.acmeAddr,
+		Handler: mux,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{tlsCert},
+		},
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	log.Printf("The ACME directory is at \"%s/directory\" 🔐\n", s.baseURL)
+	log.Printf("Clients must trust the local CA at \"%s\" to connect to it ℹ️\n\n", m.CAROOT)
+	fatalIfErr(srv.ListenAndServeTLS("", ""), "failed to run the ACME server")
+}
+
+// acmeServerCertificate issues an in-memory certificate for the ACME server
+// itself, valid for host and the loopback names. The loopback names are left
+// out if the CA name constraints don't allow them, but host is required.
+func (m *mkcert) acmeServerCertificate(host string) (tls.Certificate, error) {
+	if err := m.ca.CheckHost(host); err != nil {
+		return tls.Certificate{}, err
+	}
+	hosts := []string{host}
+	for _, h := range []string{"localhost", "127.0.0.1", "::1"} {
+		if h != host && m.ca.CheckHost(h) == nil {
+			hosts = append(hosts, h)
+		}
+	}
+	leaf, err := m.ca.IssueLeaf(&ca.LeafOptions{Hosts: hosts, KeyType: ca.KeyTypeP256})
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	chain := [][]byte{leaf.Cert.Raw}
+	for _, c := range m.ca.Chain() {
+		chain = append(chain, c.Raw)
+	}
+	return tls.Certificate{Certificate: chain, PrivateKey: leaf.Key}, nil
+}
+
+func randomACMEID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Nonces expire after acmeNonceLifetime, and only the latest acmeMaxNonces
+// are kept, as allowed by RFC 8555, Section 6.5. Clients retry on badNonce.
+const (
+	acmeNonceLifetime = 10 * time.Minute
+	acmeMaxNonces     = 10000
+)
+
+func (s *acmeServer) newNonce() string {
+	nonce := randomACMEID()
+	now := time.Now()
+	s.nonceMu.Lock()
+	defer s.nonceMu.Unlock()
+	s.nonces[nonce] = now
+	s.nonceQueue = append(s.nonceQueue, nonce)
+	for len(s.nonceQueue) > 0 {
+		oldest := s.nonceQueue[0]
+		issued, unused := s.nonces[oldest]
+		if unused && len(s.nonceQueue) <= acmeMaxNonces && now.Sub(issued) < acmeNonceLifetime {
+			break
+		}
+		delete(s.nonces, oldest)
+		s.nonceQueue = s.nonceQueue[1:]
+	}
+	return nonce
+}
+
+func (s *acmeServer) useNonce(nonce string) bool {
+	s.nonceMu.Lock()
+	defer s.nonceMu.Unlock()
+	issued, ok := s.nonces[nonce]
+	if !ok {
+		return false
+	}
+	delete(s.nonces, nonce)
+	return time.Since(issued) < acmeNonceLifetime
+}
+
+func (s *acmeServer) setHeaders(w http.ResponseWriter) {
+	w.Header().Set("Replay-Nonce", s.newNonce())
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Add("Link", fmt.Sprintf("<%s/directory>;rel=\"index\"", s.baseURL))
+}
+
+func (s *acmeServer) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	s.setHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *acmeServer) writeProblem(w http.ResponseWriter, p *acmeProblem) {
+	s.setHeaders(w)
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+func (s *acmeServer) handleDirectory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"newNonce":   s.baseURL + "/acme/new-nonce",
+		"newAccount": s.baseURL + "/acme/new-account",
+		"newOrder":   s.baseURL + "/acme/new-order",
+		"revokeCert": s.baseURL + "/acme/revoke-cert",
+		"keyChange":  s.baseURL + "/acme/key-change",
+		"meta": map[string]interface{}{
+			"website":                 "https://github.com/FiloSottile/mkcert",
+			"externalAccountRequired": false,
+		},
+	})
+}
+
+func (s *acmeServer) handleNewNonce(w http.ResponseWriter, r *http.Request) {
+	s.setHeaders(w)
+	if r.Method == http.MethodGet {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// publicKey parses the JWK into a crypto.PublicKey and computes its RFC 7638
+// thumbprint, which is used in key authorizations.
+func (k *jsonWebKey) publicKey() (pub crypto.PublicKey, thumbprint string, err error) {
+	b64 := base64.RawURLEncoding
+	var canonical string
+	switch k.Kty {
+	case "RSA":
+		n, err := b64.DecodeString(k.N)
+		if err != nil {
+			return nil, "", err
+		}
+		e, err := b64.DecodeString(k.E)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(e) == 0 || len(e) > 4 {
+			return nil, "", errors.New("invalid RSA exponent")
+		}
+		pub = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+		canonical = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, k.E, k.N)
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, "", fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil {
+			return nil, "", err
+		}
+		y, err := b64.DecodeString(k.Y)
+		if err != nil {
+			return nil, "", err
+		}
+		ecKey := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(ecKey.X, ecKey.Y) {
+			return nil, "", errors.New("invalid EC point")
+		}
+		pub = ecKey
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, k.Crv, k.X, k.Y)
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, "", fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, "", errors.New("invalid Ed25519 key")
+		}
+		pub = ed25519.PublicKey(x)
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"OKP","x":%q}`, k.Crv, k.X)
+	default:
+		return nil, "", fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return pub, b64.EncodeToString(sum[:]), nil
+}
+
+func verifyJWS(alg string, pub crypto.PublicKey, signed, sig []byte) bool {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		h := sha256.Sum256(signed)
+		switch alg {
+		case "RS256":
+			return rsa.VerifyPKCS1v15(pub, crypto.SHA256, h[:], sig) == nil
+		case "PS256":
+			return rsa.VerifyPSS(pub, crypto.SHA256, h[:], sig, nil) == nil
+		}
+	case *ecdsa.PublicKey:
+		var digest []byte
+		switch {
+		case alg == "ES256" && pub.Curve == elliptic.P256():
+			h := sha256.Sum256(signed)
+			digest = h[:]
+		case alg == "ES384" && pub.Curve == elliptic.P384():
+			h := sha512.Sum384(signed)
+			digest = h[:]
+		case alg == "ES512" && pub.Curve == elliptic.P521():
+			h := sha512.Sum512(signed)
+			digest = h[:]
+		default:
+			return false
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(pub, digest, r, s)
+	case ed25519.PublicKey:
+		return alg == "EdDSA" && ed25519.Verify(pub, signed, sig)
+	}
+	return false
+}
+
+type jwsRequest struct {
+	payload []byte
+	account *acmeAccount // set if the request used "kid"
+
+	// Set if the request used "jwk".
+	key        crypto.PublicKey
+	thumbprint string
+}
+
+// parseJWS reads and authenticates a JWS-signed POST request as described
+// in RFC 8555, Section 6.2. If useJWK is true the request must carry a
+// "jwk" header, otherwise it must reference an existing account by "kid".
+func (s *acmeServer) parseJWS(r *http.Request, useJWK bool) (*jwsRequest, *acmeProblem) {
+	if r.Method != http.MethodPost {
+		return nil, acmeError(http.StatusMethodNotAllowed, "malformed", "expected a POST request")
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/jose+json" {
+		return nil, acmeError(http.StatusUnsupportedMediaType, "malformed", "unexpected Content-Type %q", ct)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return nil, acmeError(http.StatusBadRequest, "malformed", "failed to read request: %s", err)
+	}
+	var msg struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return nil, acmeError(http.StatusBadRequest, "malformed", "failed to parse JWS: %s", err)
+	}
+	protected, err := base64.RawURLEncoding.DecodeString(msg.Protected)
+	if err != nil {
+		return nil, acmeError(http.StatusBadRequest, "malformed", "failed to decode protected header: %s", err)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(msg.Payload)
+	if err != nil {
+		return nil, acmeError(http.StatusBadRequest, "malformed", "failed to decode payload: %s", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(msg.Signature)
+	if err != nil {
+		return nil, acmeError(http.StatusBadRequest, "malformed", "failed to decode signature: %s", err)
+	}
+	var header struct {
+		Alg   string      `json:"alg"`
+		Nonce string      `json:"nonce"`
+		URL   string      `json:"url"`
+		JWK   *jsonWebKey `json:"jwk"`
+		KID   string      `json:"kid"`
+	}
+	if err := json.Unmarshal(protected, &header); err != nil {
+		return nil, acmeError(http.StatusBadRequest, "malformed", "failed to parse protected header: %s", err)
+	}
+	if header.URL != s.baseURL+r.URL.Path {
+		return nil, acmeError(http.StatusUnauthorized, "unauthorized", "JWS url %q does not match request", header.URL)
+	}
+	if !s.useNonce(header.Nonce) {
+		return nil, acmeError(http.StatusBadRequest, "badNonce", "invalid or reused nonce")
+	}
+
+	req := &jwsRequest{payload: payload}
+	var pub crypto.PublicKey
+	switch {
+	case useJWK && header.JWK != nil && header.KID == "":
+		pub, req.thumbprint, err = header.JWK.publicKey()
+		if err != nil {
+			return nil, acmeError(http.StatusBadRequest, "badPublicKey", "%s", err)
+		}
+		req.key = pub
+	case !useJWK && header.KID != "" && header.JWK == nil:
+		if id := strings.TrimPrefix(header.KID, s.baseURL+"/acme/account/"); id != header.KID {
+			s.mu.Lock()
+			req.account = s.accounts[id]
+			s.mu.Unlock()
+		}
+		if req.account == nil {
+			return nil, acmeError(http.StatusBadRequest, "accountDoesNotExist", "unknown account %q", header.KID)
+		}
+		if req.account.status != acmeStatusValid {
+			return nil, acmeError(http.StatusUnauthorized, "unauthorized", "account is %s", req.account.status)
+		}
+		pub = req.account.key
+	case useJWK:
+		return nil, acmeError(http.StatusBadRequest, "malformed", "expected a \"jwk\" and no \"kid\" header")
+	default:
+		return nil, acmeError(http.StatusBadRequest, "malformed", "expected a \"kid\" and no \"jwk\" header")
+	}
+	if !verifyJWS(header.Alg, pub, []byte(msg.Protected+"."+msg.Payload), sig) {
+		return nil, acmeError(http.StatusBadRequest, "badSignatureAlgorithm", "invalid %q signature", header.Alg)
+	}
+	return req, nil
+}
+
+func (s *acmeServer) accountURL(a *acmeAccount) string {
+	return s.baseURL + "/acme/account/" + a.id
+}
+
+func (s *acmeServer) accountJSON(a *acmeAccount) interface{} {
+	return map[string]interface{}{
+		"status":  a.status,
+		"contact": a.contact,
+		"orders":  s.accountURL(a) + "/orders",
+	}
+}
+
+func (s *acmeServer) handleNewAccount(w http.ResponseWriter, r *http.Request) {
+	req, prob := s.parseJWS(r, true)
+	if prob != nil {
+		s.writeProblem(w, prob)
+		return
+	}
+	var payload struct {
+		Contact            []string `json:"contact"`
+		OnlyReturnExisting bool     `json:"onlyReturnExisting"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		s.writeProblem(w, acmeError(http.StatusBadRequest, "malformed", "failed to parse account: %s", err))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range s.accounts {
+		if a.thumbprint == req.thumbprint {
+			w.Header().Set("Location", s.accountURL(a))
+			s.writeJSON(w, http.StatusOK, s.accountJSON(a))
+			return
+		}
+	}
+	if payload.OnlyReturnExisting {
+		s.writeProblem(w, acmeError(http.StatusBadRequest, "accountDoesNotExist", "no account for this key"))
+		return
+	}
+	a := &acmeAccount{
+		id:         randomACMEID(),
+		key:        req.key,
+		thumbprint: req.thumbprint,
+		status:     acmeStatusValid,
+		contact:    payload.Contact,
+	}
+	if a.contact == nil {
+		a.contact = []string{}
+	}
+	s.accounts[a.id] = a
+	w.Header().Set("Location", s.accountURL(a))
+	s.writeJSON(w, http.StatusCreated, s.accountJSON(a))
+}
+
+func (s *acmeServer) handleAccount(w http.ResponseWriter, r *http.Request) {
+	req, prob := s.parseJWS(r, false)
+	if prob != nil {
+		s.writeProblem(w, prob)
+		return
+	}
+	a := req.account
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if strings.HasSuffix(r.URL.Path, "/orders") {
+		if r.URL.Path != "/acme/account/"+a.id+"/orders" {
+			s.writeProblem(w, acmeError(http.StatusUnauthorized, "unauthorized", "account mismatch"))
+			return
+		}
+		orders := []string{}
+		for _, o := range s.orders {
+			if o.account == a {
+				orders = append(orders, s.baseURL+"/acme/order/"+o.id)
+			}
+		}
+		s.writeJSON(w, http.StatusOK, map[string]interface{}{"orders": orders})
+		return
+	}
+	if r.URL.Path != "/acme/account/"+a.id {
+		s.writeProblem(w, acmeError(http.StatusUnauthorized, "unauthorized", "account mismatch"))
+		return
+	}
+
+	if len(req.payload) != 0 {
+		var payload struct {
+			Contact []string `json:"contact"`
+			Status  string   `json:"status"`
+		}
+		if err := json.Unmarshal(req.payload, &payload); err != nil {
+			s.writeProblem(w, acmeError(http.StatusBadRequest, "malformed", "failed to parse account: %s", err))
+			return
+		}
+		if payload.Contact != nil {
+			a.contact = payload.Contact
+		}
+		if payload.Status == "deactivated" {
+			a.status = "deactivated"
+		}
+	}
+	s.writeJSON(w, http.StatusOK, s.accountJSON(a))
+}
+
+// checkACMEIdentifier returns an error if the identifier can't be issued by
+// this server.
+func checkACMEIdentifier(id acmeIdentifier) error {
+	switch id.Type {
+	case "dns":
+		if strings.HasPrefix(id.Value, "*.") {
+			return errors.New("wildcard names require the dns-01 challenge, which is not supported")
+		}
+		if net.ParseIP(id.Value) != nil || !hostnameRegexp.MatchString(id.Value) {
+			return fmt.Errorf("%q is not a valid hostname", id.Value)
+		}
+	case "ip":
+		if net.ParseIP(id.Value) == nil {
+			return fmt.Errorf("%q is not a valid IP address", id.Value)
+		}
+	default:
+		return fmt.Errorf("unsupported identifier type %q", id.Type)
+	}
+	return nil
+}
+
+func (s *acmeServer) orderJSON(o *acmeOrder) interface{} {
+	authzs := []string{}
+	for _, az := range o.authzs {
+		authzs = append(authzs, s.baseURL+"/acme/authz/"+az.id)
+	}
+	res := map[string]interface{}{
+		"status":         o.status,
+		"expires":        o.expires.Format(time.RFC3339),
+		"identifiers":    o.identifiers,
+		"authorizations": authzs,
+		"finalize":       s.baseURL + "/acme/finalize/" + o.id,
+	}
+	if o.cert != nil {
+		res["certificate"] = s.baseURL + "/acme/cert/" + o.id
+	}
+	if o.err != nil {
+		res["error"] = o.err
+	}
+	return res
+}
+
+func (s *acmeServer) handleNewOrder(w http.ResponseWriter, r *http.Request) {
+	req, prob := s.parseJWS(r, false)
+	if prob != nil {
+		s.writeProblem(w, prob)
+		return
+	}
+	var payload struct {
+		Identifiers []acmeIdentifier `json:"identifiers"`
+		NotBefore   string           `json:"notBefore"`
+		NotAfter    string           `json:"notAfter"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		s.writeProblem(w, acmeError(http.StatusBadRequest, "malformed", "failed to parse order: %s", err))
+		return
+	}
+	if len(payload.Identifiers) == 0 {
+		s.writeProblem(w, acmeError(http.StatusBadRequest, "malformed", "no identifiers in order"))
+		return
+	}
+	if payload.NotBefore != "" || payload.NotAfter != "" {
+		s.writeProblem(w, acmeError(http.StatusBadRequest, "malformed", "notBefore and notAfter are not supported"))
+		return
+	}
+	var identifiers []acmeIdentifier
+	seen := make(map[acmeIdentifier]bool)
+	for _, id := range payload.Identifiers {
+		id.Value = strings.ToLower(id.Value)
+		if err := checkACMEIdentifier(id); err != nil {
+			s.writeProblem(w, acmeError(http.StatusBadRequest, "rejectedIdentifier", "%s", err))
+			return
+		}
+		if id.Type == "ip" {
+			// Use the canonical form, which is what the CSR check compares.
+			id.Value = net.ParseIP(id.Value).String()
+		}
+		if err := s.m.ca.CheckHost(id.Value); err != nil {
+			s.writeProblem(w, acmeError(http.StatusBadRequest, "rejectedIdentifier", "%s", err))
+			return
+		}
+		if !seen[id] {
+			seen[id] = true
+			identifiers = append(identifiers, id)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o := &acmeOrder{
+		id:          randomACMEID(),
+		account:     req.account,
+		status:      acmeStatusPending,
+		expires:     time.Now().Add(24 * time.Hour),
+		identifiers: identifiers,
+	}
+	for _, id := range identifiers {
+		az := &acmeAuthz{
+			id:         randomACMEID(),
+			account:    req.account,
+			identifier: id,
+			status:     acmeStatusPending,
+			expires:    o.expires,
+		}
+		types := []string{"http-01"}
+		if id.Type == "dns" {
+			types = append(types, "tls-alpn-01")
+		}
+		for _, typ := range types {
+			ch := &acmeChallenge{
+				id:     randomACMEID(),
+				authz:  az,
+				typ:    typ,
+				token:  randomACMEID(),
+				status: acmeStatusPending,
+			}
+			az.challenges = append(az.challenges, ch)
+			s.challenges[ch.id] = ch
+		}
+		o.authzs = append(o.authzs, az)
+		s.authzs[az.id] = az
+	}
+	s.orders[o.id] = o
+
+	w.Header().Set("Location", s.baseURL+"/acme/order/"+o.id)
+	s.writeJSON(w, http.StatusCreated, s.orderJSON(o))
+}
+
+func (s *acmeServer) handleOrder(w http.ResponseWriter, r *http.Request) {
+	req, prob := s.parseJWS(r, false)
+	if prob != nil {
+		s.writeProblem(w, prob)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.orders[strings.TrimPrefix(r.URL.Path, "/acme/order/")]
+	if o == nil || o.account != req.account {
+		s.writeProblem(w, acmeError(http.StatusNotFound, "malformed", "order not found"))
+		return
+	}
+	s.updateOrder(o)
+	s.writeJSON(w, http.StatusOK, s.orderJSON(o))
+}
+
+// updateOrder moves an order to ready or invalid based on the status of its
+// authorizations. s.mu must be held.
+func (s *acmeServer) updateOrder(o *acmeOrder) {
+	if o.status != acmeStatusPending {
+		return
+	}
+	if time.Now().After(o.expires) {
+		o.status = acmeStatusInvalid
+		return
+	}
+	ready := true
+	for _, az := range o.authzs {
+		switch az.status {
+		case acmeStatusValid:
+		case acmeStatusPending:
+			ready = false
+		default:
+			o.status = acmeStatusInvalid
+			return
+		}
+	}
+	if ready {
+		o.status = acmeStatusReady
+	}
+}
+
+func (s *acmeServer) challengeJSON(ch *acmeChallenge) interface{} {
+	res := map[string]interface{}{
+		"type":   ch.typ,
+		"url":    s.baseURL + "/acme/chall/" + ch.id,
+		"status": ch.status,
+		"token":  ch.token,
+	}
+	if !ch.validated.IsZero() {
+		res["validated"] = ch.validated.Format(time.RFC3339)
+	}
+	if ch.err != nil {
+		res["error"] = ch.err
+	}
+	return res
+}
+
+func (s *acmeServer) authzJSON(az *acmeAuthz) interface{} {
+	challenges := []interface{}{}
+	for _, ch := range az.challenges {
+		challenges = append(challenges, s.challengeJSON(ch))
+	}
+	return map[string]interface{}{
+		"status":     az.status,
+		"expires":    az.expires.Format(time.RFC3339),
+		"identifier": az.identifier,
+		"challenges": challenges,
+	}
+}
+
+func (s *acmeServer) handleAuthz(w http.ResponseWriter, r *http.Request) {
+	req, prob := s.parseJWS(r, false)
+	if prob != nil {
+		s.writeProblem(w, prob)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	az := s.authzs[strings.TrimPrefix(r.URL.Path, "/acme/authz/")]
+	if az == nil || az.account != req.account {
+		s.writeProblem(w, acmeError(http.StatusNotFound, "malformed", "authorization not found"))
+		return
+	}
+	if len(req.payload) != 0 {
+		var payload struct {
+			Status string `json:"status"`
+		}
+		if err := json.Unmarshal(req.payload, &payload); err != nil {
+			s.writeProblem(w, acmeError(http.StatusBadRequest, "malformed", "failed to parse authorization: %s", err))
+			return
+		}
+		if payload.Status == "deactivated" {
+			az.status = "deactivated"
+		}
+	}
+	s.writeJSON(w, http.StatusOK, s.authzJSON(az))
+}
+
+func (s *acmeServer) handleChallenge(w http.ResponseWriter, r *http.Request) {
+	req, prob := s.parseJWS(r, false)
+	if prob != nil {
+		s.writeProblem(w, prob)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch := s.challenges[strings.TrimPrefix(r.URL.Path, "/acme/chall/")]
+	if ch == nil || ch.authz.account != req.account {
+		s.writeProblem(w, acmeError(http.StatusNotFound, "malformed", "challenge not found"))
+		return
+	}
+	// An empty JSON object asks the server to start the validation, while
+	// an empty payload is a POST-as-GET.
+	if len(req.payload) != 0 && ch.status == acmeStatusPending && ch.authz.status == acmeStatusPending {
+		ch.status = acmeStatusProcessing
+		keyAuth := ch.token + "." + req.account.thumbprint
+		go s.validate(ch, keyAuth)
+	}
+	w.Header().Add("Link", fmt.Sprintf("<%s/acme/authz/%s>;rel=\"up\"", s.baseURL, ch.authz.id))
+	s.writeJSON(w, http.StatusOK, s.challengeJSON(ch))
+}
+
+func (s *acmeServer) validate(ch *acmeChallenge, keyAuth string) {
+	var err error
+	switch ch.typ {
+	case "http-01":
+		err = validateHTTP01(ch.authz.identifier, ch.token, keyAuth)
+	case "tls-alpn-01":
+		err = validateTLSALPN01(ch.authz.identifier, keyAuth)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		log.Printf("ACME %s challenge for %q failed: %s", ch.typ, ch.authz.identifier.Value, err)
+		ch.status = acmeStatusInvalid
+		ch.err = acmeError(http.StatusForbidden, ch.errorType(), "%s", err)
+		ch.authz.status = acmeStatusInvalid
+		return
+	}
+	ch.status = acmeStatusValid
+	ch.validated = time.Now()
+	ch.authz.status = acmeStatusValid
+}
+
+func (ch *acmeChallenge) errorType() string {
+	if ch.typ == "tls-alpn-01" {
+		return "tls"
+	}
+	return "incorrectResponse"
+}
+
+func validateHTTP01(id acmeIdentifier, token, keyAuth string) error {
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			// Redirects to HTTPS are allowed, and the certificate is not
+			// checked, per RFC 8555, Section 8.3.
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	u := "http://" + net.JoinHostPort(id.Value, "80") + "/.well-known/acme-challenge/" + token
+	resp, err := client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", u, resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(body)) != keyAuth {
+		return fmt.Errorf("%s returned an incorrect key authorization", u)
+	}
+	return nil
+}
+
+func validateTLSALPN01(id acmeIdentifier, keyAuth string) error {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(id.Value, "443"), &tls.Config{
+		ServerName:         id.Value,
+		NextProtos:         []string{"acme-tls/1"},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != "acme-tls/1" {
+		return errors.New("the server did not negotiate the \"acme-tls/1\" protocol")
+	}
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("the server did not present a certificate")
+	}
+	cert := state.PeerCertificates[0]
+	if len(cert.DNSNames) != 1 || !strings.EqualFold(cert.DNSNames[0], id.Value) ||
+		len(cert.IPAddresses) != 0 || len(cert.EmailAddresses) != 0 || len(cert.URIs) != 0 {
+		return fmt.Errorf("the certificate must contain only the %q DNS name", id.Value)
+	}
+	expected := sha256.Sum256([]byte(keyAuth))
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(idPeACMEIdentifier) {
+			continue
+		}
+		if !ext.Critical {
+			return errors.New("the acmeIdentifier extension is not critical")
+		}
+		var value []byte
+		if rest, err := asn1.Unmarshal(ext.Value, &value); err != nil || len(rest) != 0 {
+			return errors.New("malformed acmeIdentifier extension")
+		}
+		if subtle.ConstantTimeCompare(value, expected[:]) != 1 {
+			return errors.New("incorrect acmeIdentifier extension value")
+		}
+		return nil
+	}
+	return errors.New("the certificate is missing the acmeIdentifier extension")
+}
+
+func (s *acmeServer) handleFinalize(w http.ResponseWriter, r *http.Request) {
+	req, prob := s.parseJWS(r, false)
+	if prob != nil {
+		s.writeProblem(w, prob)
+		return
+	}
+	var payload struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		s.writeProblem(w, acmeError(http.StatusBadRequest, "malformed", "failed to parse finalize request: %s", err))
+		return
+	}
+	csrDER, err := base64.RawURLEncoding.DecodeString(payload.CSR)
+	if err != nil {
+		s.writeProblem(w, acmeError(http.StatusBadRequest, "badCSR", "failed to decode CSR: %s", err))
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		s.writeProblem(w, acmeError(http.StatusBadRequest, "badCSR", "failed to parse CSR: %s", err))
+		return
+	}
+	if err := csr.CheckSignature(); err != nil {
+		s.writeProblem(w, acmeError(http.StatusBadRequest, "badCSR", "invalid CSR signature: %s", err))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.orders[strings.TrimPrefix(r.URL.Path, "/acme/finalize/")]
+	if o == nil || o.account != req.account {
+		s.writeProblem(w, acmeError(http.StatusNotFound, "malformed", "order not found"))
+		return
+	}
+	s.updateOrder(o)
+	if o.status != acmeStatusReady {
+		s.writeProblem(w, acmeError(http.StatusForbidden, "orderNotReady", "order is %s", o.status))
+		return
+	}
+	if err := checkACMECSR(csr, o.identifiers); err != nil {
+		s.writeProblem(w, acmeError(http.StatusBadRequest, "badCSR", "%s", err))
+		return
+	}
+
+	o.status = acmeStatusProcessing
+	cert, err := s.m.issueACMECert(csr.PublicKey, o.identifiers)
+	if err != nil {
+		o.status = acmeStatusInvalid
+		o.err = acmeError(http.StatusInternalServerError, "serverInternal", "failed to issue certificate: %s", err)
+		s.writeProblem(w, o.err)
+		return
+	}
+	o.cert = cert
+	o.status = acmeStatusValid
+	s.certs[o.id] = o
+
+	var names []string
+	for _, id := range o.identifiers {
+		names = append(names, id.Value)
+	}
+	log.Printf("Issued an ACME certificate for %s 📜", strings.Join(names, ", "))
+
+	w.Header().Set("Location", s.baseURL+"/acme/order/"+o.id)
+	s.writeJSON(w, http.StatusOK, s.orderJSON(o))
+}
+
+// checkACMECSR checks that the CSR requests exactly the order identifiers.
+func checkACMECSR(csr *x509.CertificateRequest, identifiers []acmeIdentifier) error {
+	want := make(map[acmeIdentifier]bool)
+	for _, id := range identifiers {
+		want[id] = true
+	}
+	got := make(map[acmeIdentifier]bool)
+	for _, name := range csr.DNSNames {
+		got[acmeIdentifier{Type: "dns", Value: strings.ToLower(name)}] = true
+	}
+	for _, ip := range csr.IPAddresses {
+		got[acmeIdentifier{Type: "ip", Value: ip.String()}] = true
+	}
+	if cn := csr.Subject.CommonName; cn != "" {
+		id := acmeIdentifier{Type: "dns", Value: strings.ToLower(cn)}
+		if ip := net.ParseIP(cn); ip != nil {
+			id = acmeIdentifier{Type: "ip", Value: ip.String()}
+		}
+		got[id] = true
+	}
+	if len(csr.EmailAddresses) != 0 || len(csr.URIs) != 0 {
+		return errors.New("CSR contains unsupported names")
+	}
+	for id := range got {
+		if !want[id] {
+			return fmt.Errorf("CSR contains %q, which is not in the order", id.Value)
+		}
+	}
+	for id := range want {
+		if !got[id] {
+			return fmt.Errorf("CSR is missing %q, which is in the order", id.Value)
+		}
+	}
+	return nil
+}
+
+// issueACMECert signs a certificate for the validated order identifiers. Only
+// the CSR public key is used, any other requested attribute is ignored.
+func (m *mkcert) issueACMECert(pub crypto.PublicKey, identifiers []acmeIdentifier) ([]byte, error) {
+	var hosts []string
+	for _, id := range identifiers {
+		hosts = append(hosts, id.Value)
+	}
+	opts := &ca.LeafOptions{Hosts: hosts, PublicKey: pub,
+		CRLDistributionPoints: m.crlDistributionPoints(), OCSPServer: m.ocspServers()}
+	opts.NotBefore, opts.NotAfter = m.validityPeriod()
+	leaf, err := m.ca.IssueLeaf(opts)
+	if err != nil {
+		return nil, err
+	}
+	m.recordCert(leaf.Cert, ca.SourceACME)
+	return m.ca.ChainPEM(leaf.Cert), nil
+}
+
+func (s *acmeServer) handleCert(w http.ResponseWriter, r *http.Request) {
+	req, prob := s.parseJWS(r, false)
+	if prob != nil {
+		s.writeProblem(w, prob)
+		return
+	}
+	s.mu.Lock()
+	o := s.certs[strings.TrimPrefix(r.URL.Path, "/acme/cert/")]
+	s.mu.Unlock()
+	if o == nil || o.account != req.account {
+		s.writeProblem(w, acmeError(http.StatusNotFound, "malformed", "certificate not found"))
+		return
+	}
+	s.setHeaders(w)
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	io.Copy(w, bytes.NewReader(o.cert))
+}
+
+// handleRevokeCert revokes a certificate issued to the requesting account.
+// Requests signed with the certificate key are not supported.
+func (s *acmeServer) handleRevokeCert(w http.ResponseWriter, r *http.Request) {
+	req, prob := s.parseJWS(r, false)
+	if prob != nil {
+		s.writeProblem(w, prob)
+		return
+	}
+	var payload struct {
+		Certificate string `json:"certificate"`
+		Reason      int    `json:"reason"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		s.writeProblem(w, acmeError(http.StatusBadRequest, "malformed", "failed to parse revocation request: %s", err))
+		return
+	}
+	// Reason 7 is unused, and 8 (removeFromCRL) only applies to delta CRLs.
+	if payload.Reason < 0 || payload.Reason == 7 || payload.Reason == 8 || payload.Reason > 10 {
+		s.writeProblem(w, acmeError(http.StatusBadRequest, "badRevocationReason", "unsupported revocation reason %d", payload.Reason))
+		return
+	}
+	der, err := base64.RawURLEncoding.DecodeString(payload.Certificate)
+	if err != nil {
+		s.writeProblem(w, acmeError(http.StatusBadRequest, "malformed", "failed to decode certificate: %s", err))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var issued bool
+	for _, o := range s.certs {
+		if block, _ := pem.Decode(o.cert); o.account == req.account && block != nil && bytes.Equal(block.Bytes, der) {
+			issued = true
+			break
+		}
+	}
+	if !issued {
+		s.writeProblem(w, acmeError(http.StatusForbidden, "unauthorized", "certificate was not issued to this account"))
+		return
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		s.writeProblem(w, acmeError(http.StatusBadRequest, "malformed", "failed to parse certificate: %s", err))
+		return
+	}
+	if r, err := s.m.ca.Revocation(cert.SerialNumber); err != nil {
+		s.writeProblem(w, acmeError(http.StatusInternalServerError, "serverInternal", "%s", err))
+		return
+	} else if r != nil {
+		s.writeProblem(w, acmeError(http.StatusBadRequest, "alreadyRevoked", "certificate was already revoked"))
+		return
+	}
+	if err := s.m.ca.Revoke(cert.SerialNumber, payload.Reason); err != nil {
+		s.writeProblem(w, acmeError(http.StatusInternalServerError, "serverInternal", "failed to revoke certificate: %s", err))
+		return
+	}
+	log.Printf("Revoked the ACME certificate with serial %s 🚫", ca.FormatSerial(cert.SerialNumber))
+
+	s.setHeaders(w)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *acmeServer) handleKeyChange(w http.ResponseWriter, r *http.Request) {
+	s.writeProblem(w, acmeError(http.StatusForbidden, "unauthorized", "key rollover is not supported by the mkcert ACME server"))
+}
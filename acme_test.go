@@ -0,0 +1,172 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJWKThumbprint(t *testing.T) {
+	// From RFC 7638, Section 3.1.
+	k := &jsonWebKey{
+		Kty: "RSA",
+		N: "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W" +
+			"-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbIS" +
+			"D08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E: "AQAB",
+	}
+	_, thumbprint, err := k.publicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs"; thumbprint != want {
+		t.Errorf("got thumbprint %s, want %s", thumbprint, want)
+	}
+
+	bad := []*jsonWebKey{
+		{Kty: "RSA", N: k.N, E: ""},
+		{Kty: "EC", Crv: "P-256", X: "AQ", Y: "AQ"},
+		{Kty: "EC", Crv: "secp256k1"},
+		{Kty: "OKP", Crv: "Ed25519", X: "AQ"},
+		{Kty: "oct"},
+	}
+	for _, k := range bad {
+		if _, _, err := k.publicKey(); err == nil {
+			t.Errorf("%+v: expected an error", k)
+		}
+	}
+}
+
+func TestVerifyJWS(t *testing.T) {
+	signed := []byte("header.payload")
+	h := sha256.Sum256(signed)
+
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	r, s, _ := ecdsa.Sign(rand.Reader, p256, h[:])
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	if !verifyJWS("ES256", &p256.PublicKey, signed, sig) {
+		t.Errorf("valid ES256 signature rejected")
+	}
+	if verifyJWS("ES384", &p256.PublicKey, signed, sig) {
+		t.Errorf("ES256 signature accepted as ES384")
+	}
+	if verifyJWS("ES256", &p256.PublicKey, []byte("header.other"), sig) {
+		t.Errorf("ES256 signature accepted for other contents")
+	}
+	if verifyJWS("ES256", &p256.PublicKey, signed, sig[:63]) {
+		t.Errorf("truncated ES256 signature accepted")
+	}
+
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	sig = ed25519.Sign(priv, signed)
+	if !verifyJWS("EdDSA", pub, signed, sig) {
+		t.Errorf("valid EdDSA signature rejected")
+	}
+	if verifyJWS("none", pub, signed, sig) {
+		t.Errorf(`"none" accepted`)
+	}
+}
+
+// signJWS returns a flattened JWS of payload signed with key, with a "jwk"
+// header.
+func signJWS(t *testing.T, key *ecdsa.PrivateKey, nonce, url string, payload []byte) string {
+	t.Helper()
+	b64 := base64.RawURLEncoding
+	protected, _ := json.Marshal(map[string]interface{}{
+		"alg":   "ES256",
+		"nonce": nonce,
+		"url":   url,
+		"jwk": &jsonWebKey{
+			Kty: "EC", Crv: "P-256",
+			X: b64.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+			Y: b64.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+		},
+	})
+	signed := b64.EncodeToString(protected) + "." + b64.EncodeToString(payload)
+	h := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	msg, _ := json.Marshal(map[string]string{
+		"protected": b64.EncodeToString(protected),
+		"payload":   b64.EncodeToString(payload),
+		"signature": b64.EncodeToString(sig),
+	})
+	return string(msg)
+}
+
+func TestParseJWS(t *testing.T) {
+	s := &acmeServer{baseURL: "https://acme.test", nonces: make(map[string]time.Time)}
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	post := func(path, body string) (*jwsRequest, *acmeProblem) {
+		r := httptest.NewRequest("POST", path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/jose+json")
+		return s.parseJWS(r, true)
+	}
+
+	nonce := s.newNonce()
+	body := signJWS(t, key, nonce, s.baseURL+"/acme/new-account", []byte(`{}`))
+	req, p := post("/acme/new-account", body)
+	if p != nil {
+		t.Fatalf("valid request rejected: %+v", p)
+	}
+	if string(req.payload) != "{}" || req.thumbprint == "" {
+		t.Errorf("got payload %q, thumbprint %q", req.payload, req.thumbprint)
+	}
+	if _, p := post("/acme/new-account", body); p == nil || p.Type != acmeErrorPrefix+"badNonce" {
+		t.Errorf("replayed request: got %+v", p)
+	}
+
+	body = signJWS(t, key, s.newNonce(), s.baseURL+"/acme/new-order", []byte(`{}`))
+	if _, p := post("/acme/new-account", body); p == nil || p.Type != acmeErrorPrefix+"unauthorized" {
+		t.Errorf("request for another URL: got %+v", p)
+	}
+
+	body = signJWS(t, key, s.newNonce(), s.baseURL+"/acme/new-account", []byte(`{}`))
+	body = strings.Replace(body, `"payload":"e30"`, `"payload":"e3x9"`, 1)
+	if _, p := post("/acme/new-account", body); p == nil || p.Type != acmeErrorPrefix+"badSignatureAlgorithm" {
+		t.Errorf("tampered request: got %+v", p)
+	}
+}
+
+func TestNonces(t *testing.T) {
+	s := &acmeServer{nonces: make(map[string]time.Time)}
+	first := s.newNonce()
+	for i := 0; i < acmeMaxNonces; i++ {
+		s.newNonce()
+	}
+	if len(s.nonces) > acmeMaxNonces || len(s.nonceQueue) > acmeMaxNonces {
+		t.Errorf("got %d nonces, want at most %d", len(s.nonces), acmeMaxNonces)
+	}
+	if s.useNonce(first) {
+		t.Errorf("evicted nonce accepted")
+	}
+
+	old := s.newNonce()
+	s.nonces[old] = time.Now().Add(-acmeNonceLifetime)
+	if s.useNonce(old) {
+		t.Errorf("expired nonce accepted")
+	}
+	n := s.newNonce()
+	if !s.useNonce(n) || s.useNonce(n) {
+		t.Errorf("nonce not usable exactly once")
+	}
+}
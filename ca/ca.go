@@ -0,0 +1,549 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package ca implements the local certificate authority behind mkcert.
+//
+// A CA is stored in a directory (CAROOT) as a root certificate and key, and
+// optionally an intermediate certificate and key that sign all leaves. The
+// root key may be missing, in which case the CA can only be installed in
+// trust stores, or used to sign through the intermediate.
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+)
+
+// Names of the files in the CA directory.
+const (
+	RootName            = "rootCA.pem"
+	RootKeyName         = "rootCA-key.pem"
+	IntermediateName    = "intermediateCA.pem"
+	IntermediateKeyName = "intermediateCA-key.pem"
+)
+
+// Organization is the subject Organization of the root and intermediate
+// certificates of all mkcert CAs.
+const Organization = "mkcert development CA"
+
+var userAndHostname string
+
+func init() {
+	u, err := user.Current()
+	if err == nil {
+		userAndHostname = u.Username + "@"
+	}
+	if h, err := os.Hostname(); err == nil {
+		userAndHostname += h
+	}
+	if err == nil && u.Name != "" && u.Name != u.Username {
+		userAndHostname += " (" + u.Name + ")"
+	}
+}
+
+// A CA is a local certificate authority loaded from a directory.
+type CA struct {
+	// Dir is the directory the CA was loaded from.
+	Dir string
+
+	// Cert is the root certificate. Key is its private key, or nil if the
+	// key is not present in Dir or is encrypted and was not needed yet.
+	Cert *x509.Certificate
+	Key  crypto.PrivateKey
+
+	// IntermediateCert is the optional intermediate certificate, which if
+	// present signs all new certificates. IntermediateKey is its private
+	// key, or nil like Key.
+	IntermediateCert *x509.Certificate
+	IntermediateKey  crypto.PrivateKey
+
+	// CrossCert is the optional root certificate signed by the previous
+	// root, during a rotation. See Rotate.
+	CrossCert *x509.Certificate
+
+	// Passphrase is called to obtain the passphrase of encrypted keys,
+	// at most once and only when a key is needed for signing.
+	Passphrase func() ([]byte, error)
+
+	encryptedKey             []byte
+	encryptedIntermediateKey []byte
+	passphrase               []byte
+}
+
+// A MissingKeyError is returned when a key needed to sign certificates is not
+// present in the CA directory.
+type MissingKeyError struct {
+	// Name is the file name of the missing key, such as RootKeyName.
+	Name string
+}
+
+func (e *MissingKeyError) Error() string {
+	if e.Name == IntermediateKeyName {
+		return "the intermediate key (" + e.Name + ") is missing"
+	}
+	return "the CA key (" + e.Name + ") is missing"
+}
+
+// Options control the generation of new CAs.
+type Options struct {
+	// KeyType is the type of the CA key, one of KeyTypes. It defaults to
+	// RSA-3072.
+	KeyType string
+
+	// NameConstraints, if not empty, restricts the names the root can
+	// issue certificates for. Each entry is a domain, like "test", which
+	// permits "test" and its subdomains, or an IP range in CIDR notation.
+	// A leading period is ignored, so ".test" is the same as "test". At
+	// least one domain is required, and if no IP ranges are listed, no IP
+	// addresses are permitted.
+	// NameConstraints is ignored by NewIntermediate.
+	NameConstraints []string
+
+	// Passphrase, if not empty, is used to encrypt the root key with
+	// EncryptKey before it's saved. Passphrase is ignored by NewIntermediate,
+	// which uses the passphrase of the root.
+	Passphrase []byte
+}
+
+// Exists reports whether dir contains a CA root certificate.
+func Exists(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, RootName))
+	return err == nil
+}
+
+// LoadCA loads the CA stored in dir. Missing keys are not an error, but
+// leave the corresponding CA fields nil.
+func LoadCA(dir string) (*CA, error) {
+	ca := &CA{Dir: dir}
+
+	var err error
+	ca.Cert, err = readCertFile(filepath.Join(dir, RootName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the CA certificate: %w", err)
+	}
+
+	ca.Key, ca.encryptedKey, err = readKeyFile(filepath.Join(dir, RootKeyName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read the CA key: %w", err)
+	}
+
+	ca.CrossCert, err = readCertFile(filepath.Join(dir, CrossName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read the cross-signed certificate: %w", err)
+	}
+
+	ca.IntermediateCert, err = readCertFile(filepath.Join(dir, IntermediateName))
+	if errors.Is(err, os.ErrNotExist) {
+		return ca, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the intermediate certificate: %w", err)
+	}
+	if err := ca.IntermediateCert.CheckSignatureFrom(ca.Cert); err != nil {
+		return nil, fmt.Errorf("the intermediate was not issued by the CA: %w", err)
+	}
+
+	ca.IntermediateKey, ca.encryptedIntermediateKey, err = readKeyFile(filepath.Join(dir, IntermediateKeyName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read the intermediate key: %w", err)
+	}
+
+	return ca, nil
+}
+
+func readCertFile(path string) (*x509.Certificate, error) {
+	certPEMBlock, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	certDERBlock, _ := pem.Decode(certPEMBlock)
+	if certDERBlock == nil || certDERBlock.Type != "CERTIFICATE" {
+		return nil, errors.New("unexpected content")
+	}
+	return x509.ParseCertificate(certDERBlock.Bytes)
+}
+
+// readKeyFile reads a PEM private key. If the key is encrypted, it's returned
+// as is in encrypted, to be decrypted by decryptKey.
+func readKeyFile(path string) (key crypto.PrivateKey, encrypted []byte, err error) {
+	keyPEMBlock, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDERBlock, _ := pem.Decode(keyPEMBlock)
+	if keyDERBlock != nil && keyDERBlock.Type == encryptedKeyType {
+		return nil, keyPEMBlock, nil
+	}
+	if keyDERBlock == nil || keyDERBlock.Type != "PRIVATE KEY" {
+		return nil, nil, errors.New("unexpected content")
+	}
+	key, err = x509.ParsePKCS8PrivateKey(keyDERBlock.Bytes)
+	return key, nil, err
+}
+
+func writeKeyFile(path string, key crypto.PrivateKey) error {
+	privDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, pem.EncodeToMemory(
+		&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}), 0400)
+}
+
+// WriteFileAtomic writes data to a temporary file and renames it to path, so
+// that an existing file, even a read-only one, is never left partially written.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func writeCertFile(path string, der []byte) error {
+	return ioutil.WriteFile(path, pem.EncodeToMemory(
+		&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// NewCA creates a new root CA and saves it in dir, which must exist.
+// It doesn't check whether a CA already exists in dir.
+func NewCA(dir string, opts *Options) (*CA, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	priv, err := GenerateKey(opts.KeyType, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate the CA key: %w", err)
+	}
+	pub := priv.(crypto.Signer).Public()
+
+	spkiASN1, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode public key: %w", err)
+	}
+
+	var spki struct {
+		Algorithm        pkix.AlgorithmIdentifier
+		SubjectPublicKey asn1.BitString
+	}
+	_, err = asn1.Unmarshal(spkiASN1, &spki)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode public key: %w", err)
+	}
+
+	skid := sha1.Sum(spki.SubjectPublicKey.Bytes)
+
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization:       []string{Organization},
+			OrganizationalUnit: []string{userAndHostname},
+
+			// The CommonName is required by iOS to show the certificate in the
+			// "Certificate Trust Settings" menu.
+			// https://github.com/FiloSottile/mkcert/issues/47
+			CommonName: "mkcert " + userAndHostname,
+		},
+		SubjectKeyId: skid[:],
+
+		NotAfter:  time.Now().AddDate(10, 0, 0),
+		NotBefore: time.Now(),
+
+		KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+
+		// Allow a single intermediate, see NewIntermediate.
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            1,
+	}
+	if len(opts.NameConstraints) > 0 {
+		if err := setNameConstraints(tpl, opts.NameConstraints); err != nil {
+			return nil, err
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, pub, priv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate CA certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CA certificate: %w", err)
+	}
+
+	ca := &CA{Dir: dir, Cert: cert, Key: priv}
+	if len(opts.Passphrase) > 0 {
+		enc, err := EncryptKey(priv, opts.Passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt CA key: %w", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, RootKeyName), enc, 0400); err != nil {
+			return nil, fmt.Errorf("failed to save CA key: %w", err)
+		}
+		ca.encryptedKey, ca.passphrase = enc, opts.Passphrase
+	} else if err := writeKeyFile(filepath.Join(dir, RootKeyName), priv); err != nil {
+		return nil, fmt.Errorf("failed to save CA key: %w", err)
+	}
+	if err := writeCertFile(filepath.Join(dir, RootName), der); err != nil {
+		return nil, fmt.Errorf("failed to save CA certificate: %w", err)
+	}
+
+	return ca, nil
+}
+
+// NewIntermediate creates an intermediate CA signed by the root and saves it
+// in the CA directory. The intermediate will then sign all new certificates,
+// so that the root key can be stored offline.
+func (ca *CA) NewIntermediate(opts *Options) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if ca.IntermediateCert != nil {
+		return fmt.Errorf("an intermediate already exists at %s", filepath.Join(ca.Dir, IntermediateName))
+	}
+	if ca.Cert.MaxPathLenZero {
+		return errors.New("the CA was created by an older version of mkcert and can't have intermediates")
+	}
+	rootKey, err := ca.rootKey()
+	if err != nil {
+		return err
+	}
+
+	priv, err := GenerateKey(opts.KeyType, true)
+	if err != nil {
+		return fmt.Errorf("failed to generate the intermediate key: %w", err)
+	}
+	pub := priv.(crypto.Signer).Public()
+
+	// The intermediate can't outlive the root.
+	expiration := time.Now().AddDate(5, 0, 0)
+	if ca.Cert.NotAfter.Before(expiration) {
+		expiration = ca.Cert.NotAfter
+	}
+
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return err
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization:       []string{Organization},
+			OrganizationalUnit: []string{userAndHostname},
+			CommonName:         "mkcert intermediate " + userAndHostname,
+		},
+
+		NotAfter:  expiration,
+		NotBefore: time.Now(),
+
+		KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, ca.Cert, pub, rootKey)
+	if err != nil {
+		return fmt.Errorf("failed to generate intermediate certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return fmt.Errorf("failed to parse intermediate certificate: %w", err)
+	}
+
+	// If the root key is encrypted, encrypt the intermediate key with the
+	// same passphrase.
+	if ca.encryptedKey != nil {
+		enc, err := EncryptKey(priv, ca.passphrase)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt intermediate key: %w", err)
+		}
+		err = ioutil.WriteFile(filepath.Join(ca.Dir, IntermediateKeyName), enc, 0400)
+		if err != nil {
+			return fmt.Errorf("failed to save intermediate key: %w", err)
+		}
+		ca.encryptedIntermediateKey = enc
+	} else if err := writeKeyFile(filepath.Join(ca.Dir, IntermediateKeyName), priv); err != nil {
+		return fmt.Errorf("failed to save intermediate key: %w", err)
+	}
+	if err := writeCertFile(filepath.Join(ca.Dir, IntermediateName), der); err != nil {
+		return fmt.Errorf("failed to save intermediate certificate: %w", err)
+	}
+
+	ca.IntermediateCert, ca.IntermediateKey = cert, priv
+	return nil
+}
+
+// UniqueName returns a name for the root that is unique across CAs, used
+// as the nickname or alias when installing it in trust stores.
+func (ca *CA) UniqueName() string {
+	return "mkcert development CA " + ca.Cert.SerialNumber.String()
+}
+
+// rootKey returns the root key, decrypting it if necessary.
+func (ca *CA) rootKey() (crypto.PrivateKey, error) {
+	if ca.Key == nil && ca.encryptedKey != nil {
+		key, err := ca.decryptKey(ca.encryptedKey, RootKeyName)
+		if err != nil {
+			return nil, err
+		}
+		ca.Key = key
+	}
+	if ca.Key == nil {
+		return nil, &MissingKeyError{Name: RootKeyName}
+	}
+	return ca.Key, nil
+}
+
+// intermediateKey returns the intermediate key, decrypting it if necessary.
+func (ca *CA) intermediateKey() (crypto.PrivateKey, error) {
+	if ca.IntermediateKey == nil && ca.encryptedIntermediateKey != nil {
+		key, err := ca.decryptKey(ca.encryptedIntermediateKey, IntermediateKeyName)
+		if err != nil {
+			return nil, err
+		}
+		ca.IntermediateKey = key
+	}
+	if ca.IntermediateKey == nil {
+		return nil, &MissingKeyError{Name: IntermediateKeyName}
+	}
+	return ca.IntermediateKey, nil
+}
+
+// signer returns the certificate and key that sign new leaves: the
+// intermediate if there is one, or the root otherwise.
+func (ca *CA) signer() (*x509.Certificate, crypto.PrivateKey, error) {
+	if ca.IntermediateCert != nil {
+		key, err := ca.intermediateKey()
+		if err != nil {
+			return nil, nil, err
+		}
+		return ca.IntermediateCert, key, nil
+	}
+	key, err := ca.rootKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	return ca.Cert, key, nil
+}
+
+// CanSign returns nil if the CA can sign new certificates, or the reason it
+// can't, such as a *MissingKeyError. If the signing key is encrypted, it
+// calls Passphrase and decrypts it.
+func (ca *CA) CanSign() error {
+	_, _, err := ca.signer()
+	return err
+}
+
+// Chain returns the certificates between a leaf and the root, excluding both.
+// During a rotation, it ends with the cross-signed root, if any, so that the
+// chain also leads to the previous root.
+func (ca *CA) Chain() []*x509.Certificate {
+	var chain []*x509.Certificate
+	if ca.IntermediateCert != nil {
+		chain = append(chain, ca.IntermediateCert)
+	}
+	if ca.CrossCert != nil {
+		chain = append(chain, ca.CrossCert)
+	}
+	return chain
+}
+
+// ChainPEM encodes cert as PEM, followed by the rest of the chain as returned
+// by Chain. The root is left out, as it's expected to be trusted.
+func (ca *CA) ChainPEM(cert *x509.Certificate) []byte {
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	for _, c := range ca.Chain() {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+	return chain
+}
+
+// Key types, as accepted by GenerateKey and returned by KeyTypeOf.
+const (
+	KeyTypeRSA2048 = "rsa2048"
+	KeyTypeRSA3072 = "rsa3072"
+	KeyTypeRSA4096 = "rsa4096"
+	KeyTypeP256    = "p256"
+	KeyTypeP384    = "p384"
+	KeyTypeP521    = "p521"
+	KeyTypeEd25519 = "ed25519"
+)
+
+// KeyTypes lists all the key types supported by GenerateKey.
+var KeyTypes = []string{
+	KeyTypeRSA2048, KeyTypeRSA3072, KeyTypeRSA4096,
+	KeyTypeP256, KeyTypeP384, KeyTypeP521, KeyTypeEd25519,
+}
+
+// GenerateKey generates a new private key of the given type. If keyType is
+// empty, it generates an RSA key of 3072 bits for CAs and 2048 bits for leaves.
+func GenerateKey(keyType string, rootCA bool) (crypto.PrivateKey, error) {
+	if keyType == "" && rootCA {
+		keyType = KeyTypeRSA3072
+	} else if keyType == "" {
+		keyType = KeyTypeRSA2048
+	}
+	switch keyType {
+	case KeyTypeRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyTypeRSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case KeyTypeRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case KeyTypeP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyTypeP521:
+		return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case KeyTypeEd25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", keyType)
+	}
+}
+
+func randomSerialNumber() (*big.Int, error) {
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+	return serialNumber, nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ca
+
+import (
+	"errors"
+	"testing"
+)
+
+// newTestCA creates a CA with a P-256 key, which is much faster to generate
+// than the default RSA key, in a temporary directory.
+func newTestCA(t *testing.T, opts *Options) *CA {
+	t.Helper()
+	if opts == nil {
+		opts = &Options{}
+	}
+	if opts.KeyType == "" {
+		opts.KeyType = KeyTypeP256
+	}
+	ca, err := NewCA(t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+func TestLoadCA(t *testing.T) {
+	ca := newTestCA(t, nil)
+	if err := ca.NewIntermediate(&Options{KeyType: KeyTypeP256}); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadCA(ca.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Cert.Equal(ca.Cert) || !loaded.IntermediateCert.Equal(ca.IntermediateCert) {
+		t.Error("loaded certificates don't match")
+	}
+	if loaded.Key == nil || loaded.IntermediateKey == nil {
+		t.Error("keys were not loaded")
+	}
+	if loaded.Encrypted() {
+		t.Error("plaintext keys reported as encrypted")
+	}
+	if err := ca.IntermediateCert.CheckSignatureFrom(ca.Cert); err != nil {
+		t.Errorf("intermediate not signed by the root: %v", err)
+	}
+	if !ca.IntermediateCert.MaxPathLenZero || ca.Cert.MaxPathLen != 1 {
+		t.Error("unexpected path length constraints")
+	}
+	if err := ca.NewIntermediate(nil); err == nil {
+		t.Error("a second intermediate was created")
+	}
+}
+
+func TestMissingKey(t *testing.T) {
+	ca := newTestCA(t, nil)
+	ca.Key = nil
+	var missing *MissingKeyError
+	if err := ca.CanSign(); !errors.As(err, &missing) || missing.Name != RootKeyName {
+		t.Errorf("got %v, want a MissingKeyError for %s", err, RootKeyName)
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ca
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// A NameConstraintError is returned when a certificate would include a name
+// that is not permitted by the name constraints of the CA.
+type NameConstraintError struct {
+	Name      string
+	Permitted []string
+}
+
+func (e *NameConstraintError) Error() string {
+	return fmt.Sprintf("%q is not permitted by the CA name constraints (%s)", e.Name, strings.Join(e.Permitted, ", "))
+}
+
+// setNameConstraints parses constraints, a list of domains (like "test") and
+// IP ranges in CIDR notation, and applies them to tpl. A leading period is
+// stripped from domains, see Options.NameConstraints.
+//
+// Name constraints only restrict the name types they list, so the domains
+// also constrain email addresses and URIs, and if no IP ranges are given all
+// IP addresses are excluded.
+func setNameConstraints(tpl *x509.Certificate, constraints []string) error {
+	for _, c := range constraints {
+		c = strings.ToLower(strings.TrimSpace(c))
+		if c == "" {
+			continue
+		}
+		if _, ipNet, err := net.ParseCIDR(c); err == nil {
+			tpl.PermittedIPRanges = append(tpl.PermittedIPRanges, ipNet)
+			continue
+		}
+		if ip := net.ParseIP(c); ip != nil {
+			return fmt.Errorf("invalid name constraint %q: IP addresses must be in CIDR notation", c)
+		}
+		domain := strings.TrimPrefix(c, ".")
+		if domain == "" || strings.ContainsAny(domain, "*@/: ") {
+			return fmt.Errorf("invalid name constraint %q", c)
+		}
+		tpl.PermittedDNSDomains = append(tpl.PermittedDNSDomains, domain)
+		tpl.PermittedEmailAddresses = append(tpl.PermittedEmailAddresses, domain, "."+domain)
+		tpl.PermittedURIDomains = append(tpl.PermittedURIDomains, domain, "."+domain)
+	}
+	if len(tpl.PermittedDNSDomains) == 0 {
+		return errors.New("name constraints must include at least one domain")
+	}
+	if len(tpl.PermittedIPRanges) == 0 {
+		tpl.ExcludedIPRanges = []*net.IPNet{
+			{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+			{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)},
+		}
+	}
+	tpl.PermittedDNSDomainsCritical = true
+	return nil
+}
+
+// NameConstraints returns a readable list of the names permitted by the
+// CA certificates, or nil if they are unconstrained.
+func (ca *CA) NameConstraints() []string {
+	var permitted []string
+	for _, c := range ca.constrainingCerts() {
+		permitted = append(permitted, c.PermittedDNSDomains...)
+		for _, r := range c.PermittedIPRanges {
+			permitted = append(permitted, r.String())
+		}
+	}
+	return permitted
+}
+
+func (ca *CA) constrainingCerts() []*x509.Certificate {
+	if ca.IntermediateCert != nil {
+		return []*x509.Certificate{ca.Cert, ca.IntermediateCert}
+	}
+	return []*x509.Certificate{ca.Cert}
+}
+
+// checkNameConstraints returns a *NameConstraintError if any of the tpl
+// names is not permitted by the root or intermediate name constraints.
+func (ca *CA) checkNameConstraints(tpl *x509.Certificate) error {
+	for _, c := range ca.constrainingCerts() {
+		for _, name := range tpl.DNSNames {
+			if !dnsPermitted(c, name) {
+				return &NameConstraintError{Name: name, Permitted: ca.NameConstraints()}
+			}
+		}
+		for _, ip := range tpl.IPAddresses {
+			if !ipPermitted(c, ip) {
+				return &NameConstraintError{Name: ip.String(), Permitted: ca.NameConstraints()}
+			}
+		}
+		for _, email := range tpl.EmailAddresses {
+			if !emailPermitted(c, email) {
+				return &NameConstraintError{Name: email, Permitted: ca.NameConstraints()}
+			}
+		}
+		for _, uri := range tpl.URIs {
+			if !uriPermitted(c, uri) {
+				return &NameConstraintError{Name: uri.String(), Permitted: ca.NameConstraints()}
+			}
+		}
+	}
+	return nil
+}
+
+// matchDomain reports whether name is within constraint, following RFC 5280:
+// a constraint with a leading period only matches subdomains, otherwise it
+// matches the domain itself and its subdomains.
+func matchDomain(name, constraint string) bool {
+	name, constraint = strings.ToLower(name), strings.ToLower(constraint)
+	if strings.HasPrefix(constraint, ".") {
+		return strings.HasSuffix(name, constraint)
+	}
+	return name == constraint || strings.HasSuffix(name, "."+constraint)
+}
+
+func dnsPermitted(c *x509.Certificate, name string) bool {
+	for _, d := range c.ExcludedDNSDomains {
+		if matchDomain(name, d) {
+			return false
+		}
+	}
+	if len(c.PermittedDNSDomains) == 0 {
+		return true
+	}
+	for _, d := range c.PermittedDNSDomains {
+		if matchDomain(name, d) {
+			return true
+		}
+	}
+	return false
+}
+
+func ipPermitted(c *x509.Certificate, ip net.IP) bool {
+	for _, r := range c.ExcludedIPRanges {
+		if r.Contains(ip) {
+			return false
+		}
+	}
+	if len(c.PermittedIPRanges) == 0 {
+		return true
+	}
+	for _, r := range c.PermittedIPRanges {
+		if r.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// emailMatches implements the RFC 5280 rules for rfc822Name constraints:
+// a full mailbox, a host, or a domain with a leading period.
+func emailMatches(email, constraint string) bool {
+	if strings.Contains(constraint, "@") {
+		return strings.EqualFold(email, constraint)
+	}
+	i := strings.LastIndex(email, "@")
+	if i < 0 {
+		return false
+	}
+	host := email[i+1:]
+	if strings.HasPrefix(constraint, ".") {
+		return matchDomain(host, constraint)
+	}
+	return strings.EqualFold(host, constraint)
+}
+
+func emailPermitted(c *x509.Certificate, email string) bool {
+	for _, e := range c.ExcludedEmailAddresses {
+		if emailMatches(email, e) {
+			return false
+		}
+	}
+	if len(c.PermittedEmailAddresses) == 0 {
+		return true
+	}
+	for _, e := range c.PermittedEmailAddresses {
+		if emailMatches(email, e) {
+			return true
+		}
+	}
+	return false
+}
+
+func uriMatches(uri *url.URL, constraint string) bool {
+	host := uri.Hostname()
+	if strings.HasPrefix(constraint, ".") {
+		return matchDomain(host, constraint)
+	}
+	return strings.EqualFold(host, constraint)
+}
+
+func uriPermitted(c *x509.Certificate, uri *url.URL) bool {
+	if len(c.PermittedURIDomains) == 0 && len(c.ExcludedURIDomains) == 0 {
+		return true
+	}
+	// URIs with IP hosts can't satisfy domain constraints.
+	if net.ParseIP(uri.Hostname()) != nil {
+		return false
+	}
+	for _, d := range c.ExcludedURIDomains {
+		if uriMatches(uri, d) {
+			return false
+		}
+	}
+	if len(c.PermittedURIDomains) == 0 {
+		return true
+	}
+	for _, d := range c.PermittedURIDomains {
+		if uriMatches(uri, d) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ca
+
+import (
+	"crypto/x509"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSetNameConstraints(t *testing.T) {
+	tests := []struct {
+		constraints []string
+		dns, ips    []string
+		err         bool
+	}{
+		{constraints: []string{"test"}, dns: []string{"test"}},
+		{constraints: []string{".test"}, dns: []string{"test"}},
+		{constraints: []string{" Example.COM ", "", "10.0.0.0/8"}, dns: []string{"example.com"}, ips: []string{"10.0.0.0/8"}},
+		{constraints: []string{"test", "127.0.0.1/8", "::1/128"}, dns: []string{"test"}, ips: []string{"127.0.0.0/8", "::1/128"}},
+		{constraints: []string{"10.0.0.0/8"}, err: true},
+		{constraints: []string{"test", "10.0.0.1"}, err: true},
+		{constraints: []string{"*.test"}, err: true},
+		{constraints: []string{"me@test"}, err: true},
+		{constraints: []string{"."}, err: true},
+		{constraints: []string{"https://test"}, err: true},
+	}
+	for _, tt := range tests {
+		tpl := &x509.Certificate{}
+		err := setNameConstraints(tpl, tt.constraints)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: expected an error", tt.constraints)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.constraints, err)
+			continue
+		}
+		if !reflect.DeepEqual(tpl.PermittedDNSDomains, tt.dns) {
+			t.Errorf("%q: got DNS domains %q, want %q", tt.constraints, tpl.PermittedDNSDomains, tt.dns)
+		}
+		var ips []string
+		for _, r := range tpl.PermittedIPRanges {
+			ips = append(ips, r.String())
+		}
+		if !reflect.DeepEqual(ips, tt.ips) {
+			t.Errorf("%q: got IP ranges %q, want %q", tt.constraints, ips, tt.ips)
+		}
+		if len(tt.ips) == 0 && len(tpl.ExcludedIPRanges) != 2 {
+			t.Errorf("%q: IP addresses are not excluded", tt.constraints)
+		}
+		if len(tt.ips) > 0 && len(tpl.ExcludedIPRanges) != 0 {
+			t.Errorf("%q: IP addresses are excluded", tt.constraints)
+		}
+		if !tpl.PermittedDNSDomainsCritical {
+			t.Errorf("%q: constraints are not critical", tt.constraints)
+		}
+	}
+}
+
+func TestCheckHost(t *testing.T) {
+	ca := newTestCA(t, &Options{NameConstraints: []string{"test", "127.0.0.0/8"}})
+	if err := ca.NewIntermediate(&Options{KeyType: KeyTypeP256}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ca.NameConstraints(), []string{"test", "127.0.0.0/8"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got constraints %q, want %q", got, want)
+	}
+
+	tests := []struct {
+		host      string
+		permitted bool
+	}{
+		{"test", true},
+		{"a.test", true},
+		{"A.b.TEST", true},
+		{"atest", false},
+		{"example.com", false},
+		{"127.0.0.1", true},
+		{"192.168.1.1", false},
+		{"::1", false},
+		{"me@a.test", true},
+		{"me@test", true},
+		{"me@example.com", false},
+		{"https://a.test/path", true},
+		{"https://example.com", false},
+		{"https://127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		err := ca.CheckHost(tt.host)
+		if tt.permitted && err != nil {
+			t.Errorf("%s: %v", tt.host, err)
+		}
+		var nce *NameConstraintError
+		if !tt.permitted && (!errors.As(err, &nce) || nce.Name == "") {
+			t.Errorf("%s: got %v, want a NameConstraintError", tt.host, err)
+		}
+	}
+
+	// The certificates also verify, so clients enforce the same constraints.
+	leaf, err := ca.IssueLeaf(&LeafOptions{Hosts: []string{"a.test", "127.0.0.1"}, KeyType: KeyTypeP256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots, inters := x509.NewCertPool(), x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	inters.AddCert(ca.IntermediateCert)
+	if _, err := leaf.Cert.Verify(x509.VerifyOptions{Roots: roots, Intermediates: inters, DNSName: "a.test"}); err != nil {
+		t.Error(err)
+	}
+	if _, err := ca.IssueLeaf(&LeafOptions{Hosts: []string{"example.com"}, KeyType: KeyTypeP256}); err == nil {
+		t.Error("issued a certificate for a name outside the constraints")
+	}
+}
+
+func TestUnconstrained(t *testing.T) {
+	ca := newTestCA(t, nil)
+	if ca.NameConstraints() != nil {
+		t.Errorf("got constraints %q", ca.NameConstraints())
+	}
+	for _, h := range []string{"example.com", "::1", "me@example.com", "https://127.0.0.1"} {
+		if err := ca.CheckHost(h); err != nil {
+			t.Errorf("%s: %v", h, err)
+		}
+	}
+}
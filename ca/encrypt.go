@@ -0,0 +1,213 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ca
+
+import (
+	"crypto"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// encryptedKeyType is the PEM type of keys encrypted by EncryptKey. The body
+// is a ChaCha20-Poly1305 nonce followed by the sealed PKCS #8 key, and the
+// scrypt parameters and salt are stored in the PEM headers.
+const encryptedKeyType = "MKCERT ENCRYPTED PRIVATE KEY"
+
+const (
+	scryptLogN = 15
+	scryptR    = 8
+	scryptP    = 1
+
+	// scryptMaxLogN bounds the work a crafted key file can demand.
+	scryptMaxLogN = 22
+)
+
+// ErrIncorrectPassphrase is returned when an encrypted key can't be decrypted
+// with the supplied passphrase.
+var ErrIncorrectPassphrase = errors.New("incorrect passphrase")
+
+// EncryptKey encrypts key with a key derived from passphrase with scrypt,
+// and returns it PEM encoded.
+func EncryptKey(key crypto.PrivateKey, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := scryptAEAD(passphrase, salt, scryptLogN, scryptR, scryptP)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type: encryptedKeyType,
+		Headers: map[string]string{
+			"KDF":  "scrypt",
+			"Salt": base64.StdEncoding.EncodeToString(salt),
+			"LogN": strconv.Itoa(scryptLogN),
+			"R":    strconv.Itoa(scryptR),
+			"P":    strconv.Itoa(scryptP),
+		},
+		Bytes: aead.Seal(nonce, nonce, privDER, nil),
+	}), nil
+}
+
+// DecryptKey decrypts a PEM key produced by EncryptKey.
+func DecryptKey(data, passphrase []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != encryptedKeyType {
+		return nil, errors.New("not an encrypted mkcert key")
+	}
+	if block.Headers["KDF"] != "scrypt" {
+		return nil, fmt.Errorf("unsupported KDF %q", block.Headers["KDF"])
+	}
+	salt, err := base64.StdEncoding.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, errors.New("invalid salt")
+	}
+	var params [3]int
+	for i, name := range []string{"LogN", "R", "P"} {
+		params[i], err = strconv.Atoi(block.Headers[name])
+		if err != nil || params[i] <= 0 {
+			return nil, fmt.Errorf("invalid scrypt parameter %s", name)
+		}
+	}
+	if params[0] > scryptMaxLogN {
+		return nil, errors.New("scrypt work factor too high")
+	}
+	aead, err := scryptAEAD(passphrase, salt, params[0], params[1], params[2])
+	if err != nil {
+		return nil, err
+	}
+	if len(block.Bytes) < aead.NonceSize() {
+		return nil, errors.New("truncated encrypted key")
+	}
+	nonce, ciphertext := block.Bytes[:aead.NonceSize()], block.Bytes[aead.NonceSize():]
+	privDER, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, ErrIncorrectPassphrase
+	}
+	return x509.ParsePKCS8PrivateKey(privDER)
+}
+
+func scryptAEAD(passphrase, salt []byte, logN, r, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, 1<<logN, r, p, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(key)
+}
+
+// Encrypted reports whether the CA keys are stored encrypted, that is, at
+// least one of the root and intermediate keys is encrypted and neither is
+// stored in plaintext.
+func (ca *CA) Encrypted() bool {
+	if ca.Key != nil && ca.encryptedKey == nil {
+		return false
+	}
+	if ca.IntermediateKey != nil && ca.encryptedIntermediateKey == nil {
+		return false
+	}
+	return ca.encryptedKey != nil || ca.encryptedIntermediateKey != nil
+}
+
+// EncryptKeys encrypts the root and intermediate keys in the CA directory
+// with passphrase, replacing the plaintext files. At least one of the keys
+// must be present in plaintext. If the other is already encrypted, it must be
+// with the same passphrase.
+//
+// Both keys are encrypted before either file is replaced.
+func (ca *CA) EncryptKeys(passphrase []byte) error {
+	if ca.Encrypted() {
+		return errors.New("the CA keys are already encrypted")
+	}
+	rootPlain := ca.Key != nil && ca.encryptedKey == nil
+	intermediatePlain := ca.IntermediateKey != nil && ca.encryptedIntermediateKey == nil
+	if !rootPlain && !intermediatePlain {
+		return &MissingKeyError{Name: RootKeyName}
+	}
+	for _, enc := range [][]byte{ca.encryptedKey, ca.encryptedIntermediateKey} {
+		if enc == nil {
+			continue
+		}
+		if _, err := DecryptKey(enc, passphrase); err != nil {
+			return fmt.Errorf("failed to decrypt the already encrypted key: %w", err)
+		}
+	}
+
+	var encKey, encIntermediateKey []byte
+	var err error
+	if rootPlain {
+		encKey, err = EncryptKey(ca.Key, passphrase)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt the CA key: %w", err)
+		}
+	}
+	if intermediatePlain {
+		encIntermediateKey, err = EncryptKey(ca.IntermediateKey, passphrase)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt the intermediate key: %w", err)
+		}
+	}
+
+	if encKey != nil {
+		if err := WriteFileAtomic(filepath.Join(ca.Dir, RootKeyName), encKey, 0400); err != nil {
+			return fmt.Errorf("failed to save the CA key: %w", err)
+		}
+		ca.encryptedKey = encKey
+	}
+	if encIntermediateKey != nil {
+		if err := WriteFileAtomic(filepath.Join(ca.Dir, IntermediateKeyName), encIntermediateKey, 0400); err != nil {
+			return fmt.Errorf("failed to save the intermediate key: %w", err)
+		}
+		ca.encryptedIntermediateKey = encIntermediateKey
+	}
+	ca.passphrase = passphrase
+	return nil
+}
+
+// decryptKey decrypts enc, calling ca.Passphrase the first time a passphrase
+// is needed.
+func (ca *CA) decryptKey(enc []byte, name string) (crypto.PrivateKey, error) {
+	if ca.passphrase == nil {
+		if ca.Passphrase == nil {
+			return nil, fmt.Errorf("the key %s is encrypted, but no passphrase was provided", name)
+		}
+		passphrase, err := ca.Passphrase()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the passphrase for %s: %w", name, err)
+		}
+		key, err := DecryptKey(enc, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt %s: %w", name, err)
+		}
+		ca.passphrase = passphrase
+		return key, nil
+	}
+	key, err := DecryptKey(enc, ca.passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s: %w", name, err)
+	}
+	return key, nil
+}
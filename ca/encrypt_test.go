@@ -0,0 +1,200 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ca
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncryptKey(t *testing.T) {
+	for _, keyType := range []string{KeyTypeRSA2048, KeyTypeP256, KeyTypeP384, KeyTypeEd25519} {
+		key, err := GenerateKey(keyType, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		enc, err := EncryptKey(key, []byte("hunter2"))
+		if err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+		if !bytes.Contains(enc, []byte(encryptedKeyType)) {
+			t.Errorf("%s: key not encrypted", keyType)
+		}
+
+		dec, err := DecryptKey(enc, []byte("hunter2"))
+		if err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+		if !key.(interface{ Equal(crypto.PrivateKey) bool }).Equal(dec) {
+			t.Errorf("%s: decrypted key doesn't match", keyType)
+		}
+		if _, err := DecryptKey(enc, []byte("hunter3")); !errors.Is(err, ErrIncorrectPassphrase) {
+			t.Errorf("%s: wrong passphrase: got %v", keyType, err)
+		}
+	}
+
+	key, _ := GenerateKey(KeyTypeP256, false)
+	if _, err := EncryptKey(key, nil); err == nil {
+		t.Error("empty passphrase accepted")
+	}
+}
+
+func TestDecryptKeyErrors(t *testing.T) {
+	key, _ := GenerateKey(KeyTypeP256, false)
+	enc, err := EncryptKey(key, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(enc)
+
+	tests := []struct {
+		name   string
+		modify func(b *pem.Block)
+		want   string
+	}{
+		{"type", func(b *pem.Block) { b.Type = "PRIVATE KEY" }, "not an encrypted mkcert key"},
+		{"kdf", func(b *pem.Block) { b.Headers["KDF"] = "pbkdf2" }, "unsupported KDF"},
+		{"salt", func(b *pem.Block) { b.Headers["Salt"] = "!" }, "invalid salt"},
+		{"logn", func(b *pem.Block) { b.Headers["LogN"] = "x" }, "invalid scrypt parameter LogN"},
+		{"zero r", func(b *pem.Block) { b.Headers["R"] = "0" }, "invalid scrypt parameter R"},
+		{"work", func(b *pem.Block) { b.Headers["LogN"] = "30" }, "work factor too high"},
+		{"truncated", func(b *pem.Block) { b.Bytes = b.Bytes[:4] }, "truncated"},
+		{"tampered", func(b *pem.Block) { b.Bytes[len(b.Bytes)-1] ^= 1 }, ErrIncorrectPassphrase.Error()},
+	}
+	for _, tt := range tests {
+		b := &pem.Block{Type: block.Type, Headers: make(map[string]string), Bytes: append([]byte{}, block.Bytes...)}
+		for k, v := range block.Headers {
+			b.Headers[k] = v
+		}
+		tt.modify(b)
+		_, err := DecryptKey(pem.EncodeToMemory(b), []byte("hunter2"))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestEncryptedCA(t *testing.T) {
+	ca := newTestCA(t, &Options{Passphrase: []byte("hunter2")})
+	if !ca.Encrypted() {
+		t.Error("new CA not encrypted")
+	}
+
+	loaded, err := LoadCA(ca.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Key != nil || !loaded.Encrypted() {
+		t.Fatal("encrypted key was not left encrypted")
+	}
+	if err := loaded.CanSign(); err == nil {
+		t.Error("signed without a passphrase")
+	}
+
+	calls := 0
+	loaded.Passphrase = func() ([]byte, error) {
+		calls++
+		return []byte("hunter2"), nil
+	}
+	if err := loaded.NewIntermediate(&Options{KeyType: KeyTypeP256}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loaded.IssueLeaf(&LeafOptions{Hosts: []string{"example.test"}, KeyType: KeyTypeP256}); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("Passphrase called %d times, want 1", calls)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(ca.Dir, IntermediateKeyName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(encryptedKeyType)) {
+		t.Error("intermediate key saved in plaintext")
+	}
+
+	wrong, err := LoadCA(ca.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong.Passphrase = func() ([]byte, error) { return []byte("hunter3"), nil }
+	if err := wrong.CanSign(); !errors.Is(err, ErrIncorrectPassphrase) {
+		t.Errorf("wrong passphrase: got %v", err)
+	}
+}
+
+func TestEncryptKeys(t *testing.T) {
+	ca := newTestCA(t, nil)
+	if err := ca.NewIntermediate(&Options{KeyType: KeyTypeP256}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.EncryptKeys([]byte("hunter2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.EncryptKeys([]byte("hunter2")); err == nil {
+		t.Error("keys encrypted twice")
+	}
+
+	loaded, err := LoadCA(ca.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Key != nil || loaded.IntermediateKey != nil {
+		t.Fatal("keys left in plaintext")
+	}
+	loaded.Passphrase = func() ([]byte, error) { return []byte("hunter2"), nil }
+	if _, err := loaded.rootKey(); err != nil {
+		t.Error(err)
+	}
+	if _, err := loaded.intermediateKey(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEncryptKeysPartial(t *testing.T) {
+	// A CA whose root key is encrypted but whose intermediate key is not.
+	ca := newTestCA(t, nil)
+	if err := ca.NewIntermediate(&Options{KeyType: KeyTypeP256}); err != nil {
+		t.Fatal(err)
+	}
+	enc, err := EncryptKey(ca.Key, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomic(filepath.Join(ca.Dir, RootKeyName), enc, 0400); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadCA(ca.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Encrypted() {
+		t.Error("a plaintext intermediate key reported as encrypted")
+	}
+	if err := loaded.EncryptKeys([]byte("hunter3")); err == nil {
+		t.Error("encrypted the keys with a different passphrase")
+	}
+	if err := loaded.EncryptKeys([]byte("hunter2")); err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Encrypted() {
+		t.Error("keys not reported as encrypted")
+	}
+
+	loaded, err = LoadCA(ca.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.IntermediateKey != nil || !loaded.Encrypted() {
+		t.Error("intermediate key left in plaintext")
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ca
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IndexName is the name of the file in the CA directory that records every
+// certificate issued by the CA, as one JSON Record per line.
+const IndexName = "index.jsonl"
+
+// Sources of issued certificates, for Record.Source.
+const (
+	SourceGenerated = "generated" // with a key generated by mkcert
+	SourceCSR       = "csr"       // from a CSR
+	SourceACME      = "acme"      // by the ACME server
+	SourceRenewed   = "renewed"   // by renewing an existing certificate
+)
+
+// A Record describes a certificate issued by the CA.
+type Record struct {
+	Serial    string    `json:"serial"` // lowercase hex
+	Names     []string  `json:"names"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	KeyType   string    `json:"key_type"`
+	Source    string    `json:"source"`
+	Files     []string  `json:"files,omitempty"`
+	Issued    time.Time `json:"issued"`
+}
+
+// NewRecord returns a Record for cert. files are the paths the certificate
+// and its key were written to, if any, and are made absolute.
+func NewRecord(cert *x509.Certificate, source string, files ...string) *Record {
+	r := &Record{
+		Serial:    FormatSerial(cert.SerialNumber),
+		Names:     CertificateNames(cert),
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+		KeyType:   KeyTypeOf(cert.PublicKey),
+		Source:    source,
+		Issued:    time.Now(),
+	}
+	for _, f := range files {
+		if abs, err := filepath.Abs(f); err == nil {
+			f = abs
+		}
+		r.Files = append(r.Files, f)
+	}
+	return r
+}
+
+// FormatSerial formats a serial number like Record.Serial.
+func FormatSerial(serial *big.Int) string {
+	return fmt.Sprintf("%x", serial)
+}
+
+// ParseSerial parses a hex serial number, optionally with colons between
+// bytes, like those printed by OpenSSL.
+func ParseSerial(s string) (*big.Int, error) {
+	s = strings.ToLower(strings.ReplaceAll(s, ":", ""))
+	s = strings.TrimPrefix(s, "0x")
+	serial, ok := new(big.Int).SetString(s, 16)
+	if !ok || serial.Sign() <= 0 {
+		return nil, fmt.Errorf("invalid serial number %q", s)
+	}
+	return serial, nil
+}
+
+// CertificateNames returns the SANs of cert, in the order DNS names, email
+// addresses, IP addresses and URIs.
+func CertificateNames(cert *x509.Certificate) []string {
+	var names []string
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+// KeyTypeOf returns a short name for the type of pub, like the KeyType
+// constants, or "unknown".
+func KeyTypeOf(pub crypto.PublicKey) string {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return "rsa" + strconv.Itoa(pub.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "p" + strconv.Itoa(pub.Curve.Params().BitSize)
+	case ed25519.PublicKey:
+		return "ed25519"
+	default:
+		return "unknown"
+	}
+}
+
+// Record appends r to the CA index.
+func (ca *CA) Record(r *Record) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(ca.Dir, IndexName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open the index: %w", err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write to the index: %w", err)
+	}
+	return f.Close()
+}
+
+// Inventory returns all the records in the CA index, in issuance order.
+func (ca *CA) Inventory() ([]*Record, error) {
+	f, err := os.Open(filepath.Join(ca.Dir, IndexName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the index: %w", err)
+	}
+	defer f.Close()
+
+	var records []*Record
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		r := &Record{}
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			return nil, fmt.Errorf("failed to parse the index at line %d: %w", line, err)
+		}
+		records = append(records, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the index: %w", err)
+	}
+	return records, nil
+}
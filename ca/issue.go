@@ -0,0 +1,292 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ca
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"time"
+)
+
+// LeafOptions describe a certificate to be issued by IssueLeaf.
+type LeafOptions struct {
+	// Hosts are the names the certificate is valid for. Each is added as
+	// an IP address, email address, URI or DNS name SAN, and the EKUs are
+	// selected accordingly. Hosts must already be validated and normalized.
+	Hosts []string
+
+	// Client adds the clientAuth EKU.
+	Client bool
+
+	// ExtKeyUsage, if not nil, is used instead of the EKUs selected based
+	// on Hosts and Client.
+	ExtKeyUsage []x509.ExtKeyUsage
+
+	// CommonName is set in the Subject if not empty.
+	CommonName string
+
+	// KeyType is the type of the generated key, one of KeyTypes. It
+	// defaults to RSA-2048.
+	KeyType string
+
+	// PublicKey, if not nil, is the key the certificate is issued for. In
+	// that case no private key is generated, and Leaf.Key is nil.
+	PublicKey crypto.PublicKey
+
+	// NotBefore and NotAfter, if not zero, set the validity period. They
+	// default to now and to 2 years and 3 months after NotBefore. The
+	// period can't be longer than MaxValidity.
+	NotBefore, NotAfter time.Time
+
+	// CRLDistributionPoints are URLs where the CRL generated by CA.CRL will
+	// be published, if any.
+	CRLDistributionPoints []string
+
+	// OCSPServer are URLs of OCSP responders backed by CA.OCSPResponse, if
+	// any, included in the Authority Information Access extension.
+	OCSPServer []string
+}
+
+// A Leaf is a certificate issued by the CA, along with its private key if it
+// was generated by IssueLeaf.
+type Leaf struct {
+	Cert *x509.Certificate
+	Key  crypto.PrivateKey
+}
+
+// MaxValidity is the longest validity period accepted by macOS and iOS for
+// all certificates, including those issued by custom roots.
+// See https://support.apple.com/en-us/HT210176.
+const MaxValidity = 825 * 24 * time.Hour
+
+// validityPeriod applies the defaults to a requested validity period, and
+// checks it against MaxValidity.
+//
+// By default, certificates are valid from now and last for 2 years and
+// 3 months, which is always less than 825 days.
+func validityPeriod(notBefore, notAfter time.Time) (time.Time, time.Time, error) {
+	if notBefore.IsZero() {
+		notBefore = time.Now()
+	}
+	if notAfter.IsZero() {
+		notAfter = notBefore.AddDate(2, 3, 0)
+	}
+	if !notAfter.After(notBefore) {
+		return time.Time{}, time.Time{}, errors.New("the certificate would expire before it becomes valid")
+	}
+	if notAfter.Sub(notBefore) > MaxValidity {
+		return time.Time{}, time.Time{}, fmt.Errorf("the validity period is longer than %d days, which macOS and iOS reject", MaxValidity/(24*time.Hour))
+	}
+	return notBefore, notAfter, nil
+}
+
+// IssueLeaf issues a new end-entity certificate.
+func (ca *CA) IssueLeaf(opts *LeafOptions) (*Leaf, error) {
+	if len(opts.Hosts) == 0 {
+		return nil, errors.New("no hosts specified")
+	}
+	if err := ca.CanSign(); err != nil {
+		return nil, err
+	}
+	notBefore, notAfter, err := validityPeriod(opts.NotBefore, opts.NotAfter)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf := &Leaf{}
+	pub := opts.PublicKey
+	if pub == nil {
+		priv, err := GenerateKey(opts.KeyType, false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate certificate key: %w", err)
+		}
+		leaf.Key = priv
+		pub = priv.(crypto.Signer).Public()
+	}
+
+	tpl := &x509.Certificate{
+		Subject: pkix.Name{
+			Organization:       []string{"mkcert development certificate"},
+			OrganizationalUnit: []string{userAndHostname},
+			CommonName:         opts.CommonName,
+		},
+
+		NotBefore: notBefore, NotAfter: notAfter,
+
+		KeyUsage: x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+
+		CRLDistributionPoints: opts.CRLDistributionPoints,
+		OCSPServer:            opts.OCSPServer,
+	}
+
+	for _, h := range opts.Hosts {
+		addHost(tpl, h)
+	}
+
+	if opts.Client {
+		tpl.ExtKeyUsage = append(tpl.ExtKeyUsage, x509.ExtKeyUsageClientAuth)
+	}
+	if len(tpl.IPAddresses) > 0 || len(tpl.DNSNames) > 0 || len(tpl.URIs) > 0 {
+		tpl.ExtKeyUsage = append(tpl.ExtKeyUsage, x509.ExtKeyUsageServerAuth)
+	}
+	if len(tpl.EmailAddresses) > 0 {
+		tpl.ExtKeyUsage = append(tpl.ExtKeyUsage, x509.ExtKeyUsageEmailProtection)
+	}
+	if opts.ExtKeyUsage != nil {
+		tpl.ExtKeyUsage = opts.ExtKeyUsage
+	}
+
+	cert, err := ca.Sign(tpl, pub)
+	if err != nil {
+		return nil, err
+	}
+	leaf.Cert = cert
+	return leaf, nil
+}
+
+// addHost adds h to tpl as an IP address, email address, URI or DNS name.
+func addHost(tpl *x509.Certificate, h string) {
+	if ip := net.ParseIP(h); ip != nil {
+		tpl.IPAddresses = append(tpl.IPAddresses, ip)
+	} else if email, err := mail.ParseAddress(h); err == nil && email.Address == h {
+		tpl.EmailAddresses = append(tpl.EmailAddresses, h)
+	} else if uriName, err := url.Parse(h); err == nil && uriName.Scheme != "" && uriName.Host != "" {
+		tpl.URIs = append(tpl.URIs, uriName)
+	} else {
+		tpl.DNSNames = append(tpl.DNSNames, h)
+	}
+}
+
+// CheckHost returns a *NameConstraintError if the CA name constraints don't
+// permit issuing a certificate for h, which is interpreted like
+// LeafOptions.Hosts.
+func (ca *CA) CheckHost(h string) error {
+	tpl := &x509.Certificate{}
+	addHost(tpl, h)
+	return ca.checkNameConstraints(tpl)
+}
+
+// CSROptions control how SignCSR issues a certificate.
+type CSROptions struct {
+	// Client adds the clientAuth EKU.
+	Client bool
+
+	// Strict makes SignCSR return a *CSRPolicyError instead of dropping
+	// the parts of the CSR that the issuance policy does not allow.
+	Strict bool
+
+	// NotBefore, NotAfter, CRLDistributionPoints and OCSPServer are like
+	// the LeafOptions fields.
+	NotBefore, NotAfter   time.Time
+	CRLDistributionPoints []string
+	OCSPServer            []string
+}
+
+// SignCSR issues a certificate for a CSR, after checking its signature.
+//
+// The requested DNS, email, IP and URI SANs, KUs, EKUs and unknown non-critical
+// extensions are copied into the certificate. Everything else, like CA basic
+// constraints, name constraints, other SAN types, EKUs other than serverAuth,
+// clientAuth and emailProtection, and unknown critical extensions, is dropped
+// and described in the returned list.
+func (ca *CA) SignCSR(csr *x509.CertificateRequest, opts *CSROptions) (*x509.Certificate, []string, error) {
+	if opts == nil {
+		opts = &CSROptions{}
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, nil, fmt.Errorf("invalid CSR signature: %w", err)
+	}
+	notBefore, notAfter, err := validityPeriod(opts.NotBefore, opts.NotAfter)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tpl := &x509.Certificate{
+		Subject: csr.Subject,
+
+		NotBefore: notBefore, NotAfter: notAfter,
+
+		DNSNames:       csr.DNSNames,
+		EmailAddresses: csr.EmailAddresses,
+		IPAddresses:    csr.IPAddresses,
+		URIs:           csr.URIs,
+
+		CRLDistributionPoints: opts.CRLDistributionPoints,
+		OCSPServer:            opts.OCSPServer,
+	}
+	dropped, err := applyCSRPolicy(csr, tpl)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(dropped) > 0 && opts.Strict {
+		return nil, nil, &CSRPolicyError{Dropped: dropped}
+	}
+
+	// If the CSR does not request a SAN extension, fix it up for them as the
+	// Common Name field does not work in modern browsers.
+	if len(csr.DNSNames)+len(csr.EmailAddresses)+len(csr.IPAddresses)+len(csr.URIs) == 0 {
+		tpl.DNSNames = []string{csr.Subject.CommonName}
+	}
+
+	if opts.Client {
+		tpl.ExtKeyUsage = appendExtKeyUsage(tpl.ExtKeyUsage, x509.ExtKeyUsageClientAuth)
+	}
+	if len(csr.EmailAddresses) > 0 {
+		tpl.ExtKeyUsage = appendExtKeyUsage(tpl.ExtKeyUsage, x509.ExtKeyUsageEmailProtection)
+	}
+
+	cert, err := ca.Sign(tpl, csr.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, dropped, nil
+}
+
+func appendExtKeyUsage(ekus []x509.ExtKeyUsage, eku x509.ExtKeyUsage) []x509.ExtKeyUsage {
+	for _, e := range ekus {
+		if e == eku {
+			return ekus
+		}
+	}
+	return append(ekus, eku)
+}
+
+// Sign issues a certificate for pub based on tpl, which is signed by the
+// intermediate if there is one, or by the root otherwise. A random serial
+// number is set if tpl.SerialNumber is nil.
+//
+// If the CA has name constraints, Sign returns a *NameConstraintError if tpl
+// includes a name that is not permitted.
+func (ca *CA) Sign(tpl *x509.Certificate, pub crypto.PublicKey) (*x509.Certificate, error) {
+	if err := ca.checkNameConstraints(tpl); err != nil {
+		return nil, err
+	}
+	signerCert, signerKey, err := ca.signer()
+	if err != nil {
+		return nil, err
+	}
+	if tpl.SerialNumber == nil {
+		tpl.SerialNumber, err = randomSerialNumber()
+		if err != nil {
+			return nil, err
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, signerCert, pub, signerKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse generated certificate: %w", err)
+	}
+	return cert, nil
+}
@@ -0,0 +1,231 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestValidityPeriod(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name                string
+		notBefore, notAfter time.Time
+		wantAfter           time.Time
+		err                 bool
+	}{
+		{name: "default end", notBefore: start, wantAfter: start.AddDate(2, 3, 0)},
+		{name: "explicit", notBefore: start, notAfter: start.AddDate(1, 0, 0), wantAfter: start.AddDate(1, 0, 0)},
+		{name: "max", notBefore: start, notAfter: start.Add(MaxValidity), wantAfter: start.Add(MaxValidity)},
+		{name: "too long", notBefore: start, notAfter: start.Add(MaxValidity + time.Second), err: true},
+		{name: "empty", notBefore: start, notAfter: start, err: true},
+		{name: "reversed", notBefore: start, notAfter: start.Add(-time.Hour), err: true},
+	}
+	for _, tt := range tests {
+		notBefore, notAfter, err := validityPeriod(tt.notBefore, tt.notAfter)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !notBefore.Equal(tt.notBefore) || !notAfter.Equal(tt.wantAfter) {
+			t.Errorf("%s: got %v - %v, want %v - %v", tt.name, notBefore, notAfter, tt.notBefore, tt.wantAfter)
+		}
+	}
+
+	// The defaults start now, and fit in MaxValidity even across leap years.
+	notBefore, notAfter, err := validityPeriod(time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(notBefore) > time.Minute || notAfter.Sub(notBefore) > MaxValidity {
+		t.Errorf("unexpected default period %v - %v", notBefore, notAfter)
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	der, err := asn1.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+type basicConstraints struct {
+	IsCA       bool `asn1:"optional"`
+	MaxPathLen int  `asn1:"optional,default:-1"`
+}
+
+func TestSignCSR(t *testing.T) {
+	ca := newTestCA(t, nil)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dirName := mustMarshal(t, pkix.Name{CommonName: "other"}.ToRDNSequence())
+	sans := mustMarshal(t, []asn1.RawValue{
+		{Class: asn1.ClassContextSpecific, Tag: 2, Bytes: []byte("a.test")},
+		{Class: asn1.ClassContextSpecific, Tag: 4, IsCompound: true, Bytes: dirName},
+	})
+	serverAuth := []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	defaultKU := x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature
+
+	tests := []struct {
+		name    string
+		ext     []pkix.Extension
+		dropped []string
+		ku      x509.KeyUsage
+		eku     []x509.ExtKeyUsage
+		isCA    bool
+	}{
+		{name: "plain", ku: defaultKU, eku: serverAuth},
+		{
+			name:    "ca",
+			ext:     []pkix.Extension{{Id: oidExtensionBasicConstraints, Critical: true, Value: mustMarshal(t, basicConstraints{true, -1})}},
+			dropped: []string{"basic constraints (CA:TRUE)"},
+			ku:      defaultKU, eku: serverAuth,
+		},
+		{
+			name: "not ca",
+			ext:  []pkix.Extension{{Id: oidExtensionBasicConstraints, Value: mustMarshal(t, basicConstraints{false, -1})}},
+			ku:   defaultKU, eku: serverAuth,
+		},
+		{
+			name:    "path length",
+			ext:     []pkix.Extension{{Id: oidExtensionBasicConstraints, Value: mustMarshal(t, basicConstraints{false, 2})}},
+			dropped: []string{"basic constraints path length"},
+			ku:      defaultKU, eku: serverAuth,
+		},
+		{
+			name:    "key usage",
+			ext:     []pkix.Extension{{Id: oidExtensionKeyUsage, Critical: true, Value: mustMarshal(t, asn1.BitString{Bytes: []byte{0x86}, BitLength: 7})}},
+			dropped: []string{"keyCertSign key usage", "cRLSign key usage"},
+			ku:      x509.KeyUsageDigitalSignature, eku: serverAuth,
+		},
+		{
+			name: "extended key usage",
+			ext: []pkix.Extension{{Id: oidExtensionExtendedKeyUsage, Value: mustMarshal(t, []asn1.ObjectIdentifier{
+				{1, 3, 6, 1, 5, 5, 7, 3, 3}, {1, 3, 6, 1, 5, 5, 7, 3, 2}, {1, 2, 3, 4},
+			})}},
+			dropped: []string{"codeSigning extended key usage", "1.2.3.4 extended key usage"},
+			ku:      defaultKU, eku: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		},
+		{
+			name:    "name constraints",
+			ext:     []pkix.Extension{{Id: oidExtensionNameConstraints, Critical: true, Value: mustMarshal(t, []asn1.RawValue{})}},
+			dropped: []string{"name constraints"},
+			ku:      defaultKU, eku: serverAuth,
+		},
+		{
+			name:    "critical unknown",
+			ext:     []pkix.Extension{{Id: asn1.ObjectIdentifier{1, 2, 3, 4}, Critical: true, Value: []byte{5, 0}}},
+			dropped: []string{"unknown critical extension 1.2.3.4"},
+			ku:      defaultKU, eku: serverAuth,
+		},
+		{
+			name:    "san types",
+			ext:     []pkix.Extension{{Id: oidExtensionSubjectAltName, Value: sans}},
+			dropped: []string{"directoryName SAN"},
+			ku:      defaultKU, eku: serverAuth,
+		},
+	}
+	for _, tt := range tests {
+		der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			Subject:         pkix.Name{CommonName: "a.test"},
+			ExtraExtensions: tt.ext,
+		}, key)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		cert, dropped, err := ca.SignCSR(csr, nil)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(dropped, tt.dropped) {
+			t.Errorf("%s: dropped %q, want %q", tt.name, dropped, tt.dropped)
+		}
+		if cert.IsCA || cert.KeyUsage != tt.ku || !reflect.DeepEqual(cert.ExtKeyUsage, tt.eku) {
+			t.Errorf("%s: got CA %v, KU %v, EKU %v", tt.name, cert.IsCA, cert.KeyUsage, cert.ExtKeyUsage)
+		}
+		if !reflect.DeepEqual(cert.DNSNames, []string{"a.test"}) {
+			t.Errorf("%s: got DNS names %q", tt.name, cert.DNSNames)
+		}
+
+		_, _, err = ca.SignCSR(csr, &CSROptions{Strict: true})
+		var policyErr *CSRPolicyError
+		if len(tt.dropped) > 0 && (!errors.As(err, &policyErr) || !reflect.DeepEqual(policyErr.Dropped, tt.dropped)) {
+			t.Errorf("%s: strict: got %v", tt.name, err)
+		}
+		if len(tt.dropped) == 0 && err != nil {
+			t.Errorf("%s: strict: %v", tt.name, err)
+		}
+	}
+}
+
+func TestSignCSRExtensions(t *testing.T) {
+	ca := newTestCA(t, nil)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	custom := pkix.Extension{Id: asn1.ObjectIdentifier{1, 2, 3, 4}, Value: []byte{5, 0}}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		EmailAddresses:  []string{"me@example.com"},
+		ExtraExtensions: []pkix.Extension{custom},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr.Signature[0] ^= 1
+	if _, _, err := ca.SignCSR(csr, nil); err == nil {
+		t.Error("accepted a CSR with an invalid signature")
+	}
+	csr.Signature[0] ^= 1
+
+	cert, _, err := ca.SignCSR(csr, &CSROptions{Client: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, ext := range cert.Extensions {
+		found = found || ext.Id.Equal(custom.Id)
+	}
+	if !found {
+		t.Error("non-critical extension not copied")
+	}
+	want := []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageEmailProtection}
+	if !reflect.DeepEqual(cert.ExtKeyUsage, want) {
+		t.Errorf("got EKU %v, want %v", cert.ExtKeyUsage, want)
+	}
+	if len(cert.DNSNames) != 0 {
+		t.Errorf("unexpected DNS names %q", cert.DNSNames)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ca
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// OCSPValidity is how long an OCSP response generated by OCSPResponse is
+// valid for. It's short so that revocations are picked up quickly.
+const OCSPValidity = time.Hour
+
+// OCSPResponse answers an OCSP request for a certificate issued by the CA
+// signer, which is the intermediate if there is one, or the root otherwise.
+// The response is signed directly by the signer.
+//
+// A certificate is reported as revoked if it was revoked with Revoke, as good
+// if it's in the index, and as unknown otherwise. If the request is for a
+// different issuer, an "unauthorized" error response is returned.
+func (ca *CA) OCSPResponse(req *ocsp.Request) ([]byte, error) {
+	signerCert, signerKey, err := ca.signer()
+	if err != nil {
+		return nil, err
+	}
+
+	if !req.HashAlgorithm.Available() {
+		return ocsp.UnauthorizedErrorResponse, nil
+	}
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(signerCert.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return nil, err
+	}
+	h := req.HashAlgorithm.New()
+	h.Write(signerCert.RawSubject)
+	nameHash := h.Sum(nil)
+	h = req.HashAlgorithm.New()
+	h.Write(spki.PublicKey.RightAlign())
+	keyHash := h.Sum(nil)
+	if !bytes.Equal(req.IssuerNameHash, nameHash) || !bytes.Equal(req.IssuerKeyHash, keyHash) {
+		return ocsp.UnauthorizedErrorResponse, nil
+	}
+
+	now := time.Now()
+	template := ocsp.Response{
+		Status:       ocsp.Unknown,
+		SerialNumber: req.SerialNumber,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(OCSPValidity),
+		IssuerHash:   req.HashAlgorithm,
+	}
+	if r, err := ca.Revocation(req.SerialNumber); err != nil {
+		return nil, err
+	} else if r != nil {
+		template.Status = ocsp.Revoked
+		template.RevokedAt = r.RevokedAt
+		template.RevocationReason = r.Reason
+	} else {
+		records, err := ca.Inventory()
+		if err != nil {
+			return nil, err
+		}
+		serial := FormatSerial(req.SerialNumber)
+		for _, r := range records {
+			if r.Serial == serial {
+				template.Status = ocsp.Good
+				break
+			}
+		}
+	}
+
+	return ocsp.CreateResponse(signerCert, signerCert, template, signerKey.(crypto.Signer))
+}
@@ -0,0 +1,214 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ca
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"strings"
+)
+
+// This file implements the issuance policy for CSRs. Only the parts of a CSR
+// that make sense for a development leaf certificate are honored, and the
+// rest is dropped and reported, so that a CSR can't request a CA certificate
+// or other surprises.
+
+var (
+	oidExtensionSubjectKeyId          = asn1.ObjectIdentifier{2, 5, 29, 14}
+	oidExtensionKeyUsage              = asn1.ObjectIdentifier{2, 5, 29, 15}
+	oidExtensionSubjectAltName        = asn1.ObjectIdentifier{2, 5, 29, 17}
+	oidExtensionBasicConstraints      = asn1.ObjectIdentifier{2, 5, 29, 19}
+	oidExtensionNameConstraints       = asn1.ObjectIdentifier{2, 5, 29, 30}
+	oidExtensionCRLDistributionPoints = asn1.ObjectIdentifier{2, 5, 29, 31}
+	oidExtensionCertificatePolicies   = asn1.ObjectIdentifier{2, 5, 29, 32}
+	oidExtensionAuthorityKeyId        = asn1.ObjectIdentifier{2, 5, 29, 35}
+	oidExtensionPolicyConstraints     = asn1.ObjectIdentifier{2, 5, 29, 36}
+	oidExtensionExtendedKeyUsage      = asn1.ObjectIdentifier{2, 5, 29, 37}
+	oidExtensionInhibitAnyPolicy      = asn1.ObjectIdentifier{2, 5, 29, 54}
+	oidExtensionAuthorityInfoAccess   = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 1}
+)
+
+// csrDroppedExtensions are extensions that are only meaningful for CAs, or
+// that are set by the CA itself, so are never copied from a CSR.
+var csrDroppedExtensions = []struct {
+	oid  asn1.ObjectIdentifier
+	name string
+}{
+	{oidExtensionSubjectKeyId, "subject key identifier"},
+	{oidExtensionNameConstraints, "name constraints"},
+	{oidExtensionCRLDistributionPoints, "CRL distribution points"},
+	{oidExtensionCertificatePolicies, "certificate policies"},
+	{oidExtensionAuthorityKeyId, "authority key identifier"},
+	{oidExtensionPolicyConstraints, "policy constraints"},
+	{oidExtensionInhibitAnyPolicy, "inhibit any policy"},
+	{oidExtensionAuthorityInfoAccess, "authority information access"},
+}
+
+// csrAllowedExtKeyUsages are the EKUs a CSR can request.
+var csrAllowedExtKeyUsages = []struct {
+	oid asn1.ObjectIdentifier
+	eku x509.ExtKeyUsage
+}{
+	{asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 1}, x509.ExtKeyUsageServerAuth},
+	{asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 2}, x509.ExtKeyUsageClientAuth},
+	{asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 4}, x509.ExtKeyUsageEmailProtection},
+}
+
+// extKeyUsageNames are the names of some EKUs that are not allowed.
+var extKeyUsageNames = map[string]string{
+	"2.5.29.37.0":        "anyExtendedKeyUsage",
+	"1.3.6.1.5.5.7.3.3":  "codeSigning",
+	"1.3.6.1.5.5.7.3.8":  "timeStamping",
+	"1.3.6.1.5.5.7.3.9":  "OCSPSigning",
+	"1.3.6.1.5.5.7.3.17": "ipsecIKE",
+}
+
+// sanTypeNames are the GeneralName types from RFC 5280, Section 4.2.1.6,
+// by tag, except for rfc822Name (1), dNSName (2), URI (6) and iPAddress (7),
+// which are the only ones allowed.
+var sanTypeNames = map[int]string{
+	0: "otherName", 3: "x400Address", 4: "directoryName",
+	5: "ediPartyName", 8: "registeredID",
+}
+
+// A CSRPolicyError is returned by SignCSR if CSROptions.Strict is set and the
+// CSR requests something the policy does not allow.
+type CSRPolicyError struct {
+	// Dropped describes each disallowed part of the CSR.
+	Dropped []string
+}
+
+func (e *CSRPolicyError) Error() string {
+	return "the CSR requests " + strings.Join(e.Dropped, ", ") + ", which are not allowed"
+}
+
+// applyCSRPolicy sets the KUs, EKUs and extra extensions of tpl based on the
+// extensions requested by csr. It returns a description of every requested
+// extension, or part of one, that was dropped. The SANs are taken from the
+// parsed CSR fields, which only include the allowed types.
+func applyCSRPolicy(csr *x509.CertificateRequest, tpl *x509.Certificate) (dropped []string, err error) {
+	// If the CSR does not set KUs and EKUs, fix it up as Apple platforms
+	// require serverAuth for TLS.
+	tpl.KeyUsage = x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature
+	tpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+
+extensions:
+	for _, ext := range csr.Extensions {
+		switch {
+		case ext.Id.Equal(oidExtensionSubjectAltName):
+			types, err := parseSANTypes(ext.Value)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse the CSR SANs: %w", err)
+			}
+			for _, t := range types {
+				switch t {
+				case 1, 2, 6, 7:
+					continue
+				}
+				name, ok := sanTypeNames[t]
+				if !ok {
+					name = fmt.Sprintf("type %d", t)
+				}
+				dropped = append(dropped, name+" SAN")
+			}
+
+		case ext.Id.Equal(oidExtensionKeyUsage):
+			var bits asn1.BitString
+			if _, err := asn1.Unmarshal(ext.Value, &bits); err != nil {
+				return nil, fmt.Errorf("failed to parse the CSR key usage: %w", err)
+			}
+			var ku x509.KeyUsage
+			for i := 0; i < 9; i++ {
+				if bits.At(i) != 0 {
+					ku |= 1 << uint(i)
+				}
+			}
+			if ku&x509.KeyUsageCertSign != 0 {
+				dropped = append(dropped, "keyCertSign key usage")
+			}
+			if ku&x509.KeyUsageCRLSign != 0 {
+				dropped = append(dropped, "cRLSign key usage")
+			}
+			if ku &^= x509.KeyUsageCertSign | x509.KeyUsageCRLSign; ku != 0 {
+				tpl.KeyUsage = ku
+			}
+
+		case ext.Id.Equal(oidExtensionExtendedKeyUsage):
+			var oids []asn1.ObjectIdentifier
+			if _, err := asn1.Unmarshal(ext.Value, &oids); err != nil {
+				return nil, fmt.Errorf("failed to parse the CSR extended key usage: %w", err)
+			}
+			var ekus []x509.ExtKeyUsage
+		oids:
+			for _, oid := range oids {
+				for _, allowed := range csrAllowedExtKeyUsages {
+					if oid.Equal(allowed.oid) {
+						ekus = append(ekus, allowed.eku)
+						continue oids
+					}
+				}
+				name, ok := extKeyUsageNames[oid.String()]
+				if !ok {
+					name = oid.String()
+				}
+				dropped = append(dropped, name+" extended key usage")
+			}
+			if len(ekus) > 0 {
+				tpl.ExtKeyUsage = ekus
+			}
+
+		case ext.Id.Equal(oidExtensionBasicConstraints):
+			var bc struct {
+				IsCA       bool `asn1:"optional"`
+				MaxPathLen int  `asn1:"optional,default:-1"`
+			}
+			if _, err := asn1.Unmarshal(ext.Value, &bc); err != nil {
+				return nil, fmt.Errorf("failed to parse the CSR basic constraints: %w", err)
+			}
+			// CA:FALSE is what the certificate gets anyway.
+			if bc.IsCA {
+				dropped = append(dropped, "basic constraints (CA:TRUE)")
+			} else if bc.MaxPathLen >= 0 {
+				dropped = append(dropped, "basic constraints path length")
+			}
+
+		default:
+			for _, d := range csrDroppedExtensions {
+				if ext.Id.Equal(d.oid) {
+					dropped = append(dropped, d.name)
+					continue extensions
+				}
+			}
+			if ext.Critical {
+				dropped = append(dropped, "unknown critical extension "+ext.Id.String())
+				continue
+			}
+			tpl.ExtraExtensions = append(tpl.ExtraExtensions, ext)
+		}
+	}
+
+	return dropped, nil
+}
+
+// parseSANTypes returns the tags of the GeneralNames in a SAN extension.
+func parseSANTypes(der []byte) ([]int, error) {
+	var seq asn1.RawValue
+	if rest, err := asn1.Unmarshal(der, &seq); err != nil {
+		return nil, err
+	} else if len(rest) != 0 || !seq.IsCompound || seq.Tag != asn1.TagSequence {
+		return nil, fmt.Errorf("invalid SAN extension")
+	}
+	var types []int
+	for rest := seq.Bytes; len(rest) > 0; {
+		var name asn1.RawValue
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &name); err != nil {
+			return nil, err
+		}
+		types = append(types, name.Tag)
+	}
+	return types, nil
+}
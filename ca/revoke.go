@@ -0,0 +1,178 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ca
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// RevokedName is the name of the file in the CA directory that records
+// revoked certificates, as one JSON Revocation per line.
+const RevokedName = "revoked.jsonl"
+
+// CRLName is the base name of the CRL files that mkcert -crl saves in the CA
+// directory, with a ".der" or ".pem" extension.
+const CRLName = "crl"
+
+// CRLValidity is how long a CRL generated by CRL is valid for.
+const CRLValidity = 7 * 24 * time.Hour
+
+// A Revocation records the revocation of a certificate.
+type Revocation struct {
+	Serial    string    `json:"serial"` // lowercase hex, like Record.Serial
+	RevokedAt time.Time `json:"revoked_at"`
+	Reason    int       `json:"reason,omitempty"` // RFC 5280 CRLReason
+}
+
+// IssuedBy reports whether cert was signed by the CA root or intermediate.
+func (ca *CA) IssuedBy(cert *x509.Certificate) bool {
+	if cert.CheckSignatureFrom(ca.Cert) == nil {
+		return true
+	}
+	return ca.IntermediateCert != nil && cert.CheckSignatureFrom(ca.IntermediateCert) == nil
+}
+
+// Revoke records the revocation of the certificate with the given serial
+// number. It doesn't check that the CA issued such a certificate.
+func (ca *CA) Revoke(serial *big.Int, reason int) error {
+	if r, err := ca.Revocation(serial); err != nil {
+		return err
+	} else if r != nil {
+		return fmt.Errorf("certificate %s was already revoked on %s", r.Serial, r.RevokedAt.Format("2 January 2006"))
+	}
+	line, err := json.Marshal(&Revocation{
+		Serial:    FormatSerial(serial),
+		RevokedAt: time.Now(),
+		Reason:    reason,
+	})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(ca.Dir, RevokedName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open the revocation list: %w", err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write to the revocation list: %w", err)
+	}
+	return f.Close()
+}
+
+// Revocations returns all the recorded revocations.
+func (ca *CA) Revocations() ([]*Revocation, error) {
+	f, err := os.Open(filepath.Join(ca.Dir, RevokedName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the revocation list: %w", err)
+	}
+	defer f.Close()
+
+	var revocations []*Revocation
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		r := &Revocation{}
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			return nil, fmt.Errorf("failed to parse the revocation list at line %d: %w", line, err)
+		}
+		revocations = append(revocations, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the revocation list: %w", err)
+	}
+	return revocations, nil
+}
+
+// Revocation returns the revocation of the certificate with the given serial
+// number, or nil if it was not revoked.
+func (ca *CA) Revocation(serial *big.Int) (*Revocation, error) {
+	revocations, err := ca.Revocations()
+	if err != nil {
+		return nil, err
+	}
+	s := FormatSerial(serial)
+	for _, r := range revocations {
+		if r.Serial == s {
+			return r, nil
+		}
+	}
+	return nil, nil
+}
+
+// CRL returns a DER encoded CRL of all revoked certificates, signed by the
+// intermediate if there is one, or by the root otherwise. It's valid for
+// CRLValidity.
+func (ca *CA) CRL() ([]byte, error) {
+	revocations, err := ca.Revocations()
+	if err != nil {
+		return nil, err
+	}
+	signerCert, signerKey, err := ca.signer()
+	if err != nil {
+		return nil, err
+	}
+	// CAs created by older versions of mkcert can't sign CRLs.
+	if signerCert.KeyUsage&x509.KeyUsageCRLSign == 0 {
+		return nil, errors.New("the CA certificate is not allowed to sign CRLs, a new CA must be created")
+	}
+
+	var revoked []pkix.RevokedCertificate
+	for _, r := range revocations {
+		serial, err := ParseSerial(r.Serial)
+		if err != nil {
+			return nil, err
+		}
+		rc := pkix.RevokedCertificate{SerialNumber: serial, RevocationTime: r.RevokedAt}
+		if r.Reason != 0 {
+			ext, err := reasonCodeExtension(r.Reason)
+			if err != nil {
+				return nil, err
+			}
+			rc.Extensions = append(rc.Extensions, ext)
+		}
+		revoked = append(revoked, rc)
+	}
+
+	// The CRL number must increase with each new CRL, so use the time.
+	now := time.Now()
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		RevokedCertificates: revoked,
+		Number:              big.NewInt(now.UnixNano()),
+		ThisUpdate:          now,
+		NextUpdate:          now.Add(CRLValidity),
+	}, signerCert, signerKey.(crypto.Signer))
+	if err != nil {
+		return nil, err
+	}
+	return der, nil
+}
+
+var oidExtensionReasonCode = asn1.ObjectIdentifier{2, 5, 29, 21}
+
+func reasonCodeExtension(reason int) (pkix.Extension, error) {
+	value, err := asn1.Marshal(asn1.Enumerated(reason))
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	return pkix.Extension{Id: oidExtensionReasonCode, Value: value}, nil
+}
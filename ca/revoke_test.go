@@ -0,0 +1,113 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ca
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+)
+
+func TestRevoke(t *testing.T) {
+	ca := newTestCA(t, nil)
+	if err := ca.NewIntermediate(&Options{KeyType: KeyTypeP256}); err != nil {
+		t.Fatal(err)
+	}
+	var leaves []*x509.Certificate
+	for i := 0; i < 3; i++ {
+		leaf, err := ca.IssueLeaf(&LeafOptions{Hosts: []string{"example.test"}, KeyType: KeyTypeP256})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ca.IssuedBy(leaf.Cert) {
+			t.Error("IssuedBy returned false for a leaf of the CA")
+		}
+		leaves = append(leaves, leaf.Cert)
+	}
+	if other := newTestCA(t, nil); other.IssuedBy(leaves[0]) {
+		t.Error("IssuedBy returned true for another CA")
+	}
+
+	if err := ca.Revoke(leaves[0].SerialNumber, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.Revoke(leaves[1].SerialNumber, 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.Revoke(leaves[1].SerialNumber, 1); err == nil {
+		t.Error("revoked a certificate twice")
+	}
+
+	revocations, err := ca.Revocations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revocations) != 2 || revocations[1].Serial != FormatSerial(leaves[1].SerialNumber) || revocations[1].Reason != 4 {
+		t.Fatalf("unexpected revocations %+v", revocations)
+	}
+	if r, err := ca.Revocation(leaves[2].SerialNumber); r != nil || err != nil {
+		t.Errorf("got revocation %+v, %v for a valid certificate", r, err)
+	}
+	if r, err := ca.Revocation(leaves[0].SerialNumber); r == nil || err != nil {
+		t.Errorf("got revocation %+v, %v for a revoked certificate", r, err)
+	}
+
+	der, err := ca.CRL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.ParseCRL(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.IntermediateCert.CheckCRLSignature(crl); err != nil {
+		t.Errorf("CRL not signed by the intermediate: %v", err)
+	}
+	revoked := crl.TBSCertList.RevokedCertificates
+	if len(revoked) != 2 || revoked[0].SerialNumber.Cmp(leaves[0].SerialNumber) != 0 || revoked[1].SerialNumber.Cmp(leaves[1].SerialNumber) != 0 {
+		t.Fatalf("unexpected CRL entries %v", revoked)
+	}
+	if len(revoked[0].Extensions) != 0 {
+		t.Error("reason code set for an unspecified reason")
+	}
+	var reason asn1.Enumerated
+	if len(revoked[1].Extensions) != 1 || !revoked[1].Extensions[0].Id.Equal(oidExtensionReasonCode) {
+		t.Fatal("missing reason code")
+	}
+	if _, err := asn1.Unmarshal(revoked[1].Extensions[0].Value, &reason); err != nil || reason != 4 {
+		t.Errorf("got reason %d, %v", reason, err)
+	}
+	if got := crl.TBSCertList.NextUpdate.Sub(crl.TBSCertList.ThisUpdate); got != CRLValidity {
+		t.Errorf("CRL valid for %v, want %v", got, CRLValidity)
+	}
+}
+
+func TestRevocationsErrors(t *testing.T) {
+	ca := newTestCA(t, nil)
+	if revocations, err := ca.Revocations(); revocations != nil || err != nil {
+		t.Errorf("got %v, %v without a revocation list", revocations, err)
+	}
+	der, err := ca.CRL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crl, err := x509.ParseCRL(der); err != nil || len(crl.TBSCertList.RevokedCertificates) != 0 {
+		t.Errorf("unexpected empty CRL: %v", err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(ca.Dir, RevokedName), []byte("{\"serial\":\"01\"}\n\nnot json\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ca.Revocations(); err == nil {
+		t.Error("parsed an invalid revocation list")
+	}
+	if err := ca.Revoke(big.NewInt(2), 0); err == nil {
+		t.Error("revoked with an invalid revocation list")
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ca
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// PreviousDirName is the name of the directory in the CA directory that holds
+// the previous root, intermediate and keys during a rotation, in the same
+// layout as a CA directory.
+const PreviousDirName = "previous"
+
+// RotationName is the name of the file in PreviousDirName that records the
+// rotation as a JSON Rotation.
+const RotationName = "rotation.json"
+
+// CrossName is the name of the file in the CA directory that holds the new
+// root cross-signed by the previous one during a rotation, if requested.
+const CrossName = "rootCA-cross.pem"
+
+// A Rotation records an ongoing rotation of the root.
+type Rotation struct {
+	Started time.Time `json:"started"`
+
+	// FinishAfter is the end of the grace period, during which the previous
+	// root is expected to stay trusted.
+	FinishAfter time.Time `json:"finish_after"`
+}
+
+// RotateOptions control the rotation of the root.
+type RotateOptions struct {
+	// Options control the generation of the new root.
+	Options
+
+	// CrossSign, if true, makes the previous root sign a certificate for
+	// the new one, which is then included in the chain of new certificates
+	// so they are trusted by clients that only trust the previous root.
+	CrossSign bool
+
+	// Grace is how long the previous root is expected to stay trusted.
+	Grace time.Duration
+}
+
+// Rotate replaces the root with a new one, moving the current root and
+// intermediate, and their keys, to the PreviousDirName subdirectory. The new
+// root key is encrypted with the same passphrase as the previous one, if it
+// was encrypted. The CA index and revocations are kept.
+//
+// The rotation is finished by FinishRotation.
+func (ca *CA) Rotate(opts *RotateOptions) (*CA, error) {
+	if opts == nil {
+		opts = &RotateOptions{}
+	}
+	prevDir := filepath.Join(ca.Dir, PreviousDirName)
+	if Exists(prevDir) {
+		return nil, errors.New("a rotation is already in progress")
+	}
+	if opts.CrossSign && ca.Cert.MaxPathLenZero {
+		return nil, errors.New("the CA was created by an older version of mkcert and can't cross-sign a new root")
+	}
+	// Obtain the passphrase, and check the key is present, before moving
+	// anything. It's only needed to cross-sign, or to encrypt the new key.
+	newOpts := opts.Options
+	if opts.CrossSign || ca.encryptedKey != nil {
+		if _, err := ca.rootKey(); err != nil {
+			return nil, err
+		}
+		if ca.encryptedKey != nil {
+			newOpts.Passphrase = ca.passphrase
+		}
+	}
+
+	if err := os.Mkdir(prevDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create the previous CA directory: %w", err)
+	}
+	var moved []string
+	var created bool
+	undo := func() {
+		if created {
+			for _, name := range []string{RootName, RootKeyName, CrossName} {
+				os.Remove(filepath.Join(ca.Dir, name))
+			}
+		}
+		for _, name := range moved {
+			os.Rename(filepath.Join(prevDir, name), filepath.Join(ca.Dir, name))
+		}
+		os.RemoveAll(prevDir)
+	}
+	for _, name := range []string{RootName, RootKeyName, IntermediateName, IntermediateKeyName} {
+		err := os.Rename(filepath.Join(ca.Dir, name), filepath.Join(prevDir, name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			undo()
+			return nil, fmt.Errorf("failed to move %s: %w", name, err)
+		}
+		moved = append(moved, name)
+	}
+	created = true
+	next, err := NewCA(ca.Dir, &newOpts)
+	if err != nil {
+		undo()
+		return nil, err
+	}
+	next.Passphrase = ca.Passphrase
+
+	if opts.CrossSign {
+		if err := next.crossSign(ca); err != nil {
+			undo()
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	r := &Rotation{Started: now, FinishAfter: now.Add(opts.Grace)}
+	data, err := json.Marshal(r)
+	if err != nil {
+		undo()
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(prevDir, RotationName), data, 0644); err != nil {
+		undo()
+		return nil, fmt.Errorf("failed to save the rotation: %w", err)
+	}
+
+	return next, nil
+}
+
+// crossSign issues a certificate for the root of ca signed by the root of
+// prev, and saves it as CrossName.
+func (ca *CA) crossSign(prev *CA) error {
+	prevKey, err := prev.rootKey()
+	if err != nil {
+		return err
+	}
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return err
+	}
+	tpl := *ca.Cert
+	tpl.SerialNumber = serial
+	tpl.AuthorityKeyId = nil
+	tpl.SignatureAlgorithm = x509.UnknownSignatureAlgorithm // pick one for prevKey
+	tpl.NotBefore = time.Now()
+	// The cross-signed certificate can't outlive the previous root.
+	if prev.Cert.NotAfter.Before(tpl.NotAfter) {
+		tpl.NotAfter = prev.Cert.NotAfter
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &tpl, prev.Cert, ca.Cert.PublicKey, prevKey)
+	if err != nil {
+		return fmt.Errorf("failed to generate the cross-signed certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return fmt.Errorf("failed to parse the cross-signed certificate: %w", err)
+	}
+	if err := writeCertFile(filepath.Join(ca.Dir, CrossName), der); err != nil {
+		return fmt.Errorf("failed to save the cross-signed certificate: %w", err)
+	}
+	ca.CrossCert = cert
+	return nil
+}
+
+// Previous loads the previous CA and the Rotation, if a rotation is in
+// progress, or returns nil.
+func (ca *CA) Previous() (*CA, *Rotation, error) {
+	prevDir := filepath.Join(ca.Dir, PreviousDirName)
+	if !Exists(prevDir) {
+		return nil, nil, nil
+	}
+	prev, err := LoadCA(prevDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load the previous CA: %w", err)
+	}
+	prev.Passphrase = ca.Passphrase
+	data, err := ioutil.ReadFile(filepath.Join(prevDir, RotationName))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read the rotation: %w", err)
+	}
+	r := &Rotation{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse the rotation: %w", err)
+	}
+	return prev, r, nil
+}
+
+// FinishRotation deletes the previous CA, including its keys, and the
+// cross-signed certificate.
+func (ca *CA) FinishRotation() error {
+	if err := os.Remove(filepath.Join(ca.Dir, CrossName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete the cross-signed certificate: %w", err)
+	}
+	ca.CrossCert = nil
+	if err := os.RemoveAll(filepath.Join(ca.Dir, PreviousDirName)); err != nil {
+		return fmt.Errorf("failed to delete the previous CA: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ca
+
+import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRotate(t *testing.T) {
+	ca := newTestCA(t, nil)
+	if err := ca.NewIntermediate(&Options{KeyType: KeyTypeP256}); err != nil {
+		t.Fatal(err)
+	}
+	if prev, r, err := ca.Previous(); prev != nil || r != nil || err != nil {
+		t.Fatalf("got %v, %v, %v before rotating", prev, r, err)
+	}
+
+	next, err := ca.Rotate(&RotateOptions{Options: Options{KeyType: KeyTypeP256}, CrossSign: true, Grace: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Cert.Equal(ca.Cert) || next.IntermediateCert != nil {
+		t.Error("the root was not replaced")
+	}
+	if _, err := ca.Rotate(nil); err == nil {
+		t.Error("started a second rotation")
+	}
+
+	loaded, err := LoadCA(ca.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Cert.Equal(next.Cert) || loaded.CrossCert == nil || !loaded.CrossCert.Equal(next.CrossCert) {
+		t.Fatal("the new root was not saved")
+	}
+	prev, r, err := loaded.Previous()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prev == nil || !prev.Cert.Equal(ca.Cert) || !prev.IntermediateCert.Equal(ca.IntermediateCert) {
+		t.Fatal("the previous CA was not moved")
+	}
+	if got := r.FinishAfter.Sub(r.Started); got != time.Hour {
+		t.Errorf("got grace period %v", got)
+	}
+
+	// New leaves chain to both roots through the cross-signed certificate.
+	leaf, err := loaded.IssueLeaf(&LeafOptions{Hosts: []string{"example.test"}, KeyType: KeyTypeP256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, root := range []*x509.Certificate{ca.Cert, next.Cert} {
+		roots, inters := x509.NewCertPool(), x509.NewCertPool()
+		roots.AddCert(root)
+		for _, c := range loaded.Chain() {
+			inters.AddCert(c)
+		}
+		if _, err := leaf.Cert.Verify(x509.VerifyOptions{Roots: roots, Intermediates: inters}); err != nil {
+			t.Errorf("leaf doesn't chain to root %d: %v", i, err)
+		}
+	}
+
+	if err := loaded.FinishRotation(); err != nil {
+		t.Fatal(err)
+	}
+	if Exists(filepath.Join(ca.Dir, PreviousDirName)) || loaded.CrossCert != nil {
+		t.Error("the previous CA was not deleted")
+	}
+	if _, err := os.Stat(filepath.Join(ca.Dir, CrossName)); !os.IsNotExist(err) {
+		t.Error("the cross-signed certificate was not deleted")
+	}
+}
+
+func TestRotateEncrypted(t *testing.T) {
+	ca := newTestCA(t, &Options{Passphrase: []byte("hunter2")})
+	loaded, err := LoadCA(ca.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a passphrase the new key can't be encrypted, so nothing moves.
+	if _, err := loaded.Rotate(&RotateOptions{Options: Options{KeyType: KeyTypeP256}}); err == nil {
+		t.Fatal("rotated without a passphrase")
+	}
+	if Exists(filepath.Join(ca.Dir, PreviousDirName)) {
+		t.Fatal("the failed rotation moved the CA")
+	}
+
+	loaded.Passphrase = func() ([]byte, error) { return []byte("hunter2"), nil }
+	if _, err := loaded.Rotate(&RotateOptions{Options: Options{KeyType: KeyTypeP256}}); err != nil {
+		t.Fatal(err)
+	}
+	next, err := LoadCA(ca.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Cert.Equal(ca.Cert) || !next.Encrypted() {
+		t.Fatal("the new root key is not encrypted")
+	}
+	next.Passphrase = loaded.Passphrase
+	if err := next.CanSign(); err != nil {
+		t.Error(err)
+	}
+}
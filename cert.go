@@ -6,130 +6,126 @@ package main
 
 import (
 	"crypto"
-	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
-	"crypto/rsa"
-	"crypto/sha1"
 	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/asn1"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
-	"math/big"
-	"net"
-	"net/mail"
-	"net/url"
-	"os"
-	"os/user"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
-	"time"
 
+	"filippo.io/mkcert/ca"
 	pkcs12 "software.sslmate.com/src/go-pkcs12"
 )
 
-var userAndHostname string
+func (m *mkcert) makeCert(hosts []string) {
+	opts := &ca.LeafOptions{Hosts: hosts, Client: m.client, KeyType: m.keyType}
+	// IIS (the main target of PKCS #12 files), only shows the deprecated
+	// Common Name in the UI. See issue #115.
+	if m.pkcs12 {
+		opts.CommonName = hosts[0]
+	}
 
-func init() {
-	u, err := user.Current()
-	if err == nil {
-		userAndHostname = u.Username + "@"
+	var key crypto.PrivateKey
+	if m.keyIn != "" {
+		signer, err := readPrivateKey(m.keyIn)
+		fatalIfErr(err, "failed to read the -key-in key")
+		opts.PublicKey = signer.Public()
+		key = signer
 	}
-	if h, err := os.Hostname(); err == nil {
-		userAndHostname += h
+
+	certFile, keyFile, p12File := m.fileNames(hosts)
+	if m.ensure {
+		if cert := m.upToDate(hosts, opts.PublicKey, certFile, keyFile, p12File); cert != nil {
+			if m.pkcs12 {
+				log.Printf("The PKCS#12 bundle at \"%s\" is up to date, leaving it untouched ✅\n", p12File)
+				m.reportCert(cert, "", "up_to_date", p12File)
+			} else {
+				log.Printf("The certificate at \"%s\" is up to date, leaving it untouched ✅\n", certFile)
+				m.reportCert(cert, "", "up_to_date", certFile, keyFile)
+			}
+			return
+		}
 	}
-	if err == nil && u.Name != "" && u.Name != u.Username {
-		userAndHostname += " (" + u.Name + ")"
+	if err := m.issueCert(opts, key, ca.SourceGenerated, certFile, keyFile, p12File); err != nil {
+		log.Fatalln("ERROR:", err)
 	}
 }
 
-func (m *mkcert) makeCert(hosts []string) {
-	if m.caKey == nil {
-		log.Fatalln("ERROR: can't create new certificates because the CA key (rootCA-key.pem) is missing")
+// issueCert issues a certificate for opts.Hosts and saves it to certFile and
+// keyFile, or to p12File if m.pkcs12 is set. If key is not nil, it must match
+// opts.PublicKey, and it's saved instead of a newly generated one.
+func (m *mkcert) issueCert(opts *ca.LeafOptions, key crypto.PrivateKey, source, certFile, keyFile, p12File string) error {
+	if err := m.canSign(); err != nil {
+		return err
 	}
 
-	priv, err := m.generateKey(false)
-	fatalIfErr(err, "failed to generate certificate key")
-	pub := priv.(crypto.Signer).Public()
-
-	// Certificates last for 2 years and 3 months, which is always less than
-	// 825 days, the limit that macOS/iOS apply to all certificates,
-	// including custom roots. See https://support.apple.com/en-us/HT210176.
-	expiration := time.Now().AddDate(2, 3, 0)
-
-	tpl := &x509.Certificate{
-		SerialNumber: randomSerialNumber(),
-		Subject: pkix.Name{
-			Organization:       []string{"mkcert development certificate"},
-			OrganizationalUnit: []string{userAndHostname},
-		},
-
-		NotBefore: time.Now(), NotAfter: expiration,
-
-		KeyUsage: x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-	}
+	opts.NotBefore, opts.NotAfter = m.validityPeriod()
+	opts.CRLDistributionPoints = m.crlDistributionPoints()
+	opts.OCSPServer = m.ocspServers()
 
-	for _, h := range hosts {
-		if ip := net.ParseIP(h); ip != nil {
-			tpl.IPAddresses = append(tpl.IPAddresses, ip)
-		} else if email, err := mail.ParseAddress(h); err == nil && email.Address == h {
-			tpl.EmailAddresses = append(tpl.EmailAddresses, h)
-		} else if uriName, err := url.Parse(h); err == nil && uriName.Scheme != "" && uriName.Host != "" {
-			tpl.URIs = append(tpl.URIs, uriName)
-		} else {
-			tpl.DNSNames = append(tpl.DNSNames, h)
+	for _, h := range opts.Hosts {
+		if err := m.hostPermitted(h); err != nil {
+			return err
 		}
 	}
 
-	if m.client {
-		tpl.ExtKeyUsage = append(tpl.ExtKeyUsage, x509.ExtKeyUsageClientAuth)
+	leaf, err := m.ca.IssueLeaf(opts)
+	if err != nil {
+		return fmt.Errorf("failed to generate certificate: %w", err)
 	}
-	if len(tpl.IPAddresses) > 0 || len(tpl.DNSNames) > 0 || len(tpl.URIs) > 0 {
-		tpl.ExtKeyUsage = append(tpl.ExtKeyUsage, x509.ExtKeyUsageServerAuth)
-	}
-	if len(tpl.EmailAddresses) > 0 {
-		tpl.ExtKeyUsage = append(tpl.ExtKeyUsage, x509.ExtKeyUsageEmailProtection)
+	if key != nil {
+		leaf.Key = key
 	}
 
-	// IIS (the main target of PKCS #12 files), only shows the deprecated
-	// Common Name in the UI. See issue #115.
-	if m.pkcs12 {
-		tpl.Subject.CommonName = hosts[0]
-	}
-
-	cert, err := x509.CreateCertificate(rand.Reader, tpl, m.caCert, pub, m.caKey)
-	fatalIfErr(err, "failed to generate certificate")
-
-	certFile, keyFile, p12File := m.fileNames(hosts)
-
 	if !m.pkcs12 {
-		certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
-		privDER, err := x509.MarshalPKCS8PrivateKey(priv)
-		fatalIfErr(err, "failed to encode certificate key")
+		certPEM := m.ca.ChainPEM(leaf.Cert)
+		privDER, err := x509.MarshalPKCS8PrivateKey(leaf.Key)
+		if err != nil {
+			return fmt.Errorf("failed to encode certificate key: %w", err)
+		}
 		privPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER})
 
 		if certFile == keyFile {
-			err = ioutil.WriteFile(keyFile, append(certPEM, privPEM...), 0600)
-			fatalIfErr(err, "failed to save certificate and key")
+			if err := ca.WriteFileAtomic(keyFile, append(certPEM, privPEM...), 0600); err != nil {
+				return fmt.Errorf("failed to save certificate and key: %w", err)
+			}
 		} else {
-			err = ioutil.WriteFile(certFile, certPEM, 0644)
-			fatalIfErr(err, "failed to save certificate")
-			err = ioutil.WriteFile(keyFile, privPEM, 0600)
-			fatalIfErr(err, "failed to save certificate key")
+			if err := ca.WriteFileAtomic(certFile, certPEM, 0644); err != nil {
+				return fmt.Errorf("failed to save certificate: %w", err)
+			}
+			if err := ca.WriteFileAtomic(keyFile, privPEM, 0600); err != nil {
+				return fmt.Errorf("failed to save certificate key: %w", err)
+			}
 		}
 	} else {
-		domainCert, _ := x509.ParseCertificate(cert)
-		pfxData, err := pkcs12.Encode(rand.Reader, priv, domainCert, []*x509.Certificate{m.caCert}, "changeit")
-		fatalIfErr(err, "failed to generate PKCS#12")
-		err = ioutil.WriteFile(p12File, pfxData, 0644)
-		fatalIfErr(err, "failed to save PKCS#12")
+		caCerts := append(m.ca.Chain(), m.ca.Cert)
+		pfxData, err := pkcs12.Encode(rand.Reader, leaf.Key, leaf.Cert, caCerts, "changeit")
+		if err != nil {
+			return fmt.Errorf("failed to generate PKCS#12: %w", err)
+		}
+		if err := ca.WriteFileAtomic(p12File, pfxData, 0644); err != nil {
+			return fmt.Errorf("failed to save PKCS#12: %w", err)
+		}
 	}
 
-	m.printHosts(hosts)
+	if !m.pkcs12 {
+		m.recordCert(leaf.Cert, source, certFile, keyFile)
+	} else {
+		m.recordCert(leaf.Cert, source, p12File)
+	}
+
+	m.printHosts(opts.Hosts)
+
+	warnKeyType("the certificate", leaf.Cert.PublicKey)
+	warnKeyType("the local CA", m.ca.Cert.PublicKey)
+	if m.ca.IntermediateCert != nil {
+		warnKeyType("the intermediate CA", m.ca.IntermediateCert.PublicKey)
+	}
 
 	if !m.pkcs12 {
 		if certFile == keyFile {
@@ -142,7 +138,66 @@ func (m *mkcert) makeCert(hosts []string) {
 		log.Printf("\nThe legacy PKCS#12 encryption password is the often hardcoded default \"changeit\" ℹ️\n\n")
 	}
 
-	log.Printf("It will expire on %s 🗓\n\n", expiration.Format("2 January 2006"))
+	log.Printf("It will expire on %s 🗓\n\n", leaf.Cert.NotAfter.Format("2 January 2006"))
+	return nil
+}
+
+// readPrivateKey reads the first private key in a PEM file, which can be in
+// PKCS #8, PKCS #1 (RSA) or SEC 1 (EC) format.
+func readPrivateKey(path string) (crypto.Signer, error) {
+	keyPEMBlock, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, keyPEMBlock = pem.Decode(keyPEMBlock)
+		if block == nil {
+			return nil, errors.New("no PRIVATE KEY block in " + path)
+		}
+		var key crypto.PrivateKey
+		switch block.Type {
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported key type %T", key)
+		}
+		return signer, nil
+	}
+}
+
+// keyTypeWarnings are the reasons certificates with certain key types, or
+// signed by CAs with those key types, might be rejected.
+var keyTypeWarnings = map[string]string{
+	ca.KeyTypeP521:    "Chrome doesn't support P-521",
+	ca.KeyTypeEd25519: "browsers don't support Ed25519",
+}
+
+func warnKeyType(name string, pub crypto.PublicKey) {
+	keyType := ca.KeyTypeOf(pub)
+	if w, ok := keyTypeWarnings[keyType]; ok {
+		log.Printf("\nWarning: %s key type is %q, but %s ⚠️", name, keyType, w)
+	}
+}
+
+func isKeyType(keyType string) bool {
+	for _, t := range ca.KeyTypes {
+		if keyType == t {
+			return true
+		}
+	}
+	return false
 }
 
 func (m *mkcert) printHosts(hosts []string) {
@@ -163,16 +218,6 @@ func (m *mkcert) printHosts(hosts []string) {
 	}
 }
 
-func (m *mkcert) generateKey(rootCA bool) (crypto.PrivateKey, error) {
-	if m.ecdsa {
-		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	}
-	if rootCA {
-		return rsa.GenerateKey(rand.Reader, 3072)
-	}
-	return rsa.GenerateKey(rand.Reader, 2048)
-}
-
 func (m *mkcert) fileNames(hosts []string) (certFile, keyFile, p12File string) {
 	defaultName := strings.Replace(hosts[0], ":", "_", -1)
 	defaultName = strings.Replace(defaultName, "*", "_wildcard", -1)
@@ -199,17 +244,8 @@ func (m *mkcert) fileNames(hosts []string) (certFile, keyFile, p12File string) {
 	return
 }
 
-func randomSerialNumber() *big.Int {
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
-	fatalIfErr(err, "failed to generate serial number")
-	return serialNumber
-}
-
 func (m *mkcert) makeCertFromCSR() {
-	if m.caKey == nil {
-		log.Fatalln("ERROR: can't create new certificates because the CA key (rootCA-key.pem) is missing")
-	}
+	m.checkSigner()
 
 	csrPEMBytes, err := ioutil.ReadFile(m.csrPath)
 	fatalIfErr(err, "failed to read the CSR")
@@ -223,146 +259,166 @@ func (m *mkcert) makeCertFromCSR() {
 	}
 	csr, err := x509.ParseCertificateRequest(csrPEM.Bytes)
 	fatalIfErr(err, "failed to parse the CSR")
-	fatalIfErr(csr.CheckSignature(), "invalid CSR signature")
-
-	expiration := time.Now().AddDate(2, 3, 0)
-	tpl := &x509.Certificate{
-		SerialNumber:    randomSerialNumber(),
-		Subject:         csr.Subject,
-		ExtraExtensions: csr.Extensions, // includes requested SANs, KUs and EKUs
-
-		NotBefore: time.Now(), NotAfter: expiration,
-
-		// If the CSR does not request a SAN extension, fix it up for them as
-		// the Common Name field does not work in modern browsers. Otherwise,
-		// this will get overridden.
-		DNSNames: []string{csr.Subject.CommonName},
-
-		// Likewise, if the CSR does not set KUs and EKUs, fix it up as Apple
-		// platforms require serverAuth for TLS.
-		KeyUsage:    x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-	}
 
-	if m.client {
-		tpl.ExtKeyUsage = append(tpl.ExtKeyUsage, x509.ExtKeyUsageClientAuth)
-	}
-	if len(csr.EmailAddresses) > 0 {
-		tpl.ExtKeyUsage = append(tpl.ExtKeyUsage, x509.ExtKeyUsageEmailProtection)
+	opts := &ca.CSROptions{Client: m.client, Strict: m.csrStrict,
+		CRLDistributionPoints: m.crlDistributionPoints(), OCSPServer: m.ocspServers()}
+	opts.NotBefore, opts.NotAfter = m.validityPeriod()
+	c, dropped, err := m.ca.SignCSR(csr, opts)
+	var nameErr *ca.NameConstraintError
+	if errors.As(err, &nameErr) {
+		m.checkHost(nameErr.Name)
+	}
+	var policyErr *ca.CSRPolicyError
+	if errors.As(err, &policyErr) {
+		log.Printf("ERROR: refusing to sign the CSR because it requests:")
+		for _, d := range policyErr.Dropped {
+			log.Printf(" - %s", d)
+		}
+		log.Fatalln("Run without -csr-strict to drop them from the certificate instead")
 	}
-
-	cert, err := x509.CreateCertificate(rand.Reader, tpl, m.caCert, csr.PublicKey, m.caKey)
 	fatalIfErr(err, "failed to generate certificate")
-	c, err := x509.ParseCertificate(cert)
-	fatalIfErr(err, "failed to parse generated certificate")
 
-	var hosts []string
-	hosts = append(hosts, c.DNSNames...)
-	hosts = append(hosts, c.EmailAddresses...)
-	for _, ip := range c.IPAddresses {
-		hosts = append(hosts, ip.String())
-	}
-	for _, uri := range c.URIs {
-		hosts = append(hosts, uri.String())
-	}
+	hosts := ca.CertificateNames(c)
 	certFile, _, _ := m.fileNames(hosts)
 
-	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(
-		&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0644)
+	err = ca.WriteFileAtomic(certFile, m.ca.ChainPEM(c), 0644)
 	fatalIfErr(err, "failed to save certificate")
 
+	m.recordCert(c, ca.SourceCSR, certFile)
+
 	m.printHosts(hosts)
 
+	if len(dropped) > 0 {
+		log.Printf("\nThe following parts of the CSR were not allowed, and were left out ℹ️")
+		for _, d := range dropped {
+			log.Printf(" - %s", d)
+		}
+	}
+
 	log.Printf("\nThe certificate is at \"%s\" ✅\n\n", certFile)
 
-	log.Printf("It will expire on %s 🗓\n\n", expiration.Format("2 January 2006"))
+	log.Printf("It will expire on %s 🗓\n\n", c.NotAfter.Format("2 January 2006"))
+}
+
+// localNameConstraints are the names permitted by "-name-constraints local":
+// reserved and local-only TLDs, and loopback and private IP ranges.
+var localNameConstraints = []string{
+	"test", "localhost", "internal", "local", "example", "invalid",
+	"127.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16",
+	"::1/128", "fc00::/7",
 }
 
 // loadCA will load or create the CA at CAROOT.
 func (m *mkcert) loadCA() {
-	if !pathExists(filepath.Join(m.CAROOT, rootName)) {
-		m.newCA()
+	if !ca.Exists(m.CAROOT) {
+		opts := &ca.Options{KeyType: m.keyType, NameConstraints: m.parseNameConstraints()}
+		// With -encrypt-ca-key, the new key is never saved in plaintext.
+		if m.encryptKey {
+			passphrase, err := readPassphrase(true)
+			fatalIfErr(err, "failed to read the passphrase")
+			opts.Passphrase = passphrase
+		}
+		c, err := ca.NewCA(m.CAROOT, opts)
+		fatalIfErr(err, "failed to create the CA")
+		m.createdCA = true
+		log.Printf("Created a new local CA 💥\n")
+		warnKeyType("the local CA", c.Cert.PublicKey)
+		if names := c.NameConstraints(); names != nil {
+			log.Printf("It can only issue certificates for %s ℹ️\n", strings.Join(names, ", "))
+		}
+	} else if m.nameConstraints != "" && !m.rotateCA {
+		log.Fatalln("ERROR: -name-constraints can only be used when creating a new CA, but one already exists at " + m.CAROOT)
 	}
 
-	certPEMBlock, err := ioutil.ReadFile(filepath.Join(m.CAROOT, rootName))
-	fatalIfErr(err, "failed to read the CA certificate")
-	certDERBlock, _ := pem.Decode(certPEMBlock)
-	if certDERBlock == nil || certDERBlock.Type != "CERTIFICATE" {
-		log.Fatalln("ERROR: failed to read the CA certificate: unexpected content")
-	}
-	m.caCert, err = x509.ParseCertificate(certDERBlock.Bytes)
-	fatalIfErr(err, "failed to parse the CA certificate")
+	var err error
+	m.ca, err = ca.LoadCA(m.CAROOT)
+	fatalIfErr(err, "failed to load the CA")
+	m.ca.Passphrase = func() ([]byte, error) { return readPassphrase(false) }
+	m.previous, m.rotation, err = m.ca.Previous()
+	fatalIfErr(err, "failed to load the CA rotation")
+}
 
-	if !pathExists(filepath.Join(m.CAROOT, rootKeyName)) {
-		return // keyless mode, where only -install works
+// parseNameConstraints splits m.nameConstraints, expanding "local".
+func (m *mkcert) parseNameConstraints() []string {
+	var constraints []string
+	for _, c := range strings.Split(m.nameConstraints, ",") {
+		if c == "local" {
+			constraints = append(constraints, localNameConstraints...)
+		} else if c != "" {
+			constraints = append(constraints, c)
+		}
 	}
+	return constraints
+}
 
-	keyPEMBlock, err := ioutil.ReadFile(filepath.Join(m.CAROOT, rootKeyName))
-	fatalIfErr(err, "failed to read the CA key")
-	keyDERBlock, _ := pem.Decode(keyPEMBlock)
-	if keyDERBlock == nil || keyDERBlock.Type != "PRIVATE KEY" {
-		log.Fatalln("ERROR: failed to read the CA key: unexpected content")
+// checkHost exits if the CA name constraints don't permit h.
+func (m *mkcert) checkHost(h string) {
+	if err := m.hostPermitted(h); err != nil {
+		log.Fatalln("ERROR:", err)
 	}
-	m.caKey, err = x509.ParsePKCS8PrivateKey(keyDERBlock.Bytes)
-	fatalIfErr(err, "failed to parse the CA key")
 }
 
-func (m *mkcert) newCA() {
-	priv, err := m.generateKey(true)
-	fatalIfErr(err, "failed to generate the CA key")
-	pub := priv.(crypto.Signer).Public()
-
-	spkiASN1, err := x509.MarshalPKIXPublicKey(pub)
-	fatalIfErr(err, "failed to encode public key")
-
-	var spki struct {
-		Algorithm        pkix.AlgorithmIdentifier
-		SubjectPublicKey asn1.BitString
+// hostPermitted returns an error if the CA name constraints don't permit h.
+func (m *mkcert) hostPermitted(h string) error {
+	if err := m.ca.CheckHost(h); err != nil {
+		return fmt.Errorf("can't create a certificate for %q because the local CA only permits %s",
+			h, strings.Join(m.ca.NameConstraints(), ", "))
 	}
-	_, err = asn1.Unmarshal(spkiASN1, &spki)
-	fatalIfErr(err, "failed to decode public key")
-
-	skid := sha1.Sum(spki.SubjectPublicKey.Bytes)
-
-	tpl := &x509.Certificate{
-		SerialNumber: randomSerialNumber(),
-		Subject: pkix.Name{
-			Organization:       []string{"mkcert development CA"},
-			OrganizationalUnit: []string{userAndHostname},
-
-			// The CommonName is required by iOS to show the certificate in the
-			// "Certificate Trust Settings" menu.
-			// https://github.com/FiloSottile/mkcert/issues/47
-			CommonName: "mkcert " + userAndHostname,
-		},
-		SubjectKeyId: skid[:],
-
-		NotAfter:  time.Now().AddDate(10, 0, 0),
-		NotBefore: time.Now(),
-
-		KeyUsage: x509.KeyUsageCertSign,
+	return nil
+}
 
-		BasicConstraintsValid: true,
-		IsCA:                  true,
-		MaxPathLenZero:        true,
+// checkSigner exits if the CA can't sign new certificates.
+func (m *mkcert) checkSigner() {
+	if err := m.canSign(); err != nil {
+		log.Fatalln("ERROR:", err)
 	}
+}
 
-	cert, err := x509.CreateCertificate(rand.Reader, tpl, tpl, pub, priv)
-	fatalIfErr(err, "failed to generate CA certificate")
-
-	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
-	fatalIfErr(err, "failed to encode CA key")
-	err = ioutil.WriteFile(filepath.Join(m.CAROOT, rootKeyName), pem.EncodeToMemory(
-		&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}), 0400)
-	fatalIfErr(err, "failed to save CA key")
+// canSign returns an error if the CA can't sign new certificates. If the
+// signing key is encrypted, it asks for the passphrase.
+func (m *mkcert) canSign() error {
+	if err := m.ca.CanSign(); err != nil {
+		return fmt.Errorf("can't create new certificates because %s", err)
+	}
+	return nil
+}
 
-	err = ioutil.WriteFile(filepath.Join(m.CAROOT, rootName), pem.EncodeToMemory(
-		&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0644)
-	fatalIfErr(err, "failed to save CA certificate")
+func (m *mkcert) newIntermediate() {
+	err := m.ca.NewIntermediate(&ca.Options{KeyType: m.keyType})
+	var missingKey *ca.MissingKeyError
+	if errors.As(err, &missingKey) {
+		log.Fatalf("ERROR: can't create an intermediate because %s", err)
+	}
+	fatalIfErr(err, "failed to create the intermediate")
 
-	log.Printf("Created a new local CA 💥\n")
+	log.Printf("Created a new intermediate CA 💥\n")
+	warnKeyType("the intermediate CA", m.ca.IntermediateCert.PublicKey)
+	log.Printf("New certificates will be signed by the intermediate, so you can now move %q to a safe place ℹ️\n",
+		filepath.Join(m.CAROOT, ca.RootKeyName))
+	log.Printf("It's only needed to create a new intermediate, which will expire on %s 🗓\n",
+		m.ca.IntermediateCert.NotAfter.Format("2 January 2006"))
 }
 
 func (m *mkcert) caUniqueName() string {
-	return "mkcert development CA " + m.caCert.SerialNumber.String()
+	return m.ca.UniqueName()
+}
+
+func (m *mkcert) encryptCAKeys() {
+	// A CA created by loadCA with -encrypt-ca-key is already encrypted.
+	if !m.createdCA {
+		if m.ca.Encrypted() {
+			log.Fatalln("ERROR: the CA keys are already encrypted")
+		}
+		passphrase, err := readPassphrase(true)
+		fatalIfErr(err, "failed to read the passphrase")
+		err = m.ca.EncryptKeys(passphrase)
+		var missingKey *ca.MissingKeyError
+		if errors.As(err, &missingKey) {
+			log.Fatalf("ERROR: can't encrypt the CA keys because %s", err)
+		}
+		fatalIfErr(err, "failed to encrypt the CA keys")
+	}
+
+	log.Printf("The CA keys are now encrypted 🔒\n")
+	log.Printf("mkcert will ask for the passphrase, or read it from $MKCERT_CA_PASSPHRASE or $MKCERT_CA_PASSPHRASE_FD, when creating certificates ℹ️\n")
 }
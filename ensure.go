@@ -0,0 +1,116 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"filippo.io/mkcert/ca"
+	pkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+// upToDate returns the certificate in the files makeCert would write for
+// hosts, if they already hold one that was issued by the CA for exactly those
+// names, with the requested key type and EKUs, that wasn't revoked and
+// doesn't expire within m.within (or 30 days if not set), along with its key. If wantKey is not nil,
+// the certificate must also be for that public key. Otherwise, it returns nil.
+func (m *mkcert) upToDate(hosts []string, wantKey crypto.PublicKey, certFile, keyFile, p12File string) *x509.Certificate {
+	var cert *x509.Certificate
+	var key crypto.PrivateKey
+	if m.pkcs12 {
+		pfxData, err := ioutil.ReadFile(p12File)
+		if err != nil {
+			return nil
+		}
+		key, cert, _, err = pkcs12.DecodeChain(pfxData, "changeit")
+		if err != nil {
+			return nil
+		}
+	} else {
+		var err error
+		if cert, err = readLeaf(certFile); err != nil {
+			return nil
+		}
+		if key, err = readPrivateKey(keyFile); err != nil {
+			return nil
+		}
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil
+	}
+	pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(cert.PublicKey) {
+		return nil
+	}
+	if wantKey != nil && !pub.Equal(wantKey) {
+		return nil
+	}
+
+	if !m.ca.IssuedBy(cert) {
+		return nil
+	}
+	// If the revocation list can't be read, reissuing is the safe choice.
+	if r, err := m.ca.Revocation(cert.SerialNumber); err != nil || r != nil {
+		return nil
+	}
+	within := m.within
+	if within < 0 {
+		within = 30 * 24 * time.Hour
+	}
+	if cert.NotAfter.Before(time.Now().Add(within)) {
+		return nil
+	}
+	if m.keyType != "" && ca.KeyTypeOf(cert.PublicKey) != m.keyType {
+		return nil
+	}
+	var client bool
+	for _, eku := range cert.ExtKeyUsage {
+		if eku == x509.ExtKeyUsageClientAuth {
+			client = true
+		}
+	}
+	if client != m.client {
+		return nil
+	}
+
+	want, got := canonicalNames(hosts), canonicalNames(ca.CertificateNames(cert))
+	if len(want) != len(got) {
+		return nil
+	}
+	for i := range want {
+		if want[i] != got[i] {
+			return nil
+		}
+	}
+	return cert
+}
+
+// canonicalNames returns a sorted and deduplicated copy of names, with
+// hostnames lowercased and IP addresses in their canonical form.
+func canonicalNames(names []string) []string {
+	seen := make(map[string]bool)
+	var canonical []string
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			name = ip.String()
+		} else if !strings.Contains(name, "@") && !strings.Contains(name, "://") {
+			name = strings.ToLower(name)
+		}
+		if !seen[name] {
+			seen[name] = true
+			canonical = append(canonical, name)
+		}
+	}
+	sort.Strings(canonical)
+	return canonical
+}
@@ -3,12 +3,14 @@ module filippo.io/mkcert
 go 1.18
 
 require (
+	golang.org/x/crypto v0.0.0-20220331220935-ae2d96664a29
 	golang.org/x/net v0.0.0-20220421235706-1d1ef9303861
+	golang.org/x/term v0.0.0-20220411215600-e5f449aeb171
 	howett.net/plist v1.0.0
 	software.sslmate.com/src/go-pkcs12 v0.2.0
 )
 
 require (
-	golang.org/x/crypto v0.0.0-20220331220935-ae2d96664a29 // indirect
+	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e // indirect
 	golang.org/x/text v0.3.7 // indirect
 )
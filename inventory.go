@@ -0,0 +1,98 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"filippo.io/mkcert/ca"
+)
+
+// recordCert adds an issued certificate to the CA index, and to the -json
+// output. Failures are not fatal, since the certificate was already saved.
+func (m *mkcert) recordCert(cert *x509.Certificate, source string, files ...string) {
+	m.reportCert(cert, source, "issued", files...)
+	if err := m.ca.Record(ca.NewRecord(cert, source, files...)); err != nil {
+		log.Printf("Warning: failed to record the certificate in the CA index: %s ⚠️", err)
+	}
+}
+
+// list prints the certificates in the CA index, optionally filtered by name
+// patterns and by expiration within m.within.
+func (m *mkcert) list(patterns []string) {
+	records, err := m.ca.Inventory()
+	fatalIfErr(err, "failed to read the CA index")
+	revocations, err := m.ca.Revocations()
+	fatalIfErr(err, "failed to read the revocation list")
+	revoked := make(map[string]bool)
+	for _, r := range revocations {
+		revoked[r.Serial] = true
+	}
+
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			log.Fatalf("ERROR: invalid pattern %q: %s", p, err)
+		}
+	}
+
+	var selected []*ca.Record
+	for _, r := range records {
+		if m.within >= 0 && r.NotAfter.After(time.Now().Add(m.within)) {
+			continue
+		}
+		if len(patterns) > 0 && !recordMatches(r, patterns) {
+			continue
+		}
+		selected = append(selected, r)
+	}
+	sort.SliceStable(selected, func(i, j int) bool {
+		return selected[i].NotAfter.Before(selected[j].NotAfter)
+	})
+
+	if len(selected) == 0 {
+		log.Println("No certificates found.")
+		return
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERIAL\tEXPIRES\tNAMES\tKEY\tSOURCE\tFILES")
+	for _, r := range selected {
+		expires := r.NotAfter.Format("2006-01-02")
+		if r.NotAfter.Before(time.Now()) {
+			expires += " (expired)"
+		}
+		if revoked[r.Serial] {
+			expires += " (revoked)"
+		}
+		files := strings.Join(r.Files, ", ")
+		if files == "" {
+			files = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", r.Serial, expires,
+			strings.Join(r.Names, ", "), r.KeyType, r.Source, files)
+	}
+	tw.Flush()
+}
+
+// recordMatches reports whether any of the record names matches any of the
+// patterns, which use path.Match syntax and are case-insensitive.
+func recordMatches(r *ca.Record, patterns []string) bool {
+	for _, p := range patterns {
+		for _, name := range r.Names {
+			if ok, _ := path.Match(strings.ToLower(p), strings.ToLower(name)); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,452 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// This file reads and writes Java keystores, so the trusted certificate
+// entries of cacerts can be managed without keytool, which JRE-only and
+// jlink'd runtimes don't ship.
+//
+// Two formats are supported: JKS, used for cacerts up to Java 17, and the
+// password-less PKCS #12 used since Java 18, which has no MAC and no
+// encryption. Other entries, like private keys, are written back unchanged.
+// PKCS #12 keystores that are encrypted or MAC protected are reported as
+// errUnsupportedKeyStore, and left to keytool.
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+var errUnsupportedKeyStore = errors.New("unsupported keystore format")
+
+// A javaKeyStore is a decoded JKS or PKCS #12 keystore.
+type javaKeyStore struct {
+	pkcs12  bool
+	entries []*javaKeyStoreEntry
+}
+
+// A javaKeyStoreEntry is an entry of a javaKeyStore.
+type javaKeyStoreEntry struct {
+	Alias string
+	Cert  *x509.Certificate // nil if not a trusted certificate entry
+
+	raw []byte // the encoded entry, to write it back unchanged
+}
+
+// TrustedCerts returns the trusted certificate entries.
+func (ks *javaKeyStore) TrustedCerts() []*javaKeyStoreEntry {
+	var entries []*javaKeyStoreEntry
+	for _, e := range ks.entries {
+		if e.Cert != nil {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// SetTrustedCert adds a trusted certificate entry, replacing any entry with
+// the same alias. Aliases are case-insensitive, like in keytool.
+func (ks *javaKeyStore) SetTrustedCert(alias string, cert *x509.Certificate) {
+	ks.Delete(alias)
+	if !ks.pkcs12 {
+		// JKS stores aliases in lowercase.
+		alias = strings.ToLower(alias)
+	}
+	ks.entries = append(ks.entries, &javaKeyStoreEntry{Alias: alias, Cert: cert})
+}
+
+// Delete removes the entry with the given alias, and reports whether it was
+// present.
+func (ks *javaKeyStore) Delete(alias string) bool {
+	for i, e := range ks.entries {
+		if strings.EqualFold(e.Alias, alias) {
+			ks.entries = append(ks.entries[:i], ks.entries[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// parseJavaKeyStore decodes a JKS or PKCS #12 keystore. The password is
+// used to check the integrity of JKS keystores.
+func parseJavaKeyStore(data []byte, password string) (*javaKeyStore, error) {
+	if len(data) >= 4 && binary.BigEndian.Uint32(data) == jksMagic {
+		return parseJKS(data, password)
+	}
+	return parsePKCS12KeyStore(data)
+}
+
+// Marshal encodes the keystore in its original format.
+func (ks *javaKeyStore) Marshal(password string) ([]byte, error) {
+	if ks.pkcs12 {
+		return ks.marshalPKCS12()
+	}
+	return ks.marshalJKS(password), nil
+}
+
+// JKS, as implemented by sun.security.provider.JavaKeyStore.
+
+const (
+	jksMagic       = 0xfeedfeed
+	jksVersion     = 2
+	jksPrivateKey  = 1
+	jksTrustedCert = 2
+	jksCertType    = "X.509"
+)
+
+func parseJKS(data []byte, password string) (*javaKeyStore, error) {
+	if len(data) < 12+sha1.Size {
+		return nil, errors.New("truncated JKS keystore")
+	}
+	body, digest := data[:len(data)-sha1.Size], data[len(data)-sha1.Size:]
+	if !bytes.Equal(jksDigest(body, password), digest) {
+		return nil, errors.New("keystore password was incorrect")
+	}
+	version := binary.BigEndian.Uint32(body[4:])
+	if version != 1 && version != 2 {
+		return nil, fmt.Errorf("%w: JKS version %d", errUnsupportedKeyStore, version)
+	}
+
+	r := &jksReader{b: body[12:]}
+	ks := &javaKeyStore{}
+	for n := binary.BigEndian.Uint32(body[8:]); n > 0; n-- {
+		start := r.b
+		tag := r.uint32()
+		e := &javaKeyStoreEntry{Alias: r.utf()}
+		r.next(8) // creation date
+		switch tag {
+		case jksPrivateKey:
+			r.next(int(r.uint32()))
+			for chain := r.uint32(); chain > 0; chain-- {
+				r.cert(version)
+			}
+		case jksTrustedCert:
+			der := r.cert(version)
+			if r.err == nil {
+				cert, err := x509.ParseCertificate(der)
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse the certificate %q: %w", e.Alias, err)
+				}
+				e.Cert = cert
+			}
+		default:
+			return nil, fmt.Errorf("%w: JKS entry type %d", errUnsupportedKeyStore, tag)
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+		e.raw = start[:len(start)-len(r.b)]
+		ks.entries = append(ks.entries, e)
+	}
+	if len(r.b) != 0 {
+		return nil, errors.New("trailing data in JKS keystore")
+	}
+	return ks, nil
+}
+
+func (ks *javaKeyStore) marshalJKS(password string) []byte {
+	b := &bytes.Buffer{}
+	writeUint32 := func(v uint32) { binary.Write(b, binary.BigEndian, v) }
+	writeUTF := func(s string) {
+		// Java's DataOutput.writeUTF, which matches UTF-8 for ASCII aliases.
+		binary.Write(b, binary.BigEndian, uint16(len(s)))
+		b.WriteString(s)
+	}
+	writeUint32(jksMagic)
+	writeUint32(jksVersion)
+	writeUint32(uint32(len(ks.entries)))
+	for _, e := range ks.entries {
+		if e.raw != nil {
+			b.Write(e.raw)
+			continue
+		}
+		writeUint32(jksTrustedCert)
+		writeUTF(e.Alias)
+		binary.Write(b, binary.BigEndian, time.Now().UnixMilli())
+		writeUTF(jksCertType)
+		writeUint32(uint32(len(e.Cert.Raw)))
+		b.Write(e.Cert.Raw)
+	}
+	b.Write(jksDigest(b.Bytes(), password))
+	return b.Bytes()
+}
+
+// jksDigest computes the integrity check of a JKS keystore, which is a SHA-1
+// hash of the UTF-16 password, a fixed string, and the keystore.
+func jksDigest(data []byte, password string) []byte {
+	h := sha1.New()
+	for _, c := range utf16.Encode([]rune(password)) {
+		h.Write([]byte{byte(c >> 8), byte(c)})
+	}
+	h.Write([]byte("Mighty Aphrodite"))
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// jksReader decodes the fields of a JKS keystore, recording the first error.
+type jksReader struct {
+	b   []byte
+	err error
+}
+
+func (r *jksReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.b) {
+		r.err = errors.New("truncated JKS keystore")
+		r.b = nil
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *jksReader) uint32() uint32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *jksReader) utf() string {
+	b := r.next(2)
+	if b == nil {
+		return ""
+	}
+	return string(r.next(int(binary.BigEndian.Uint16(b))))
+}
+
+func (r *jksReader) cert(version uint32) []byte {
+	if version == 2 {
+		if typ := r.utf(); r.err == nil && typ != jksCertType {
+			r.err = fmt.Errorf("%w: certificate type %q", errUnsupportedKeyStore, typ)
+		}
+	}
+	return r.next(int(r.uint32()))
+}
+
+// PKCS #12, see RFC 7292.
+
+var (
+	oidDataContentType = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidCertBag         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidX509Certificate = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+
+	// oidJavaTrustedKeyUsage marks trusted certificate entries, with the
+	// extended key usages they are trusted for.
+	oidJavaTrustedKeyUsage = asn1.ObjectIdentifier{2, 16, 840, 1, 113894, 746875, 1, 1}
+	oidAnyExtendedKeyUsage = asn1.ObjectIdentifier{2, 5, 29, 37, 0}
+)
+
+type pfxPDU struct {
+	Version  int
+	AuthSafe p12ContentInfo
+	MacData  asn1.RawValue `asn1:"optional"`
+}
+
+type p12ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit"`
+}
+
+type p12SafeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue  `asn1:"tag:0,explicit"`
+	Attributes []p12Attribute `asn1:"set,optional"`
+}
+
+type p12Attribute struct {
+	ID     asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+type p12CertBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+func parsePKCS12KeyStore(data []byte) (*javaKeyStore, error) {
+	var pfx pfxPDU
+	if err := unmarshalDER(data, &pfx); err != nil {
+		return nil, fmt.Errorf("%w: %v", errUnsupportedKeyStore, err)
+	}
+	if pfx.Version != 3 {
+		return nil, fmt.Errorf("%w: PKCS #12 version %d", errUnsupportedKeyStore, pfx.Version)
+	}
+	if len(pfx.MacData.FullBytes) != 0 {
+		return nil, fmt.Errorf("%w: PKCS #12 keystore is password protected", errUnsupportedKeyStore)
+	}
+	authSafe, err := p12Data(pfx.AuthSafe)
+	if err != nil {
+		return nil, err
+	}
+	var contents []p12ContentInfo
+	if err := unmarshalDER(authSafe, &contents); err != nil {
+		return nil, fmt.Errorf("failed to parse the PKCS #12 keystore: %w", err)
+	}
+
+	ks := &javaKeyStore{pkcs12: true}
+	for _, ci := range contents {
+		safeContents, err := p12Data(ci)
+		if err != nil {
+			return nil, err
+		}
+		var bags []asn1.RawValue
+		if err := unmarshalDER(safeContents, &bags); err != nil {
+			return nil, fmt.Errorf("failed to parse the PKCS #12 keystore: %w", err)
+		}
+		for _, raw := range bags {
+			e, err := parsePKCS12Entry(raw.FullBytes)
+			if err != nil {
+				return nil, err
+			}
+			ks.entries = append(ks.entries, e)
+		}
+	}
+	return ks, nil
+}
+
+// p12Data returns the content of a ContentInfo of type data.
+func p12Data(ci p12ContentInfo) ([]byte, error) {
+	if !ci.ContentType.Equal(oidDataContentType) {
+		return nil, fmt.Errorf("%w: PKCS #12 keystore is encrypted", errUnsupportedKeyStore)
+	}
+	var data []byte
+	if err := unmarshalDER(ci.Content.Bytes, &data); err != nil {
+		return nil, fmt.Errorf("failed to parse the PKCS #12 keystore: %w", err)
+	}
+	return data, nil
+}
+
+func parsePKCS12Entry(raw []byte) (*javaKeyStoreEntry, error) {
+	var bag p12SafeBag
+	if err := unmarshalDER(raw, &bag); err != nil {
+		return nil, fmt.Errorf("failed to parse the PKCS #12 keystore: %w", err)
+	}
+	e := &javaKeyStoreEntry{raw: raw}
+	var trusted bool
+	for _, attr := range bag.Attributes {
+		switch {
+		case attr.ID.Equal(oidFriendlyName):
+			var name asn1.RawValue
+			if err := unmarshalDER(attr.Values.Bytes, &name); err != nil || name.Tag != asn1.TagBMPString {
+				return nil, errors.New("failed to parse the PKCS #12 keystore: invalid friendly name")
+			}
+			e.Alias = decodeBMPString(name.Bytes)
+		case attr.ID.Equal(oidJavaTrustedKeyUsage):
+			trusted = true
+		}
+	}
+	if !bag.ID.Equal(oidCertBag) || !trusted {
+		return e, nil
+	}
+	var certBag p12CertBag
+	if err := unmarshalDER(bag.Value.Bytes, &certBag); err != nil {
+		return nil, fmt.Errorf("failed to parse the PKCS #12 keystore: %w", err)
+	}
+	if !certBag.ID.Equal(oidX509Certificate) {
+		return e, nil
+	}
+	cert, err := x509.ParseCertificate(certBag.Data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the certificate %q: %w", e.Alias, err)
+	}
+	e.Cert = cert
+	return e, nil
+}
+
+func (ks *javaKeyStore) marshalPKCS12() ([]byte, error) {
+	var bags []asn1.RawValue
+	for _, e := range ks.entries {
+		if e.raw == nil {
+			raw, err := marshalPKCS12Entry(e)
+			if err != nil {
+				return nil, err
+			}
+			e.raw = raw
+		}
+		bags = append(bags, asn1.RawValue{FullBytes: e.raw})
+	}
+	safeContents, err := asn1.Marshal(bags)
+	if err != nil {
+		return nil, err
+	}
+	authSafe, err := asn1.Marshal([]p12ContentInfo{newP12Data(safeContents)})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(pfxPDU{Version: 3, AuthSafe: newP12Data(authSafe)})
+}
+
+func newP12Data(data []byte) p12ContentInfo {
+	content, _ := asn1.Marshal(data)
+	return p12ContentInfo{
+		ContentType: oidDataContentType,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: content},
+	}
+}
+
+func marshalPKCS12Entry(e *javaKeyStoreEntry) ([]byte, error) {
+	certBag, err := asn1.Marshal(p12CertBag{ID: oidX509Certificate, Data: e.Cert.Raw})
+	if err != nil {
+		return nil, err
+	}
+	name, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagBMPString, Bytes: encodeBMPString(e.Alias)})
+	if err != nil {
+		return nil, err
+	}
+	usage, err := asn1.Marshal(oidAnyExtendedKeyUsage)
+	if err != nil {
+		return nil, err
+	}
+	set := func(b []byte) asn1.RawValue {
+		return asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: b}
+	}
+	return asn1.Marshal(p12SafeBag{
+		ID:    oidCertBag,
+		Value: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certBag},
+		Attributes: []p12Attribute{
+			{ID: oidFriendlyName, Values: set(name)},
+			{ID: oidJavaTrustedKeyUsage, Values: set(usage)},
+		},
+	})
+}
+
+// unmarshalDER is asn1.Unmarshal, but it rejects trailing data.
+func unmarshalDER(data []byte, v interface{}) error {
+	rest, err := asn1.Unmarshal(data, v)
+	if err == nil && len(rest) != 0 {
+		err = errors.New("trailing data")
+	}
+	return err
+}
+
+func decodeBMPString(b []byte) string {
+	s := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		s = append(s, uint16(b[i])<<8|uint16(b[i+1]))
+	}
+	return string(utf16.Decode(s))
+}
+
+func encodeBMPString(s string) []byte {
+	var b []byte
+	for _, c := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(c>>8), byte(c))
+	}
+	return b
+}
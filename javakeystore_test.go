@@ -0,0 +1,155 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"testing"
+
+	pkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+func TestJavaKeyStoreRoundTrip(t *testing.T) {
+	a, b := newTestCA(t).Cert, newTestCA(t).Cert
+	for _, p12 := range []bool{false, true} {
+		ks := &javaKeyStore{pkcs12: p12}
+		ks.SetTrustedCert("First Root", a)
+		ks.SetTrustedCert("second", b)
+		ks.SetTrustedCert("second", a) // replaces the entry
+		data, err := ks.Marshal(storePass)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ks, err = parseJavaKeyStore(data, storePass)
+		if err != nil {
+			t.Fatalf("pkcs12=%v: %v", p12, err)
+		}
+		if ks.pkcs12 != p12 {
+			t.Errorf("pkcs12=%v: format changed", p12)
+		}
+		entries := ks.TrustedCerts()
+		if len(entries) != 2 {
+			t.Fatalf("pkcs12=%v: got %d entries, want 2", p12, len(entries))
+		}
+		wantAlias := "First Root"
+		if !p12 {
+			wantAlias = "first root"
+		}
+		if entries[0].Alias != wantAlias || !entries[0].Cert.Equal(a) {
+			t.Errorf("pkcs12=%v: got entry %q", p12, entries[0].Alias)
+		}
+		if entries[1].Alias != "second" || !entries[1].Cert.Equal(a) {
+			t.Errorf("pkcs12=%v: got entry %q", p12, entries[1].Alias)
+		}
+
+		// Parsed entries are written back unchanged.
+		again, err := ks.Marshal(storePass)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p12 && !bytes.Equal(again, data) {
+			t.Errorf("pkcs12=%v: re-encoding changed the keystore", p12)
+		}
+		if !p12 && !bytes.Equal(again[:len(again)-20], data[:len(data)-20]) {
+			t.Errorf("pkcs12=%v: re-encoding changed the keystore", p12)
+		}
+
+		if !ks.Delete("FIRST ROOT") || ks.Delete("first root") {
+			t.Errorf("pkcs12=%v: Delete is not case-insensitive", p12)
+		}
+		data, err = ks.Marshal(storePass)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ks, err = parseJavaKeyStore(data, storePass)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entries := ks.TrustedCerts(); len(entries) != 1 || entries[0].Alias != "second" {
+			t.Errorf("pkcs12=%v: got %d entries after Delete", p12, len(entries))
+		}
+	}
+}
+
+func TestJKSIntegrity(t *testing.T) {
+	ks := &javaKeyStore{}
+	ks.SetTrustedCert("root", newTestCA(t).Cert)
+	data, _ := ks.Marshal(storePass)
+	if _, err := parseJavaKeyStore(data, "wrong"); err == nil {
+		t.Errorf("wrong password accepted")
+	}
+	data[len(data)/2] ^= 1
+	if _, err := parseJavaKeyStore(data, storePass); err == nil {
+		t.Errorf("corrupted keystore accepted")
+	}
+	for n := 0; n < len(data); n += 7 {
+		parseJavaKeyStore(data[:n], storePass) // must not panic
+	}
+}
+
+func TestJKSPrivateKeyEntry(t *testing.T) {
+	// A private key entry with an opaque key and a chain of one certificate,
+	// as written by keytool, which must be kept as is.
+	cert := newTestCA(t).Cert
+	entry := &bytes.Buffer{}
+	entry.Write([]byte{0, 0, 0, jksPrivateKey, 0, 3, 'k', 'e', 'y', 0, 0, 0, 0, 0, 0, 0, 0})
+	entry.Write([]byte{0, 0, 0, 4, 0xde, 0xad, 0xbe, 0xef})
+	entry.Write([]byte{0, 0, 0, 1, 0, 5, 'X', '.', '5', '0', '9'})
+	entry.Write([]byte{0, 0, byte(len(cert.Raw) >> 8), byte(len(cert.Raw))})
+	entry.Write(cert.Raw)
+
+	body := []byte{0xfe, 0xed, 0xfe, 0xed, 0, 0, 0, 2, 0, 0, 0, 1}
+	body = append(body, entry.Bytes()...)
+	data := append(body, jksDigest(body, storePass)...)
+
+	ks, err := parseJavaKeyStore(data, storePass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ks.entries) != 1 || len(ks.TrustedCerts()) != 0 || ks.entries[0].Alias != "key" {
+		t.Fatalf("got %d entries", len(ks.entries))
+	}
+	ks.SetTrustedCert("root", cert)
+	out, err := ks.Marshal(storePass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(out, entry.Bytes()) {
+		t.Errorf("the private key entry was not preserved")
+	}
+}
+
+func TestPKCS12KeyStoreInterop(t *testing.T) {
+	certs := []*x509.Certificate{newTestCA(t).Cert, newTestCA(t).Cert}
+
+	// Password protected keystores are left to keytool.
+	data, err := pkcs12.EncodeTrustStore(rand.Reader, certs, storePass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseJavaKeyStore(data, storePass); !errors.Is(err, errUnsupportedKeyStore) {
+		t.Errorf("got %v, want errUnsupportedKeyStore", err)
+	}
+
+	// Ours are readable by other implementations.
+	ks := &javaKeyStore{pkcs12: true}
+	ks.SetTrustedCert("a", certs[0])
+	ks.SetTrustedCert("b", certs[1])
+	data, err = ks.Marshal(storePass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := pkcs12.DecodeTrustStore(data, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalCertList(decoded, certs) {
+		t.Errorf("got %d different certificates", len(decoded))
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"os"
+
+	"filippo.io/mkcert/ca"
+)
+
+// jsonResult is printed to standard output by -json. The usual messages are
+// still printed to standard error.
+type jsonResult struct {
+	CAROOT       string       `json:"caroot"`
+	Certificates []*jsonCert  `json:"certificates,omitempty"`
+	TrustStores  []*jsonStore `json:"trust_stores,omitempty"`
+}
+
+type jsonCert struct {
+	*ca.Record
+	Status string `json:"status"` // "issued" or "up_to_date"
+}
+
+type jsonStore struct {
+	Name      string `json:"name"` // like in $TRUST_STORES
+	Installed bool   `json:"installed"`
+	Changed   bool   `json:"changed"`
+	Error     string `json:"error,omitempty"`
+}
+
+// reportCert adds a certificate to the -json output, if enabled.
+func (m *mkcert) reportCert(cert *x509.Certificate, source, status string, files ...string) {
+	if m.result == nil {
+		return
+	}
+	m.result.Certificates = append(m.result.Certificates, &jsonCert{
+		Record: ca.NewRecord(cert, source, files...), Status: status,
+	})
+}
+
+// reportStore adds the state of a trust store to the -json output, if enabled.
+func (m *mkcert) reportStore(name string, installed, changed bool, err string) {
+	if m.result == nil {
+		return
+	}
+	m.result.TrustStores = append(m.result.TrustStores, &jsonStore{
+		Name: name, Installed: installed, Changed: changed, Error: err,
+	})
+}
+
+func printJSON(v interface{}) {
+	e := json.NewEncoder(os.Stdout)
+	e.SetIndent("", "\t")
+	fatalIfErr(e.Encode(v), "failed to encode the JSON output")
+}
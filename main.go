@@ -6,8 +6,8 @@
 package main
 
 import (
-	"crypto"
 	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -21,9 +21,12 @@ import (
 	"regexp"
 	"runtime"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"filippo.io/mkcert/ca"
 	"golang.org/x/net/idna"
 )
 
@@ -54,8 +57,19 @@ const advancedUsage = `Advanced options:
 	-client
 	    Generate a certificate for client authentication.
 
+	-key-type TYPE
+	    Generate keys of TYPE: "rsa2048" (the default for certificates),
+	    "rsa3072" (the default for a new CA), "rsa4096", "p256", "p384",
+	    "p521" or "ed25519". Applies to the CA too if it's created now.
+	    Browsers don't support "ed25519", and Chrome not "p521".
+
 	-ecdsa
-	    Generate a certificate with an ECDSA key.
+	    Shorthand for -key-type p256.
+
+	-key-in FILE
+	    Generate a certificate for the existing private key in FILE, in
+	    PKCS #8, PKCS #1 or SEC 1 PEM format, instead of a new one. The
+	    key is also saved to the usual key file.
 
 	-pkcs12
 	    Generate a ".p12" PKCS #12 file, also know as a ".pfx" file,
@@ -65,6 +79,139 @@ const advancedUsage = `Advanced options:
 	    Generate a certificate based on the supplied CSR. Conflicts with
 	    all other flags and arguments except -install and -cert-file.
 
+	-csr-strict
+	    With -csr, refuse to sign CSRs that request CA basic constraints
+	    or key usages, name constraints, SANs other than DNS names, IPs,
+	    emails and URIs, EKUs other than serverAuth, clientAuth and
+	    emailProtection, or unknown critical extensions. By default those
+	    are left out of the certificate, and listed.
+
+	-acme-server ADDR
+	    Run an ACME (RFC 8555) server on ADDR, such as "localhost:8443",
+	    issuing certificates from the local CA. The directory is served
+	    at "https://ADDR/directory". Supports the http-01 and tls-alpn-01
+	    challenges, validated on ports 80 and 443 respectively.
+
+	-rotate-ca
+	    Replace the local CA root with a new one, for example to change
+	    its -key-type. The new root is installed alongside the previous
+	    one, and the certificates in the -list whose files still hold a
+	    certificate from the previous root are re-issued, keeping their
+	    keys. Run it again after the grace period to uninstall and
+	    delete the previous root.
+
+	-cross-sign
+	    With -rotate-ca, sign the new root with the previous one, and
+	    include that certificate in the chain of new certificates, so
+	    they are also trusted where only the previous root is installed.
+
+	-grace DURATION
+	    With -rotate-ca, how long to keep the previous root installed
+	    (default "30d"). When finishing a rotation, "0" skips the rest
+	    of the grace period.
+
+	-create-intermediate
+	    Create an intermediate CA signed by the local root CA, and use it
+	    to sign all new certificates. The root key is then only needed to
+	    create a new intermediate, and can be stored offline.
+
+	-encrypt-ca-key
+	    Encrypt the CA keys in CAROOT with a passphrase, which is then
+	    required to create certificates. The passphrase is read from
+	    $MKCERT_CA_PASSPHRASE, from the file descriptor number in
+	    $MKCERT_CA_PASSPHRASE_FD, or from the terminal.
+
+	-name-constraints LIST
+	    When creating a new CA, only allow it to issue certificates for
+	    the comma-separated domains (and their subdomains) and CIDR IP
+	    ranges, such as "test,localhost,127.0.0.0/8". "local" expands
+	    to local-only TLDs and loopback and private IP ranges. If no IP
+	    ranges are listed, no IP addresses are allowed.
+
+	-validity DURATION
+	    Set how long from now new certificates are valid, such as "90d",
+	    "24h" or "1y". The default is 2 years and 3 months. macOS and
+	    iOS reject certificates valid for longer than 825 days.
+
+	-not-before TIME
+	    Backdate the start of the validity period of new certificates by
+	    a duration like "1h", or set it to an RFC 3339 timestamp.
+
+	-list [PATTERN...]
+	    List the certificates issued by the local CA, optionally only
+	    those with a name matching one of the patterns, like "*.test".
+
+	-within DURATION
+	    With -list, only show certificates that expire within DURATION,
+	    such as "30d", including those that already expired. With
+	    -renew-all, only renew those (default "30d"). With -ensure,
+	    regenerate the certificate if it expires within DURATION.
+
+	-revoke SERIAL|FILE
+	    Revoke a certificate issued by the local CA, identified by its
+	    serial number (see -list) or by its PEM file.
+
+	-crl
+	    Generate a CRL of the revoked certificates, signed by the local
+	    CA, as "crl.der" and "crl.pem" in CAROOT. It's valid for 7 days.
+
+	-crl-url URL
+	    Include URL as the CRL Distribution Point of new certificates.
+	    Publish the output of -crl there for clients to check it.
+
+	-ocsp-server ADDR
+	    Run an OCSP responder over HTTP on ADDR, such as ":8889", that
+	    reports certificates as revoked (see -revoke), good if they are
+	    listed by -list, or unknown. Can be combined with -acme-server.
+
+	-ocsp-url URL
+	    Include URL as the OCSP responder of new certificates.
+
+	-ensure
+	    Only generate the certificate if the output files don't already
+	    hold one from the local CA for exactly the same names, key type
+	    and -client setting, that wasn't revoked and expires after
+	    -within (default "30d"). Useful to run mkcert on every start of
+	    a container or build.
+
+	-manifest FILE
+	    Generate all the certificates described in the JSON file FILE,
+	    each with its names and optional "cert_file", "key_file",
+	    "p12_file", "key_type", "client" and "pkcs12" settings. See the
+	    README for an example.
+
+	-json
+	    Print the result of generating certificates, -install, -uninstall
+	    or -CAROOT to standard output as JSON, including the paths, serial
+	    numbers, names and expiration of certificates, and the state of
+	    each trust store. Other messages are still printed to standard
+	    error.
+
+	-renew FILE
+	    Issue a new certificate for the same names and key usages as the
+	    one in FILE, which is overwritten. The key is saved to the file
+	    next to it, like "example.com+4-key.pem", or -key-file.
+
+	-renew-all DIR
+	    Renew every certificate issued by the local CA in a ".pem" file
+	    under DIR that expires within -within. Files are replaced
+	    atomically. If some fail, the others are still renewed, and
+	    mkcert exits with an error.
+
+	-reuse-key
+	    With -renew or -renew-all, keep the existing key instead of
+	    generating a new one.
+
+	-status
+	    Show whether the local CA is installed in each trust store and
+	    Firefox or Chrome profile, and list any roots left there by
+	    mkcert with a different CAROOT.
+
+	-prune
+	    Remove the roots left in the trust stores by mkcert with a
+	    different CAROOT, such as one that was deleted, as listed by
+	    -status. Can be combined with -install.
+
 	-CAROOT
 	    Print the CA certificate and key storage location.
 
@@ -74,8 +221,8 @@ const advancedUsage = `Advanced options:
 
 	$TRUST_STORES (environment variable)
 	    A comma-separated list of trust stores to install the local
-	    root CA into. Options are: "system", "java" and "nss" (includes
-	    Firefox). Autodetected by default.
+	    root CA into. Options are: "system", "java", "nss" (includes
+	    Firefox) and "node". Autodetected by default.
 
 `
 
@@ -95,13 +242,40 @@ func main() {
 		uninstallFlag = flag.Bool("uninstall", false, "")
 		pkcs12Flag    = flag.Bool("pkcs12", false, "")
 		ecdsaFlag     = flag.Bool("ecdsa", false, "")
+		keyTypeFlag   = flag.String("key-type", "", "")
+		keyInFlag     = flag.String("key-in", "", "")
 		clientFlag    = flag.Bool("client", false, "")
 		helpFlag      = flag.Bool("help", false, "")
 		carootFlag    = flag.Bool("CAROOT", false, "")
 		csrFlag       = flag.String("csr", "", "")
+		csrStrictFlag = flag.Bool("csr-strict", false, "")
 		certFileFlag  = flag.String("cert-file", "", "")
 		keyFileFlag   = flag.String("key-file", "", "")
 		p12FileFlag   = flag.String("p12-file", "", "")
+		acmeFlag      = flag.String("acme-server", "", "")
+		intFlag       = flag.Bool("create-intermediate", false, "")
+		encryptFlag   = flag.Bool("encrypt-ca-key", false, "")
+		constrainFlag = flag.String("name-constraints", "", "")
+		validityFlag  = flag.String("validity", "", "")
+		notBeforeFlag = flag.String("not-before", "", "")
+		listFlag      = flag.Bool("list", false, "")
+		withinFlag    = flag.String("within", "", "")
+		revokeFlag    = flag.String("revoke", "", "")
+		crlFlag       = flag.Bool("crl", false, "")
+		crlURLFlag    = flag.String("crl-url", "", "")
+		ocspFlag      = flag.String("ocsp-server", "", "")
+		ocspURLFlag   = flag.String("ocsp-url", "", "")
+		renewFlag     = flag.String("renew", "", "")
+		reuseKeyFlag  = flag.Bool("reuse-key", false, "")
+		renewAllFlag  = flag.String("renew-all", "", "")
+		manifestFlag  = flag.String("manifest", "", "")
+		ensureFlag    = flag.Bool("ensure", false, "")
+		jsonFlag      = flag.Bool("json", false, "")
+		statusFlag    = flag.Bool("status", false, "")
+		pruneFlag     = flag.Bool("prune", false, "")
+		rotateFlag    = flag.Bool("rotate-ca", false, "")
+		crossFlag     = flag.Bool("cross-sign", false, "")
+		graceFlag     = flag.String("grace", "", "")
 		versionFlag   = flag.Bool("version", false, "")
 	)
 	flag.Usage = func() {
@@ -126,46 +300,246 @@ func main() {
 		fmt.Println("(unknown)")
 		return
 	}
+	checkFlags()
 	if *carootFlag {
-		if *installFlag || *uninstallFlag {
-			log.Fatalln("ERROR: you can't set -[un]install and -CAROOT at the same time")
+		if *jsonFlag {
+			printJSON(&jsonResult{CAROOT: getCAROOT()})
+			return
 		}
 		fmt.Println(getCAROOT())
 		return
 	}
-	if *installFlag && *uninstallFlag {
-		log.Fatalln("ERROR: you can't set -install and -uninstall at the same time")
+	if *withinFlag != "" && *renewAllFlag == "" && !*listFlag && !*ensureFlag {
+		log.Fatalln("ERROR: -within can only be used with -list, -renew-all or -ensure")
+	}
+	grace := time.Duration(-1)
+	if *graceFlag != "" {
+		var err error
+		if grace, err = parseDuration(*graceFlag); err != nil || grace < 0 {
+			log.Fatalf("ERROR: invalid -grace value %q: must be a duration like \"30d\"", *graceFlag)
+		}
+	}
+	if *ocspURLFlag != "" {
+		if u, err := url.Parse(*ocspURLFlag); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatalf("ERROR: invalid -ocsp-url value %q: must be an http:// or https:// URL", *ocspURLFlag)
+		}
+	}
+	if *crlURLFlag != "" {
+		if u, err := url.Parse(*crlURLFlag); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatalf("ERROR: invalid -crl-url value %q: must be an http:// or https:// URL", *crlURLFlag)
+		}
+	}
+	keyType := *keyTypeFlag
+	if *ecdsaFlag {
+		if keyType != "" && keyType != ca.KeyTypeP256 {
+			log.Fatalln("ERROR: you can't set -ecdsa and -key-type at the same time")
+		}
+		keyType = ca.KeyTypeP256
+	}
+	if keyType != "" && !isKeyType(keyType) {
+		log.Fatalf("ERROR: invalid -key-type value %q: must be one of %s", keyType, strings.Join(ca.KeyTypes, ", "))
+	}
+	if *keyInFlag != "" && keyType != "" {
+		log.Fatalln("ERROR: you can't set -key-in and -key-type at the same time")
+	}
+	within := time.Duration(-1)
+	if *withinFlag != "" {
+		var err error
+		if within, err = parseDuration(*withinFlag); err != nil || within < 0 {
+			log.Fatalf("ERROR: invalid -within value %q: must be a duration like \"30d\"", *withinFlag)
+		}
 	}
-	if *csrFlag != "" && (*pkcs12Flag || *ecdsaFlag || *clientFlag) {
-		log.Fatalln("ERROR: can only combine -csr with -install and -cert-file")
+	var notBefore time.Time
+	var backdate, validity time.Duration
+	if *notBeforeFlag != "" {
+		if t, err := time.Parse(time.RFC3339, *notBeforeFlag); err == nil {
+			notBefore = t
+		} else if backdate, err = parseDuration(*notBeforeFlag); err != nil || backdate < 0 {
+			log.Fatalf("ERROR: invalid -not-before value %q: must be a duration like \"1h\" or an RFC 3339 timestamp", *notBeforeFlag)
+		}
 	}
-	if *csrFlag != "" && flag.NArg() != 0 {
-		log.Fatalln("ERROR: can't specify extra arguments when using -csr")
+	if *validityFlag != "" {
+		var err error
+		if validity, err = parseDuration(*validityFlag); err != nil || validity <= 0 {
+			log.Fatalf("ERROR: invalid -validity value %q: must be a duration like \"90d\", \"24h\" or \"1y\"", *validityFlag)
+		}
 	}
 	(&mkcert{
-		installMode: *installFlag, uninstallMode: *uninstallFlag, csrPath: *csrFlag,
-		pkcs12: *pkcs12Flag, ecdsa: *ecdsaFlag, client: *clientFlag,
+		installMode: *installFlag, uninstallMode: *uninstallFlag, csrPath: *csrFlag, csrStrict: *csrStrictFlag,
+		pkcs12: *pkcs12Flag, keyType: keyType, keyIn: *keyInFlag, client: *clientFlag,
 		certFile: *certFileFlag, keyFile: *keyFileFlag, p12File: *p12FileFlag,
+		acmeAddr: *acmeFlag, createIntermediate: *intFlag, encryptKey: *encryptFlag,
+		nameConstraints: *constrainFlag, listMode: *listFlag, within: within,
+		notBefore: notBefore, backdate: backdate, validity: validity,
+		revokeArg: *revokeFlag, crl: *crlFlag, crlURL: *crlURLFlag,
+		ocspAddr: *ocspFlag, ocspURL: *ocspURLFlag,
+		renewPath: *renewFlag, reuseKey: *reuseKeyFlag, renewAllDir: *renewAllFlag,
+		manifestPath: *manifestFlag, ensure: *ensureFlag, json: *jsonFlag,
+		statusMode: *statusFlag, pruneMode: *pruneFlag,
+		rotateCA: *rotateFlag, crossSign: *crossFlag, grace: grace,
 	}).Run(flag.Args())
 }
 
-const rootName = "rootCA.pem"
-const rootKeyName = "rootCA-key.pem"
+// A flagMode is a flag that selects what mkcert does, and the other flags it
+// can be combined with.
+type flagMode struct {
+	flag    string
+	allowed []string
+	args    string // what the arguments are, or "" if there can't be any
+}
+
+// flagModes are checked in order, and the first one set on the command line
+// selects the mode. If none is set, mkcert generates certificates, and
+// generateMode lists the flags that can be used.
+var flagModes = []flagMode{
+	{flag: "CAROOT", allowed: []string{"json"}},
+	{flag: "status"},
+	{flag: "prune", allowed: []string{"install"}},
+	{flag: "rotate-ca", allowed: []string{"key-type", "ecdsa", "name-constraints", "cross-sign", "grace"}},
+	{flag: "create-intermediate", allowed: []string{"key-type", "ecdsa", "name-constraints"}},
+	{flag: "encrypt-ca-key", allowed: []string{"key-type", "ecdsa", "name-constraints"}},
+	{flag: "list", allowed: []string{"within"}, args: "name patterns"},
+	{flag: "revoke", allowed: []string{"crl"}},
+	{flag: "crl", allowed: []string{"revoke"}},
+	{flag: "uninstall", allowed: []string{"json"}},
+	{flag: "acme-server", allowed: []string{"install", "ocsp-server", "key-type", "ecdsa", "name-constraints",
+		"validity", "not-before", "crl-url", "ocsp-url"}},
+	{flag: "ocsp-server", allowed: []string{"install", "acme-server", "key-type", "ecdsa", "name-constraints",
+		"validity", "not-before", "crl-url", "ocsp-url"}},
+	{flag: "csr", allowed: []string{"install", "csr-strict", "cert-file", "name-constraints",
+		"validity", "not-before", "crl-url", "ocsp-url", "json"}},
+	{flag: "renew", allowed: []string{"install", "reuse-key", "key-type", "ecdsa", "cert-file", "key-file",
+		"name-constraints", "validity", "not-before", "crl-url", "ocsp-url", "json"}},
+	{flag: "renew-all", allowed: []string{"install", "within", "reuse-key", "key-type", "ecdsa",
+		"name-constraints", "validity", "not-before", "crl-url", "ocsp-url", "json"}},
+	{flag: "manifest", allowed: []string{"install", "ensure", "within", "key-type", "ecdsa",
+		"name-constraints", "validity", "not-before", "crl-url", "ocsp-url", "json"}},
+}
+
+var generateMode = flagMode{allowed: []string{"install", "ensure", "within", "key-type", "ecdsa", "key-in",
+	"client", "pkcs12", "cert-file", "key-file", "p12-file", "name-constraints",
+	"validity", "not-before", "crl-url", "ocsp-url", "json"}, args: "names"}
+
+func (md flagMode) allows(name string) bool {
+	for _, a := range md.allowed {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFlags exits if the flags set on the command line can't be used
+// together, according to flagModes.
+func checkFlags() {
+	var set []string
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Value.String() != f.DefValue {
+			set = append(set, f.Name)
+		}
+	})
+	mode := generateMode
+	for _, md := range flagModes {
+		if flagIn(md.flag, set) {
+			mode = md
+			break
+		}
+	}
+
+	for _, name := range set {
+		if name == mode.flag || mode.allows(name) {
+			continue
+		}
+		if mode.flag == "" {
+			var with []string
+			for _, md := range flagModes {
+				if md.allows(name) {
+					with = append(with, "-"+md.flag)
+				}
+			}
+			log.Fatalf("ERROR: -%s can only be used with %s", name, joinFlags(with, "or"))
+		}
+		if len(mode.allowed) == 0 {
+			log.Fatalf("ERROR: -%s can't be combined with other options", mode.flag)
+		}
+		with := make([]string, 0, len(mode.allowed)+1)
+		for _, a := range mode.allowed {
+			with = append(with, "-"+a)
+		}
+		if mode.args != "" {
+			with = append(with, mode.args)
+		}
+		log.Fatalf("ERROR: can only combine -%s with %s", mode.flag, joinFlags(with, "and"))
+	}
+	if flag.NArg() != 0 && mode.args == "" {
+		log.Fatalf("ERROR: can't specify extra arguments when using -%s", mode.flag)
+	}
+}
+
+func flagIn(name string, names []string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// joinFlags joins names like "-a, -b and -c", with conj as the last separator.
+func joinFlags(names []string, conj string) string {
+	if len(names) < 2 {
+		return strings.Join(names, "")
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " " + conj + " " + names[len(names)-1]
+}
+
+const rootName = ca.RootName
 
 type mkcert struct {
 	installMode, uninstallMode bool
-	pkcs12, ecdsa, client      bool
+	pkcs12, client             bool
+	keyType, keyIn             string
 	keyFile, certFile, p12File string
 	csrPath                    string
+	csrStrict                  bool
+	acmeAddr                   string
+	createIntermediate         bool
+	encryptKey                 bool
+	nameConstraints            string
+	notBefore                  time.Time
+	backdate, validity         time.Duration
+	listMode, statusMode       bool
+	pruneMode                  bool
+	rotateCA, crossSign        bool
+	grace                      time.Duration // or -1 if not set
+	within                     time.Duration // or -1 if not set
+	revokeArg                  string
+	crl                        bool
+	crlURL                     string
+	ocspAddr, ocspURL          string
+	renewPath, renewAllDir     string
+	manifestPath               string
+	ensure                     bool
+	json                       bool
+	reuseKey                   bool
 
 	CAROOT string
-	caCert *x509.Certificate
-	caKey  crypto.PrivateKey
+	ca     *ca.CA
+
+	// createdCA is set if loadCA created the CA in this run.
+	createdCA bool
+
+	// previous and rotation are set while the root is being rotated.
+	previous *ca.CA
+	rotation *ca.Rotation
 
 	// The system cert pool is only loaded once. After installing the root, checks
 	// will keep failing until the next execution. TODO: maybe execve?
 	// https://github.com/golang/go/issues/24540 (thanks, myself)
 	ignoreCheckFailure bool
+
+	// result collects the -json output, if enabled.
+	result *jsonResult
 }
 
 func (m *mkcert) Run(args []string) {
@@ -176,9 +550,51 @@ func (m *mkcert) Run(args []string) {
 	fatalIfErr(os.MkdirAll(m.CAROOT, 0755), "failed to create the CAROOT")
 	m.loadCA()
 
+	if m.json {
+		m.result = &jsonResult{CAROOT: m.CAROOT}
+		defer printJSON(m.result)
+	}
+
+	if m.rotateCA {
+		m.rotate()
+		return
+	}
+	if m.createIntermediate {
+		m.newIntermediate()
+		return
+	}
+	if m.encryptKey {
+		m.encryptCAKeys()
+		return
+	}
+	if m.listMode {
+		m.list(args)
+		return
+	}
+	if m.statusMode {
+		m.status()
+		return
+	}
+	if m.pruneMode {
+		if m.installMode {
+			m.install()
+		}
+		m.prune()
+		return
+	}
+	if m.revokeArg != "" || m.crl {
+		if m.revokeArg != "" {
+			m.revoke(m.revokeArg)
+		}
+		if m.crl {
+			m.writeCRL()
+		}
+		return
+	}
+
 	if m.installMode {
 		m.install()
-		if len(args) == 0 {
+		if len(args) == 0 && m.acmeAddr == "" && m.ocspAddr == "" && m.renewPath == "" && m.renewAllDir == "" && m.manifestPath == "" {
 			return
 		}
 	} else if m.uninstallMode {
@@ -186,35 +602,66 @@ func (m *mkcert) Run(args []string) {
 		return
 	} else {
 		var warning bool
-		if storeEnabled("system") && !m.checkPlatform() {
-			warning = true
-			log.Println("Note: the local CA is not installed in the system trust store.")
-		}
-		if storeEnabled("nss") && hasNSS && CertutilInstallHelp != "" && !m.checkNSS() {
-			warning = true
-			log.Printf("Note: the local CA is not installed in the %s trust store.", NSSBrowsers)
-		}
-		if storeEnabled("java") && hasJava && !m.checkJava() {
-			warning = true
-			log.Println("Note: the local CA is not installed in the Java trust store.")
+		for _, s := range enabledTrustStores() {
+			err := s.Available()
+			if err == errNoStore || err == errUnsupported {
+				continue
+			}
+			// Checking doesn't need the tools that make changes.
+			installed := s.Check(m)
+			if !installed {
+				warning = true
+				log.Printf("Note: the local CA is not installed in %s.", s.Description())
+			}
+			m.reportStore(s.Name(), installed, false, "")
 		}
 		if warning {
 			log.Println("Run \"mkcert -install\" for certificates to be trusted automatically ⚠️")
 		}
 	}
 
+	if m.ocspAddr != "" && m.acmeAddr != "" {
+		m.checkSigner() // before the servers start, as it might prompt
+		go m.serveOCSP()
+	} else if m.ocspAddr != "" {
+		m.serveOCSP()
+		return
+	}
+	if m.acmeAddr != "" {
+		m.serveACME()
+		return
+	}
+
 	if m.csrPath != "" {
 		m.makeCertFromCSR()
 		return
 	}
 
+	if m.renewPath != "" {
+		m.renew(m.renewPath)
+		return
+	}
+	if m.renewAllDir != "" {
+		m.renewAll(m.renewAllDir)
+		return
+	}
+	if m.manifestPath != "" {
+		m.issueManifest(m.manifestPath)
+		return
+	}
+
 	if len(args) == 0 {
 		flag.Usage()
 		return
 	}
 
-	hostnameRegexp := regexp.MustCompile(`(?i)^(\*\.)?[0-9a-z_-]([0-9a-z._-]*[0-9a-z_-])?$`)
-	for i, name := range args {
+	m.makeCert(normalizeHosts(args))
+}
+
+// normalizeHosts validates the hostnames, IPs, URLs and emails in hosts, and
+// converts hostnames to punycode. It exits if any is invalid.
+func normalizeHosts(hosts []string) []string {
+	for i, name := range hosts {
 		if ip := net.ParseIP(name); ip != nil {
 			continue
 		}
@@ -228,15 +675,16 @@ func (m *mkcert) Run(args []string) {
 		if err != nil {
 			log.Fatalf("ERROR: %q is not a valid hostname, IP, URL or email: %s", name, err)
 		}
-		args[i] = punycode
+		hosts[i] = punycode
 		if !hostnameRegexp.MatchString(punycode) {
 			log.Fatalf("ERROR: %q is not a valid hostname, IP, URL or email", name)
 		}
 	}
-
-	m.makeCert(args)
+	return hosts
 }
 
+var hostnameRegexp = regexp.MustCompile(`(?i)^(\*\.)?[0-9a-z_-]([0-9a-z._-]*[0-9a-z_-])?$`)
+
 func getCAROOT() string {
 	if env := os.Getenv("CAROOT"); env != "" {
 		return env
@@ -265,72 +713,83 @@ func getCAROOT() string {
 }
 
 func (m *mkcert) install() {
-	if storeEnabled("system") {
-		if m.checkPlatform() {
-			log.Print("The local CA is already installed in the system trust store! 👍")
-		} else {
-			if m.installPlatform() {
-				log.Print("The local CA is now installed in the system trust store! ⚡️")
-			}
-			m.ignoreCheckFailure = true // TODO: replace with a check for a successful install
-		}
-	}
-	if storeEnabled("nss") && hasNSS {
-		if m.checkNSS() {
-			log.Printf("The local CA is already installed in the %s trust store! 👍", NSSBrowsers)
-		} else {
-			if hasCertutil && m.installNSS() {
-				log.Printf("The local CA is now installed in the %s trust store (requires browser restart)! 🦊", NSSBrowsers)
-			} else if CertutilInstallHelp == "" {
-				log.Printf(`Note: %s support is not available on your platform. ℹ️`, NSSBrowsers)
-			} else if !hasCertutil {
-				log.Printf(`Warning: "certutil" is not available, so the CA can't be automatically installed in %s! ⚠️`, NSSBrowsers)
-				log.Printf(`Install "certutil" with "%s" and re-run "mkcert -install" 👈`, CertutilInstallHelp)
+	for _, s := range enabledTrustStores() {
+		err := s.Available()
+		var missingTool *missingToolError
+		switch {
+		case err == errNoStore:
+			continue
+		case err == errUnsupported:
+			log.Printf("Note: installing in %s is not supported on this platform ℹ️", s.Description())
+			log.Printf("You can also manually install the root certificate at %q.", filepath.Join(m.CAROOT, rootName))
+			m.reportStore(s.Name(), false, false, err.Error())
+			continue
+		case errors.As(err, &missingTool):
+			log.Printf(`Warning: %s, so the CA can't be automatically installed in %s! ⚠️`, err, s.Description())
+			if missingTool.Help != "" {
+				log.Printf(`Install %q with "%s" and re-run "mkcert -install" 👈`, missingTool.Tool, missingTool.Help)
 			}
+			m.reportStore(s.Name(), false, false, err.Error())
+			continue
+		case err != nil:
+			log.Printf("Warning: can't install the CA in %s: %s ⚠️", s.Description(), err)
+			m.reportStore(s.Name(), false, false, err.Error())
+			continue
 		}
-	}
-	if storeEnabled("java") && hasJava {
-		if m.checkJava() {
-			log.Println("The local CA is already installed in Java's trust store! 👍")
-		} else {
-			if hasKeytool {
-				m.installJava()
-				log.Println("The local CA is now installed in Java's trust store! ☕️")
-			} else {
-				log.Println(`Warning: "keytool" is not available, so the CA can't be automatically installed in Java's trust store! ⚠️`)
+
+		if s.Check(m) {
+			log.Printf("The local CA is already installed in %s! 👍", s.Description())
+			m.reportStore(s.Name(), true, false, "")
+			continue
+		}
+		if err := s.Install(m); err != nil {
+			log.Printf("Warning: failed to install the local CA in %s: %s ⚠️", s.Description(), err)
+			if errors.As(err, &missingTool) && missingTool.Help != "" {
+				log.Printf(`Install %q with "%s" and re-run "mkcert -install" 👈`, missingTool.Tool, missingTool.Help)
 			}
+			m.reportStore(s.Name(), false, false, err.Error())
+			continue
 		}
+		m.reportStore(s.Name(), true, true, "")
 	}
 	log.Print("")
 }
 
 func (m *mkcert) uninstall() {
-	if storeEnabled("nss") && hasNSS {
-		if hasCertutil {
-			m.uninstallNSS()
-		} else if CertutilInstallHelp != "" {
-			log.Print("")
-			log.Printf(`Warning: "certutil" is not available, so the CA can't be automatically uninstalled from %s (if it was ever installed)! ⚠️`, NSSBrowsers)
-			log.Printf(`You can install "certutil" with "%s" and re-run "mkcert -uninstall" 👈`, CertutilInstallHelp)
-			log.Print("")
+	for _, s := range enabledTrustStores() {
+		err := s.Available()
+		var missingTool *missingToolError
+		switch {
+		case err == errNoStore || err == errUnsupported:
+			continue
+		case err != nil && !errors.As(err, &missingTool):
+			log.Printf("Warning: can't uninstall the CA from %s: %s ⚠️", s.Description(), err)
+			m.reportStore(s.Name(), false, false, err.Error())
+			continue
 		}
-	}
-	if storeEnabled("java") && hasJava {
-		if hasKeytool {
-			m.uninstallJava()
-		} else {
+
+		// A store missing a tool might still be able to remove the CA from
+		// some locations, like NSS cert9.db databases.
+		err = s.Uninstall(m)
+		if errors.As(err, &missingTool) {
 			log.Print("")
-			log.Println(`Warning: "keytool" is not available, so the CA can't be automatically uninstalled from Java's trust store (if it was ever installed)! ⚠️`)
+			log.Printf(`Warning: %s, so the CA can't be automatically uninstalled from %s (if it was ever installed)! ⚠️`, err, s.Description())
+			if missingTool.Help != "" {
+				log.Printf(`You can install %q with "%s" and re-run "mkcert -uninstall" 👈`, missingTool.Tool, missingTool.Help)
+			}
 			log.Print("")
+			m.reportStore(s.Name(), false, false, err.Error())
+			continue
 		}
+		if err != nil {
+			log.Printf("Warning: failed to uninstall the local CA from %s: %s ⚠️", s.Description(), err)
+			m.reportStore(s.Name(), false, false, err.Error())
+			continue
+		}
+		log.Printf("The local CA is now uninstalled from %s! 👋", s.Description())
+		m.reportStore(s.Name(), false, true, "")
 	}
-	if storeEnabled("system") && m.uninstallPlatform() {
-		log.Print("The local CA is now uninstalled from the system trust store(s)! 👋")
-		log.Print("")
-	} else if storeEnabled("nss") && hasCertutil {
-		log.Printf("The local CA is now uninstalled from the %s trust store(s)! 👋", NSSBrowsers)
-		log.Print("")
-	}
+	log.Print("")
 }
 
 func (m *mkcert) checkPlatform() bool {
@@ -338,7 +797,7 @@ func (m *mkcert) checkPlatform() bool {
 		return true
 	}
 
-	_, err := m.caCert.Verify(x509.VerifyOptions{})
+	_, err := m.ca.Cert.Verify(x509.VerifyOptions{})
 	return err == nil
 }
 
@@ -355,6 +814,33 @@ func storeEnabled(name string) bool {
 	return false
 }
 
+// validityPeriod returns the validity period for a certificate issued now,
+// or zero values to use the defaults.
+func (m *mkcert) validityPeriod() (notBefore, notAfter time.Time) {
+	notBefore = m.notBefore
+	if m.backdate != 0 {
+		notBefore = time.Now().Add(-m.backdate)
+	}
+	if m.validity != 0 {
+		if notBefore.IsZero() {
+			notBefore = time.Now()
+		}
+		notAfter = time.Now().Add(m.validity)
+	}
+	return
+}
+
+// parseDuration parses a duration like time.ParseDuration, but also accepts
+// a number of days or years, like "90d" or "1y". A year is 365 days.
+func parseDuration(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "y": 365 * 24 * time.Hour} {
+		if n, err := strconv.Atoi(strings.TrimSuffix(s, suffix)); strings.HasSuffix(s, suffix) && err == nil {
+			return time.Duration(n) * unit, nil
+		}
+	}
+	return time.ParseDuration(s)
+}
+
 func fatalIfErr(err error, msg string) {
 	if err != nil {
 		log.Fatalf("ERROR: %s: %s", msg, err)
@@ -0,0 +1,133 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/mkcert/ca"
+)
+
+// A manifest describes a batch of certificates to issue with -manifest.
+//
+//	{
+//		"certificates": [
+//			{"names": ["example.test", "localhost"], "cert_file": "certs/web.pem", "key_file": "certs/web-key.pem"},
+//			{"names": ["db.test"], "key_type": "p256", "client": true},
+//			{"names": ["iis.test"], "pkcs12": true, "p12_file": "certs/iis.p12"}
+//		]
+//	}
+type manifest struct {
+	Certificates []*manifestCert `json:"certificates"`
+}
+
+// A manifestCert corresponds to the arguments and options of a single mkcert
+// invocation. Relative paths are resolved against the manifest directory, and
+// the output files default to the same names mkcert would use, in that
+// directory. Missing directories are created.
+type manifestCert struct {
+	Names    []string `json:"names"`
+	CertFile string   `json:"cert_file"`
+	KeyFile  string   `json:"key_file"`
+	P12File  string   `json:"p12_file"`
+	KeyType  string   `json:"key_type"`
+	Client   bool     `json:"client"`
+	PKCS12   bool     `json:"pkcs12"`
+}
+
+// issueManifest issues all the certificates described in the manifest file at
+// path. The whole manifest is validated before any certificate is issued.
+func (m *mkcert) issueManifest(path string) {
+	data, err := ioutil.ReadFile(path)
+	fatalIfErr(err, "failed to read the manifest")
+	var mf manifest
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&mf); err != nil {
+		if ext := strings.ToLower(filepath.Ext(path)); ext == ".yaml" || ext == ".yml" {
+			log.Fatalf("ERROR: failed to parse the manifest: %s (only JSON manifests are supported)", err)
+		}
+		fatalIfErr(err, "failed to parse the manifest")
+	}
+	if len(mf.Certificates) == 0 {
+		log.Fatalln("ERROR: the manifest doesn't list any certificates")
+	}
+
+	dir := filepath.Dir(path)
+	resolve := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+
+	type job struct {
+		m     *mkcert
+		hosts []string
+	}
+	var batch []job
+	written := make(map[string]int) // output file -> certificate number
+	for i, c := range mf.Certificates {
+		if len(c.Names) == 0 {
+			log.Fatalf("ERROR: certificate %d in the manifest has no names", i+1)
+		}
+		if c.KeyType != "" && !isKeyType(c.KeyType) {
+			log.Fatalf("ERROR: certificate %d in the manifest has an invalid key_type %q: must be one of %s",
+				i+1, c.KeyType, strings.Join(ca.KeyTypes, ", "))
+		}
+		if c.P12File != "" && !c.PKCS12 {
+			log.Fatalf("ERROR: certificate %d in the manifest sets p12_file but not pkcs12", i+1)
+		}
+		hosts := normalizeHosts(c.Names)
+		for _, h := range hosts {
+			m.checkHost(h)
+		}
+
+		mm := *m
+		mm.client, mm.pkcs12 = c.Client, c.PKCS12
+		if c.KeyType != "" {
+			mm.keyType = c.KeyType
+		}
+		certFile, keyFile, p12File := mm.fileNames(hosts)
+		mm.certFile = resolve(c.CertFile)
+		if mm.certFile == "" {
+			mm.certFile = filepath.Join(dir, certFile)
+		}
+		mm.keyFile = resolve(c.KeyFile)
+		if mm.keyFile == "" {
+			mm.keyFile = filepath.Join(dir, keyFile)
+		}
+		mm.p12File = resolve(c.P12File)
+		if mm.p12File == "" {
+			mm.p12File = filepath.Join(dir, p12File)
+		}
+		outputs := []string{mm.certFile, mm.keyFile}
+		if mm.pkcs12 {
+			outputs = []string{mm.p12File}
+		}
+		for _, f := range outputs {
+			f = filepath.Clean(f)
+			if prev, ok := written[f]; ok && prev != i+1 {
+				log.Fatalf("ERROR: certificate %d in the manifest would overwrite %q from certificate %d (duplicate names need distinct output files)", i+1, f, prev)
+			}
+			written[f] = i + 1
+		}
+		batch = append(batch, job{&mm, hosts})
+	}
+
+	for _, j := range batch {
+		for _, f := range []string{j.m.certFile, j.m.keyFile, j.m.p12File} {
+			fatalIfErr(os.MkdirAll(filepath.Dir(f), 0755), "failed to create the output directory")
+		}
+		j.m.makeCert(j.hosts)
+	}
+	log.Printf("Issued %d certificates from %q ✅\n", len(batch), path)
+}
@@ -0,0 +1,818 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// This file reads the certificates and trust settings of NSS cert9.db
+// databases directly, so they can be checked and listed without certutil. It
+// implements just enough of the SQLite file format to read a table, see
+// https://www.sqlite.org/fileformat.html.
+//
+// Certificates are also added and removed directly, see nssdb_write.go. NSS
+// checks trust settings against signatures in key4.db, made with a key
+// derived from its password, see nssdb_sign.go, so adding them needs the
+// password to be empty, as it is unless the user set a primary password.
+// Otherwise, certutil is used to ask for it.
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PKCS #11 and NSS constants, from pkcs11t.h and pkcs11n.h.
+const (
+	ckaClass           = 0x00
+	ckaToken           = 0x01
+	ckaPrivate         = 0x02
+	ckaLabel           = 0x03
+	ckaValue           = 0x11
+	ckaCertificateType = 0x80
+	ckaIssuer          = 0x81
+	ckaSerialNumber    = 0x82
+	ckaSubject         = 0x101
+	ckaID              = 0x102
+	ckaModifiable      = 0x170
+
+	ckoCertificate = 0x01
+	ckoNSSTrust    = 0xce534353
+	ckcX509        = 0x00
+
+	ckaTrustServerAuth      = 0xce536358
+	ckaTrustClientAuth      = 0xce536359
+	ckaTrustCodeSigning     = 0xce53635a
+	ckaTrustEmailProtection = 0xce53635b
+	ckaTrustStepUpApproved  = 0xce536360
+	ckaCertSHA1Hash         = 0xce5363b4
+	ckaCertMD5Hash          = 0xce5363b5
+
+	cktNSSTrustedDelegator = 0xce534352
+	cktNSSMustVerifyTrust  = 0xce534353
+	cktNSSValidDelegator   = 0xce53435b
+)
+
+// nssSignedTrustAttributes are the attributes of trust objects that NSS
+// signs in key4.db.
+var nssSignedTrustAttributes = []uint32{
+	ckaTrustServerAuth, ckaTrustClientAuth, ckaTrustCodeSigning,
+	ckaTrustEmailProtection, ckaTrustStepUpApproved,
+	ckaCertSHA1Hash, ckaCertMD5Hash,
+}
+
+// sqliteExplicitNull is how NSS stores attributes with an empty value, as
+// opposed to missing ones which are NULL.
+var sqliteExplicitNull = []byte{0xa5, 0x00, 0x5a}
+
+// An nssCert is a certificate in an NSS database.
+type nssCert struct {
+	Nickname string
+	Cert     *x509.Certificate
+
+	// TrustedCA is whether the certificate is trusted to issue certificates
+	// for TLS servers, the "C" in certutil's "C,,".
+	TrustedCA bool
+}
+
+// readNSSDB reads the certificates in the cert9.db database in dir.
+func readNSSDB(dir string) ([]*nssCert, error) {
+	db, err := openSQLite(filepath.Join(dir, "cert9.db"))
+	if err != nil {
+		return nil, err
+	}
+	objects, err := nssObjects(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*nssCert
+	certsByID := make(map[nssIssuerAndSerial]*nssCert)
+	var trusts []*nssObject
+	for _, o := range objects {
+		switch nssULong(o.attrs[ckaClass]) {
+		case ckoCertificate:
+			cert, err := x509.ParseCertificate(o.attrs[ckaValue])
+			if err != nil {
+				continue
+			}
+			c := &nssCert{Nickname: string(o.attrs[ckaLabel]), Cert: cert}
+			certs = append(certs, c)
+			certsByID[o.issuerAndSerial()] = c
+		case ckoNSSTrust:
+			trusts = append(trusts, o)
+		}
+	}
+	for _, t := range trusts {
+		c := certsByID[t.issuerAndSerial()]
+		if c != nil && nssULong(t.attrs[ckaTrustServerAuth]) == cktNSSTrustedDelegator {
+			c.TrustedCA = true
+		}
+	}
+	return certs, nil
+}
+
+// deleteNSSCert removes cert and its trust settings from the cert9.db
+// database in dir, like "certutil -D" but by certificate rather than by
+// nickname, and reports whether it was there.
+func deleteNSSCert(dir string, cert *x509.Certificate) (bool, error) {
+	var trustIDs []int64
+	err := sqliteRetry(func() error {
+		trustIDs = nil
+		tx, err := beginSQLiteTx(filepath.Join(dir, "cert9.db"))
+		if err != nil {
+			return err
+		}
+		defer tx.close()
+		objects, err := nssObjects(tx.db)
+		if err != nil {
+			return err
+		}
+		rowids := make(map[int64]bool)
+		certIDs := make(map[nssIssuerAndSerial]bool)
+		for _, o := range objects {
+			if nssULong(o.attrs[ckaClass]) == ckoCertificate && bytes.Equal(o.attrs[ckaValue], cert.Raw) {
+				rowids[o.rowid] = true
+				certIDs[o.issuerAndSerial()] = true
+			}
+		}
+		for _, o := range objects {
+			if nssULong(o.attrs[ckaClass]) == ckoNSSTrust && certIDs[o.issuerAndSerial()] {
+				rowids[o.rowid] = true
+				trustIDs = append(trustIDs, o.id)
+			}
+		}
+		if len(certIDs) == 0 {
+			return errNSSCertNotFound
+		}
+		if err := tx.deleteRows("nssPublic", rowids); err != nil {
+			return err
+		}
+		return tx.commit()
+	})
+	if err == errNSSCertNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if len(trustIDs) > 0 {
+		if err := deleteNSSSignatures(filepath.Join(dir, "key4.db"), trustIDs); err != nil {
+			log.Printf("Warning: failed to remove the trust settings signatures from %s: %s ⚠️", filepath.Join(dir, "key4.db"), err)
+		}
+	}
+	return true, nil
+}
+
+var errNSSCertNotFound = errors.New("certificate not found")
+
+// addNSSCert adds cert to the cert9.db database in dir with the given
+// nickname, trusted to issue certificates for TLS servers, like "certutil -A
+// -t C,,". Any copy of cert already there is replaced. It returns
+// errNSSNeedsCertutil if the trust settings can't be signed in key4.db.
+func addNSSCert(dir, nickname string, cert *x509.Certificate) error {
+	keyDB := filepath.Join(dir, "key4.db")
+	passKey, err := nssPassKey(keyDB)
+	if err != nil {
+		return err
+	}
+	serial, err := asn1.Marshal(cert.SerialNumber)
+	if err != nil {
+		return err
+	}
+	certAttrs := map[uint32][]byte{
+		ckaClass:           appendUint32(nil, ckoCertificate),
+		ckaToken:           {1},
+		ckaPrivate:         {0},
+		ckaModifiable:      {1},
+		ckaLabel:           []byte(nickname),
+		ckaValue:           cert.Raw,
+		ckaCertificateType: appendUint32(nil, ckcX509),
+		ckaIssuer:          cert.RawIssuer,
+		ckaSerialNumber:    serial,
+		ckaSubject:         cert.RawSubject,
+	}
+	if id := nssKeyID(cert); id != nil {
+		certAttrs[ckaID] = id
+	}
+	sha1Hash, md5Hash := sha1.Sum(cert.Raw), md5.Sum(cert.Raw)
+	trustAttrs := map[uint32][]byte{
+		ckaClass:        appendUint32(nil, ckoNSSTrust),
+		ckaToken:        {1},
+		ckaPrivate:      {0},
+		ckaModifiable:   {1},
+		ckaLabel:        {},
+		ckaIssuer:       cert.RawIssuer,
+		ckaSerialNumber: serial,
+
+		// What certutil sets for "C,,".
+		ckaTrustServerAuth:      appendUint32(nil, cktNSSTrustedDelegator),
+		ckaTrustClientAuth:      appendUint32(nil, cktNSSValidDelegator),
+		ckaTrustCodeSigning:     appendUint32(nil, cktNSSMustVerifyTrust),
+		ckaTrustEmailProtection: appendUint32(nil, cktNSSMustVerifyTrust),
+		ckaTrustStepUpApproved:  {0},
+		ckaCertSHA1Hash:         sha1Hash[:],
+		ckaCertMD5Hash:          md5Hash[:],
+	}
+
+	var oldTrustIDs []int64
+	err = sqliteRetry(func() error {
+		oldTrustIDs = nil
+		tx, err := beginSQLiteTx(filepath.Join(dir, "cert9.db"))
+		if err != nil {
+			return err
+		}
+		defer tx.close()
+		objects, err := nssObjects(tx.db)
+		if err != nil {
+			return err
+		}
+		rowids := make(map[int64]bool)
+		used := make(map[int64]bool)
+		for _, o := range objects {
+			used[o.id] = true
+			switch nssULong(o.attrs[ckaClass]) {
+			case ckoCertificate:
+				if bytes.Equal(o.attrs[ckaValue], cert.Raw) {
+					rowids[o.rowid] = true
+				}
+			case ckoNSSTrust:
+				if bytes.Equal(o.attrs[ckaIssuer], cert.RawIssuer) && bytes.Equal(o.attrs[ckaSerialNumber], serial) {
+					rowids[o.rowid] = true
+					oldTrustIDs = append(oldTrustIDs, o.id)
+				}
+			}
+		}
+		certID, err := nssNewObjectID(used)
+		if err != nil {
+			return err
+		}
+		used[certID] = true
+		trustID, err := nssNewObjectID(used)
+		if err != nil {
+			return err
+		}
+
+		// NSS rejects trust settings without a valid signature, but doesn't
+		// mind signatures without an object, so the signatures go first.
+		sigs := make(map[string][]byte)
+		for _, typ := range nssSignedTrustAttributes {
+			sig, err := nssSignature(passKey, uint32(trustID), typ, trustAttrs[typ])
+			if err != nil {
+				return err
+			}
+			sigs[fmt.Sprintf("sig_cert_%08x_%08x", uint32(trustID), typ)] = sig
+		}
+		if err := updateNSSSignatures(keyDB, []int64{trustID}, sigs); err != nil {
+			return fmt.Errorf("failed to sign the trust settings in %s: %w", keyDB, err)
+		}
+
+		added := []map[string]interface{}{nssRow(certID, certAttrs), nssRow(trustID, trustAttrs)}
+		if err := tx.updateRows("nssPublic", rowids, added); err != nil {
+			return err
+		}
+		return tx.commit()
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(oldTrustIDs) > 0 {
+		if err := deleteNSSSignatures(keyDB, oldTrustIDs); err != nil {
+			log.Printf("Warning: failed to remove the old trust settings signatures from %s: %s ⚠️", keyDB, err)
+		}
+	}
+	return nil
+}
+
+// nssRow returns the nssPublic columns of an object with the given
+// attributes, storing empty values like NSS does.
+func nssRow(id int64, attrs map[uint32][]byte) map[string]interface{} {
+	row := map[string]interface{}{"id": id}
+	for typ, value := range attrs {
+		if len(value) == 0 {
+			value = sqliteExplicitNull
+		}
+		row[fmt.Sprintf("a%x", typ)] = value
+	}
+	return row
+}
+
+// nssNewObjectID picks a random object ID that is not in used, in the range
+// that NSS uses for database objects.
+func nssNewObjectID(used map[int64]bool) (int64, error) {
+	for {
+		var b [4]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return 0, err
+		}
+		id := int64(binary.BigEndian.Uint32(b[:]) & 0x3fffffff)
+		if id != 0 && !used[id] {
+			return id, nil
+		}
+	}
+}
+
+// nssKeyID returns the CKA_ID of cert, which NSS derives from the public key
+// to match certificates with their private keys, or nil if NSS doesn't set
+// one for the key type.
+func nssKeyID(cert *x509.Certificate) []byte {
+	var id [sha1.Size]byte
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		id = sha1.Sum(pub.N.Bytes())
+	case *ecdsa.PublicKey:
+		// The encoded point, as in the certificate.
+		var spki struct {
+			Algorithm pkix.AlgorithmIdentifier
+			PublicKey asn1.BitString
+		}
+		if _, err := asn1.Unmarshal(cert.RawSubjectPublicKeyInfo, &spki); err != nil {
+			return nil
+		}
+		id = sha1.Sum(spki.PublicKey.Bytes)
+	default:
+		return nil
+	}
+	return id[:]
+}
+
+// deleteNSSSignatures removes the MACs of the attributes of the trust objects
+// with the given IDs from the key4.db database at path, like certutil does,
+// as NSS would reject them for a new object with the same ID.
+func deleteNSSSignatures(path string, ids []int64) error {
+	return updateNSSSignatures(path, ids, nil)
+}
+
+// updateNSSSignatures removes the MACs of the attributes of the objects with
+// the given IDs from the key4.db database at path, like deleteNSSSignatures,
+// and adds sigs, by name.
+func updateNSSSignatures(path string, ids []int64, sigs map[string][]byte) error {
+	return sqliteRetry(func() error {
+		tx, err := beginSQLiteTx(path)
+		if errors.Is(err, os.ErrNotExist) && len(sigs) == 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer tx.close()
+		rows, err := tx.db.readTable("metaData")
+		if err != nil {
+			return err
+		}
+		rowids := make(map[int64]bool)
+		for _, row := range rows {
+			name, _ := row.values["id"].(string)
+			for _, id := range ids {
+				if strings.HasPrefix(name, fmt.Sprintf("sig_cert_%08x_", uint32(id))) {
+					rowids[row.rowid] = true
+				}
+			}
+		}
+		var names []string
+		for name := range sigs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var added []map[string]interface{}
+		for _, name := range names {
+			added = append(added, map[string]interface{}{"id": name, "item1": sigs[name]})
+		}
+		if err := tx.updateRows("metaData", rowids, added); err != nil {
+			return err
+		}
+		return tx.commit()
+	})
+}
+
+// An nssObject is a row of the nssPublic table, like a certificate or its
+// trust settings.
+type nssObject struct {
+	rowid int64
+	id    int64 // the NSS object ID
+	attrs map[uint32][]byte
+}
+
+// nssIssuerAndSerial links certificates and their trust settings.
+type nssIssuerAndSerial struct{ issuer, serial string }
+
+func (o *nssObject) issuerAndSerial() nssIssuerAndSerial {
+	return nssIssuerAndSerial{string(o.attrs[ckaIssuer]), string(o.attrs[ckaSerialNumber])}
+}
+
+// nssObjects returns the objects in the nssPublic table of db.
+func nssObjects(db *sqliteDB) ([]*nssObject, error) {
+	rows, err := db.readTable("nssPublic")
+	if err != nil {
+		return nil, err
+	}
+	var objects []*nssObject
+	for _, row := range rows {
+		o := &nssObject{rowid: row.rowid, attrs: make(map[uint32][]byte)}
+		o.id, _ = row.values["id"].(int64)
+		for column, value := range row.values {
+			if !strings.HasPrefix(column, "a") {
+				continue
+			}
+			typ, err := strconv.ParseUint(column[1:], 16, 32)
+			if err != nil {
+				continue
+			}
+			switch value := value.(type) {
+			case []byte:
+				if bytes.Equal(value, sqliteExplicitNull) {
+					value = []byte{}
+				}
+				o.attrs[uint32(typ)] = value
+			case string:
+				o.attrs[uint32(typ)] = []byte(value)
+			}
+		}
+		objects = append(objects, o)
+	}
+	return objects, nil
+}
+
+// nssULong decodes a CK_ULONG attribute, which NSS stores as four bytes in
+// network order, or returns math.MaxUint32 if it's malformed.
+func nssULong(b []byte) uint32 {
+	if len(b) != 4 {
+		return math.MaxUint32
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+// nssProfileDir returns the directory of a profile as passed by
+// forEachNSSProfile, and whether it's a cert9.db one.
+func nssProfileDir(profile string) (string, bool) {
+	return strings.TrimPrefix(profile, "sql:"), strings.HasPrefix(profile, "sql:")
+}
+
+// sqliteDB is a read-only SQLite database, loaded in memory.
+type sqliteDB struct {
+	data       []byte
+	pageSize   int
+	usableSize int
+}
+
+func openSQLite(path string) (*sqliteDB, error) {
+	// Committed changes might only be in the write-ahead log, which we
+	// don't read. NSS doesn't normally use WAL mode.
+	if wal, err := storeFS.Stat(path + "-wal"); err == nil && wal.Size() > 0 {
+		return nil, errors.New("the database has changes in its write-ahead log")
+	}
+	data, err := storeFS.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseSQLite(data)
+}
+
+// parseSQLite checks the header of the database in data.
+func parseSQLite(data []byte) (*sqliteDB, error) {
+	if len(data) < 100 || string(data[:16]) != "SQLite format 3\x00" {
+		return nil, errors.New("not a SQLite database")
+	}
+	db := &sqliteDB{data: data, pageSize: int(binary.BigEndian.Uint16(data[16:]))}
+	if db.pageSize == 1 {
+		db.pageSize = 65536
+	}
+	if db.pageSize < 512 || db.pageSize&(db.pageSize-1) != 0 || len(data)%db.pageSize != 0 {
+		return nil, errors.New("invalid SQLite page size")
+	}
+	db.usableSize = db.pageSize - int(data[20])
+	if db.usableSize < 480 {
+		return nil, errors.New("invalid SQLite reserved space")
+	}
+	if enc := binary.BigEndian.Uint32(data[56:]); enc != 0 && enc != 1 {
+		return nil, errors.New("unsupported SQLite text encoding")
+	}
+	return db, nil
+}
+
+// A sqliteRow is a row of a table, with its values by column name.
+type sqliteRow struct {
+	rowid  int64
+	values map[string]interface{}
+}
+
+// readTable returns all the rows of a table, in rowid order.
+func (db *sqliteDB) readTable(name string) ([]sqliteRow, error) {
+	schema, err := db.readSchema()
+	if err != nil {
+		return nil, err
+	}
+	var t *sqliteSchemaEntry
+	for _, e := range schema {
+		if e.Type == "table" && e.Name == name {
+			t = e
+		}
+	}
+	if t == nil || t.RootPage == 0 {
+		return nil, fmt.Errorf("table %s not found", name)
+	}
+	columns, err := sqliteColumns(t.SQL)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []sqliteRow
+	err = db.walkTable(t.RootPage, make(map[uint32]bool), func(rowid int64, payload []byte) error {
+		values, err := parseSQLiteRecord(payload)
+		if err != nil {
+			return err
+		}
+		row := sqliteRow{rowid: rowid, values: make(map[string]interface{})}
+		// Columns added by ALTER TABLE are missing from older rows.
+		for i := 0; i < len(columns) && i < len(values); i++ {
+			row.values[columns[i]] = values[i]
+		}
+		rows = append(rows, row)
+		return nil
+	})
+	return rows, err
+}
+
+// A sqliteSchemaEntry is a row of the sqlite_schema table, which lists the
+// tables and indexes, and their root pages.
+type sqliteSchemaEntry struct {
+	Type, Name, Table string
+	RootPage          uint32
+	SQL               string // empty for automatic indexes
+
+	rowid int64
+}
+
+func (db *sqliteDB) readSchema() ([]*sqliteSchemaEntry, error) {
+	var schema []*sqliteSchemaEntry
+	err := db.walkTable(1, make(map[uint32]bool), func(rowid int64, payload []byte) error {
+		values, err := parseSQLiteRecord(payload)
+		if err != nil {
+			return err
+		}
+		if len(values) < 5 {
+			return errors.New("invalid SQLite schema")
+		}
+		e := &sqliteSchemaEntry{rowid: rowid}
+		e.Type, _ = values[0].(string)
+		e.Name, _ = values[1].(string)
+		e.Table, _ = values[2].(string)
+		e.SQL, _ = values[4].(string)
+		if root, _ := values[3].(int64); root > 0 && root <= math.MaxUint32 {
+			e.RootPage = uint32(root)
+		}
+		schema = append(schema, e)
+		return nil
+	})
+	return schema, err
+}
+
+// sqliteColumns returns the column names from a CREATE TABLE statement,
+// which is all NSS needs.
+func sqliteColumns(sql string) ([]string, error) {
+	start, end := strings.Index(sql, "("), strings.LastIndex(sql, ")")
+	if start < 0 || end < start {
+		return nil, errors.New("unexpected table definition")
+	}
+	var columns []string
+	for _, def := range strings.Split(sql[start+1:end], ",") {
+		fields := strings.Fields(def)
+		if len(fields) == 0 {
+			return nil, errors.New("unexpected table definition")
+		}
+		columns = append(columns, strings.Trim(fields[0], "\"`[]'"))
+	}
+	return columns, nil
+}
+
+// page returns page n, and the offset of its b-tree header, which is after
+// the database header on the first page.
+func (db *sqliteDB) page(n uint32) ([]byte, int, error) {
+	if n == 0 || int(n) > len(db.data)/db.pageSize {
+		return nil, 0, fmt.Errorf("invalid SQLite page number %d", n)
+	}
+	p := db.data[int(n-1)*db.pageSize : int(n)*db.pageSize]
+	if n == 1 {
+		return p, 100, nil
+	}
+	return p, 0, nil
+}
+
+// walkTable calls f with the rowid and the record of each row of the table
+// b-tree at page root, in rowid order. visited holds the pages already seen,
+// to detect loops in corrupted databases.
+func (db *sqliteDB) walkTable(root uint32, visited map[uint32]bool, f func(rowid int64, payload []byte) error) error {
+	if visited[root] {
+		return errors.New("SQLite b-tree loop")
+	}
+	visited[root] = true
+	p, hdr, err := db.page(root)
+	if err != nil {
+		return err
+	}
+	if len(p) < hdr+12 {
+		return errors.New("truncated SQLite page")
+	}
+	kind := p[hdr]
+	cells := int(binary.BigEndian.Uint16(p[hdr+3:]))
+	ptrs := hdr + 8
+	if kind == 0x05 {
+		ptrs = hdr + 12
+	}
+	if ptrs+2*cells > len(p) {
+		return errors.New("truncated SQLite page")
+	}
+	for i := 0; i < cells; i++ {
+		off := int(binary.BigEndian.Uint16(p[ptrs+2*i:]))
+		if off >= db.usableSize {
+			return errors.New("invalid SQLite cell offset")
+		}
+		switch kind {
+		case 0x05: // interior table page
+			if off+4 > len(p) {
+				return errors.New("truncated SQLite cell")
+			}
+			if err := db.walkTable(binary.BigEndian.Uint32(p[off:]), visited, f); err != nil {
+				return err
+			}
+		case 0x0d: // leaf table page
+			rowid, payload, err := db.payload(p, off)
+			if err != nil {
+				return err
+			}
+			if err := f(rowid, payload); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected SQLite page type %#x", kind)
+		}
+	}
+	if kind == 0x05 {
+		return db.walkTable(binary.BigEndian.Uint32(p[hdr+8:]), visited, f)
+	}
+	return nil
+}
+
+// payload returns the rowid and the payload of the leaf table cell at off,
+// following its overflow pages if needed.
+func (db *sqliteDB) payload(p []byte, off int) (int64, []byte, error) {
+	size, n := sqliteVarint(p[off:])
+	if n == 0 {
+		return 0, nil, errors.New("invalid SQLite cell")
+	}
+	off += n
+	rowid, n := sqliteVarint(p[off:])
+	if n == 0 {
+		return 0, nil, errors.New("invalid SQLite cell")
+	}
+	off += n
+	if size > uint64(len(db.data)) {
+		return 0, nil, errors.New("invalid SQLite payload size")
+	}
+
+	local := db.localPayload(size, false)
+	if off+int(local) > len(p) || (local < size && off+int(local)+4 > len(p)) {
+		return 0, nil, errors.New("truncated SQLite cell")
+	}
+	payload := append([]byte(nil), p[off:off+int(local)]...)
+	if local == size {
+		return int64(rowid), payload, nil
+	}
+
+	next := binary.BigEndian.Uint32(p[off+int(local):])
+	for uint64(len(payload)) < size {
+		if len(payload) > len(db.data) {
+			return 0, nil, errors.New("SQLite overflow pages loop")
+		}
+		op, _, err := db.page(next)
+		if err != nil {
+			return 0, nil, err
+		}
+		chunk := op[4:db.usableSize]
+		if remaining := size - uint64(len(payload)); uint64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		payload = append(payload, chunk...)
+		next = binary.BigEndian.Uint32(op)
+	}
+	return int64(rowid), payload, nil
+}
+
+// localPayload returns how much of a payload of the given size is stored in
+// the b-tree page, rather than in overflow pages, per the file format. Index
+// b-trees store less, so that each page holds at least four cells.
+func (db *sqliteDB) localPayload(size uint64, index bool) uint64 {
+	u := uint64(db.usableSize)
+	max := u - 35
+	if index {
+		max = (u-12)*64/255 - 23
+	}
+	if size <= max {
+		return size
+	}
+	min := (u-12)*32/255 - 23
+	local := min + (size-min)%(u-4)
+	if local > max {
+		local = min
+	}
+	return local
+}
+
+// parseSQLiteRecord decodes a record into nil, int64, float64, []byte and
+// string values.
+func parseSQLiteRecord(b []byte) ([]interface{}, error) {
+	hdrSize, n := sqliteVarint(b)
+	if n == 0 || hdrSize < uint64(n) || hdrSize > uint64(len(b)) {
+		return nil, errors.New("invalid SQLite record")
+	}
+	types, body := b[n:hdrSize], b[hdrSize:]
+	var values []interface{}
+	for len(types) > 0 {
+		t, n := sqliteVarint(types)
+		if n == 0 {
+			return nil, errors.New("invalid SQLite record")
+		}
+		types = types[n:]
+
+		var size uint64
+		switch {
+		case t >= 12:
+			size = (t - 12) / 2
+		case t >= 1 && t <= 4:
+			size = t
+		case t == 5:
+			size = 6
+		case t == 6 || t == 7:
+			size = 8
+		}
+		if size > uint64(len(body)) {
+			return nil, errors.New("truncated SQLite record")
+		}
+		v := body[:size]
+		body = body[size:]
+
+		switch {
+		case t == 0:
+			values = append(values, nil)
+		case t <= 6:
+			var x int64
+			for i, c := range v {
+				if i == 0 {
+					x = int64(int8(c))
+				} else {
+					x = x<<8 | int64(c)
+				}
+			}
+			values = append(values, x)
+		case t == 7:
+			values = append(values, math.Float64frombits(binary.BigEndian.Uint64(v)))
+		case t == 8:
+			values = append(values, int64(0))
+		case t == 9:
+			values = append(values, int64(1))
+		case t >= 12 && t%2 == 0:
+			values = append(values, append([]byte(nil), v...))
+		case t >= 13:
+			values = append(values, string(v))
+		default:
+			return nil, fmt.Errorf("invalid SQLite serial type %d", t)
+		}
+	}
+	return values, nil
+}
+
+// sqliteVarint decodes a SQLite big-endian varint, returning the number of
+// bytes read, or zero if b is too short.
+func sqliteVarint(b []byte) (uint64, int) {
+	var x uint64
+	for i := 0; i < 9; i++ {
+		if i >= len(b) {
+			return 0, 0
+		}
+		if i == 8 {
+			return x<<8 | uint64(b[i]), 9
+		}
+		x = x<<7 | uint64(b[i]&0x7f)
+		if b[i] < 0x80 {
+			return x, i + 1
+		}
+	}
+	return 0, 0
+}
@@ -0,0 +1,64 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+
+package main
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// The locks are POSIX advisory locks on byte ranges of the database, like
+// SQLite sets by default. They belong to the process, and closing any file
+// descriptor for the database releases all of them.
+
+func sqliteSetLock(f *os.File, typ int16, start, n int64) error {
+	lk := &syscall.Flock_t{Type: typ, Whence: io.SeekStart, Start: start, Len: n}
+	err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, lk)
+	if err == syscall.EAGAIN || err == syscall.EACCES {
+		return errSQLiteBusy
+	}
+	return err
+}
+
+// sqliteLockShared allows reading. It fails while a writer waits for the
+// readers to finish, or writes.
+func sqliteLockShared(f *os.File) error {
+	if err := sqliteSetLock(f, syscall.F_RDLCK, sqlitePendingByte, 1); err != nil {
+		return err
+	}
+	err := sqliteSetLock(f, syscall.F_RDLCK, sqliteSharedFirst, sqliteSharedSize)
+	sqliteSetLock(f, syscall.F_UNLCK, sqlitePendingByte, 1)
+	return err
+}
+
+// sqliteLockReserved announces the intention to write, and can only be held
+// by one process at a time.
+func sqliteLockReserved(f *os.File) error {
+	return sqliteSetLock(f, syscall.F_WRLCK, sqliteReservedByte, 1)
+}
+
+// sqliteLockExclusive allows writing, once the other readers are gone. It
+// can be retried, and it keeps new readers out in the meantime.
+func sqliteLockExclusive(f *os.File) error {
+	if err := sqliteSetLock(f, syscall.F_WRLCK, sqlitePendingByte, 1); err != nil {
+		return err
+	}
+	return sqliteSetLock(f, syscall.F_WRLCK, sqliteSharedFirst, sqliteSharedSize)
+}
+
+func sqliteUnlock(f *os.File) {
+	sqliteSetLock(f, syscall.F_UNLCK, sqlitePendingByte, 2+sqliteSharedSize)
+}
+
+// syncDir makes a file creation or removal in dir durable.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
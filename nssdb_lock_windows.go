@@ -0,0 +1,22 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// NSS databases are changed with certutil on Windows.
+
+var errSQLiteLockUnsupported = errors.New("locking SQLite databases is not supported on Windows")
+
+func sqliteLockShared(f *os.File) error   { return errSQLiteLockUnsupported }
+func sqliteLockReserved(f *os.File) error { return errSQLiteLockUnsupported }
+func sqliteLockExclusive(f *os.File) error {
+	return errSQLiteLockUnsupported
+}
+func sqliteUnlock(f *os.File) {}
+func syncDir(dir string)      {}
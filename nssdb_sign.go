@@ -0,0 +1,204 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// This file signs the trust settings of NSS databases like NSS does, with
+// HMAC-SHA256 keys derived with PBKDF2 from the password of key4.db, see
+// sftkdb_SignAttribute in lib/softoken/sftkpwd.c. Only an empty password is
+// tried, which is checked against the encrypted "password-check" value.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"hash"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// errNSSNeedsCertutil is returned by addNSSCert if the trust settings can't
+// be signed, because key4.db has a password, isn't initialized, or has a
+// format that is not supported.
+var errNSSNeedsCertutil = errors.New("the NSS key database has a password, or is not supported")
+
+var (
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBMAC1         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 14}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// An nssPBEItem is how NSS stores encrypted values, and signatures.
+type nssPBEItem struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Data      []byte
+}
+
+// nssPBEParams are the parameters of PBES2 and PBMAC1, from RFC 8018.
+type nssPBEParams struct {
+	KDF    pkix.AlgorithmIdentifier
+	Scheme pkix.AlgorithmIdentifier
+}
+
+type nssPBKDF2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                      `asn1:"optional"`
+	PRF        pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// nssPassKey returns the key that NSS derives from the password of the
+// key4.db database at path and from its global salt, if the password is
+// empty, or errNSSNeedsCertutil.
+func nssPassKey(path string) ([]byte, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, errNSSNeedsCertutil
+	}
+	rows, err := db.readTable("metaData")
+	if err != nil {
+		return nil, errNSSNeedsCertutil
+	}
+	for _, row := range rows {
+		if row.values["id"] != "password" {
+			continue
+		}
+		salt, _ := row.values["item1"].([]byte)
+		check, _ := row.values["item2"].([]byte)
+		passKey := sha1.Sum(salt) // followed by the empty password
+		plaintext, err := nssDecrypt(passKey[:], check)
+		if err != nil || string(plaintext) != "password-check" {
+			return nil, errNSSNeedsCertutil
+		}
+		return passKey[:], nil
+	}
+	return nil, errNSSNeedsCertutil
+}
+
+// nssDecrypt decrypts an nssPBEItem encrypted with PBES2 and AES-256-CBC,
+// which is what NSS uses since version 3.48.
+func nssDecrypt(passKey, data []byte) ([]byte, error) {
+	var item nssPBEItem
+	var params nssPBEParams
+	if _, err := asn1.Unmarshal(data, &item); err != nil || !item.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, errNSSNeedsCertutil
+	}
+	if _, err := asn1.Unmarshal(item.Algorithm.Parameters.FullBytes, &params); err != nil || !params.Scheme.Algorithm.Equal(oidAES256CBC) {
+		return nil, errNSSNeedsCertutil
+	}
+	// NSS encodes a 14 bytes IV, and uses its encoding as the IV.
+	iv := params.Scheme.Parameters.FullBytes
+	if len(params.Scheme.Parameters.Bytes) == aes.BlockSize {
+		iv = params.Scheme.Parameters.Bytes
+	}
+	if len(iv) != aes.BlockSize || len(item.Data) == 0 || len(item.Data)%aes.BlockSize != 0 {
+		return nil, errNSSNeedsCertutil
+	}
+	key, err := nssPBKDF2(passKey, params.KDF, 32)
+	if err != nil || len(key) != 32 {
+		return nil, errNSSNeedsCertutil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(item.Data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, item.Data)
+	pad := int(plaintext[len(plaintext)-1])
+	if pad == 0 || pad > aes.BlockSize {
+		return nil, errNSSNeedsCertutil
+	}
+	return plaintext[:len(plaintext)-pad], nil
+}
+
+// nssPBKDF2 derives a key from passKey with the PBKDF2 parameters of alg.
+func nssPBKDF2(passKey []byte, alg pkix.AlgorithmIdentifier, keyLength int) ([]byte, error) {
+	var params nssPBKDF2Params
+	if !alg.Algorithm.Equal(oidPBKDF2) {
+		return nil, errNSSNeedsCertutil
+	}
+	if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &params); err != nil {
+		return nil, errNSSNeedsCertutil
+	}
+	var h func() hash.Hash
+	switch {
+	case len(params.PRF.Algorithm) == 0, params.PRF.Algorithm.Equal(oidHMACWithSHA1):
+		h = sha1.New
+	case params.PRF.Algorithm.Equal(oidHMACWithSHA256):
+		h = sha256.New
+	default:
+		return nil, errNSSNeedsCertutil
+	}
+	if params.KeyLength != 0 {
+		keyLength = params.KeyLength
+	}
+	if params.Iterations < 1 || params.Iterations > 10000000 || keyLength > 64 {
+		return nil, errNSSNeedsCertutil
+	}
+	return pbkdf2.Key(passKey, params.Salt, params.Iterations, keyLength, h), nil
+}
+
+// nssSignature signs the value of the attribute typ of the object id, with a
+// passKey from nssPassKey, like NSS does for new signatures.
+func nssSignature(passKey []byte, id, typ uint32, value []byte) ([]byte, error) {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	kdf, err := asn1.Marshal(nssPBKDF2Params{
+		Salt: salt, Iterations: 1, KeyLength: 32,
+		PRF: pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256},
+	})
+	if err != nil {
+		return nil, err
+	}
+	params := nssPBEParams{
+		KDF:    pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdf}},
+		Scheme: pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256},
+	}
+	mac, err := nssMAC(passKey, params, id, typ, value)
+	if err != nil {
+		return nil, err
+	}
+	paramsDER, err := asn1.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(nssPBEItem{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidPBMAC1, Parameters: asn1.RawValue{FullBytes: paramsDER}},
+		Data:      mac,
+	})
+}
+
+// nssMAC computes the PBMAC1 MAC of the attribute typ of the object id. The
+// object ID and the attribute type are included, so that values can't be
+// copied to other objects.
+func nssMAC(passKey []byte, params nssPBEParams, id, typ uint32, value []byte) ([]byte, error) {
+	var h func() hash.Hash
+	switch {
+	case params.Scheme.Algorithm.Equal(oidHMACWithSHA1):
+		h = sha1.New
+	case params.Scheme.Algorithm.Equal(oidHMACWithSHA256):
+		h = sha256.New
+	default:
+		return nil, errNSSNeedsCertutil
+	}
+	key, err := nssPBKDF2(passKey, params.KDF, h().Size())
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(h, key)
+	mac.Write(appendUint32(appendUint32(nil, id), typ))
+	mac.Write(value)
+	return mac.Sum(nil), nil
+}
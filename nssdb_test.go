@@ -0,0 +1,565 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testdata/cert9.db was created with the Python sqlite3 module, using the
+// nssPublic schema and indexes of NSS and a 1024 bytes page size, so that
+// the certificates span overflow pages and the table has interior pages. It
+// holds 40 copies of a leaf, a trusted mkcert root, another mkcert root
+// without trust, and the leaf again with non-CA trust.
+//
+// testdata/key4.db has the metaData table of NSS, with the signatures of the
+// trust settings in cert9.db and of 12 other objects.
+//
+// testdata/nss was created with NSS 3.87 and an empty password, and holds an
+// mkcert root with the trust settings of "certutil -A -t C,,".
+// testdata/nss-password/key4.db was created the same way, with a password.
+
+func TestReadNSSDB(t *testing.T) {
+	certs, err := readNSSDB("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 43 {
+		t.Fatalf("got %d certificates, want 43", len(certs))
+	}
+	byName := make(map[string]*nssCert)
+	for _, c := range certs {
+		byName[c.Nickname] = c
+	}
+
+	root := byName["mkcert development CA trusted"]
+	if root == nil || !root.TrustedCA || !isMkcertRoot(root.Cert) {
+		t.Errorf("trusted root: got %+v", root)
+	}
+	other := byName["mkcert other@host"]
+	if other == nil || other.TrustedCA || !isMkcertRoot(other.Cert) {
+		t.Errorf("untrusted root: got %+v", other)
+	}
+	if other != nil && root != nil && other.Cert.Equal(root.Cert) {
+		t.Errorf("the two roots are the same certificate")
+	}
+	leaf := byName["a.test"]
+	if leaf == nil || leaf.TrustedCA || isMkcertRoot(leaf.Cert) {
+		t.Errorf("leaf: got %+v", leaf)
+	}
+	if c := byName["filler 39"]; c == nil || !c.Cert.Equal(leaf.Cert) {
+		t.Errorf("filler: got %+v", c)
+	}
+}
+
+func TestNSSRoots(t *testing.T) {
+	roots, err := nssRoots("sql:testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 2 {
+		t.Fatalf("got %d roots, want 2", len(roots))
+	}
+	for _, r := range roots {
+		if r.Name != "mkcert development CA trusted" && r.Name != "mkcert other@host" {
+			t.Errorf("unexpected root %q", r.Name)
+		}
+	}
+}
+
+func TestOpenSQLiteErrors(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string][]byte{
+		"empty.db":    nil,
+		"text.db":     []byte("this is not a database, but it is long enough to pass the length check of the header, right?"),
+		"wal.db":      validSQLiteHeader(),
+		"wal.db-wal":  []byte("pending"),
+		"badpage.db":  append([]byte("SQLite format 3\x00\x03\x00"), make([]byte, 98)...),
+		"truncate.db": validSQLiteHeader()[:200],
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"missing.db", "empty.db", "text.db", "wal.db", "badpage.db", "truncate.db"} {
+		if _, err := openSQLite(filepath.Join(dir, name)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// validSQLiteHeader returns an empty database with a 512 bytes page.
+func validSQLiteHeader() []byte {
+	b := make([]byte, 512)
+	copy(b, "SQLite format 3\x00")
+	b[16], b[17] = 0x02, 0x00 // page size
+	b[56+3] = 1               // UTF-8
+	return b
+}
+
+// copyTestdata copies files from testdata to dir.
+func copyTestdata(t *testing.T, dir string, files ...string) {
+	t.Helper()
+	for _, name := range files {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, filepath.Base(name)), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDeleteNSSCert(t *testing.T) {
+	dir := t.TempDir()
+	copyTestdata(t, dir, "cert9.db", "key4.db")
+	certs, err := readNSSDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]*nssCert)
+	for _, c := range certs {
+		byName[c.Nickname] = c
+	}
+	root, leaf := byName["mkcert development CA trusted"].Cert, byName["a.test"].Cert
+
+	// The 41 copies of the leaf span most pages of the table and indexes.
+	if found, err := deleteNSSCert(dir, leaf); err != nil || !found {
+		t.Fatalf("deleting the leaf: got %v, %v", found, err)
+	}
+	certs, err = readNSSDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 2 || !certs[0].TrustedCA || certs[1].TrustedCA {
+		t.Errorf("after deleting the leaf: got %d certificates", len(certs))
+	}
+	checkSQLitePages(t, filepath.Join(dir, "cert9.db"))
+
+	if found, err := deleteNSSCert(dir, root); err != nil || !found {
+		t.Fatalf("deleting the root: got %v, %v", found, err)
+	}
+	if found, err := deleteNSSCert(dir, root); err != nil || found {
+		t.Errorf("deleting the root again: got %v, %v", found, err)
+	}
+	certs, err = readNSSDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 || certs[0].Nickname != "mkcert other@host" {
+		t.Errorf("after deleting the root: got %d certificates", len(certs))
+	}
+	checkSQLitePages(t, filepath.Join(dir, "cert9.db"))
+	if _, err := os.Stat(filepath.Join(dir, "cert9.db-journal")); !os.IsNotExist(err) {
+		t.Errorf("the rollback journal was left behind: %v", err)
+	}
+
+	db, err := openSQLite(filepath.Join(dir, "key4.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.readTable("metaData")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1+12*5 || rows[0].values["id"] != "password" {
+		t.Errorf("got %d signatures in key4.db, want 61", len(rows))
+	}
+	for _, row := range rows {
+		id, _ := row.values["id"].(string)
+		if strings.HasPrefix(id, "sig_cert_00000129_") || strings.HasPrefix(id, "sig_cert_0000012c_") {
+			t.Errorf("signature %s was not removed", id)
+		}
+	}
+	checkSQLitePages(t, filepath.Join(dir, "key4.db"))
+}
+
+func TestNSSPassKey(t *testing.T) {
+	if _, err := nssPassKey("testdata/nss/key4.db"); err != nil {
+		t.Errorf("empty password: %v", err)
+	}
+	for _, path := range []string{"testdata/nss-password/key4.db", "testdata/nss/cert9.db", "testdata/missing.db"} {
+		if _, err := nssPassKey(path); err != errNSSNeedsCertutil {
+			t.Errorf("%s: got %v", path, err)
+		}
+	}
+}
+
+func TestAddNSSCert(t *testing.T) {
+	dir := t.TempDir()
+	copyTestdata(t, dir, "nss/cert9.db", "nss/key4.db")
+	// The signatures made by NSS are checked like the ones of addNSSCert.
+	checkNSSSignatures(t, dir)
+	ref := nssTestObjects(t, dir)
+	if len(ref) != 2 {
+		t.Fatalf("got %d objects in testdata/nss, want 2", len(ref))
+	}
+	refCert, err := x509.ParseCertificate(ref[0].attrs[ckaValue])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(nssKeyID(refCert), ref[0].attrs[ckaID]) {
+		t.Errorf("got key ID %x, NSS set %x", nssKeyID(refCert), ref[0].attrs[ckaID])
+	}
+
+	cert := newTestCA(t).Cert
+	if err := addNSSCert(dir, "mkcert test", cert); err != nil {
+		t.Fatal(err)
+	}
+	// Adding it again replaces it.
+	if err := addNSSCert(dir, "mkcert test", cert); err != nil {
+		t.Fatal(err)
+	}
+	certs, err := readNSSDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 2 || certs[1].Nickname != "mkcert test" || !certs[1].Cert.Equal(cert) || !certs[1].TrustedCA {
+		t.Fatalf("got %d certificates", len(certs))
+	}
+	checkNSSSignatures(t, dir)
+	checkSQLitePages(t, filepath.Join(dir, "cert9.db"))
+	checkSQLitePages(t, filepath.Join(dir, "key4.db"))
+
+	// The objects have the same attributes as the ones made by certutil,
+	// and the same trust settings.
+	objects := nssTestObjects(t, dir)
+	for i, o := range objects[2:] {
+		if got, want := nssAttrTypes(o), nssAttrTypes(ref[i]); !reflect.DeepEqual(got, want) {
+			t.Errorf("object %d: got attributes %x, want %x", i, got, want)
+		}
+	}
+	for _, typ := range nssSignedTrustAttributes[:5] {
+		if !bytes.Equal(objects[3].attrs[typ], ref[1].attrs[typ]) {
+			t.Errorf("trust attribute %x: got %x, want %x", typ, objects[3].attrs[typ], ref[1].attrs[typ])
+		}
+	}
+
+	if found, err := deleteNSSCert(dir, cert); err != nil || !found {
+		t.Fatalf("deleting the root: got %v, %v", found, err)
+	}
+	checkNSSSignatures(t, dir)
+}
+
+func TestAddNSSCertPassword(t *testing.T) {
+	dir := t.TempDir()
+	copyTestdata(t, dir, "nss/cert9.db", "nss-password/key4.db")
+	if err := addNSSCert(dir, "mkcert test", newTestCA(t).Cert); err != errNSSNeedsCertutil {
+		t.Errorf("got %v, want errNSSNeedsCertutil", err)
+	}
+	if certs, err := readNSSDB(dir); err != nil || len(certs) != 1 {
+		t.Errorf("got %d certificates, %v", len(certs), err)
+	}
+}
+
+// nssTestObjects returns the objects in the cert9.db database in dir.
+func nssTestObjects(t *testing.T, dir string) []*nssObject {
+	t.Helper()
+	db, err := openSQLite(filepath.Join(dir, "cert9.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects, err := nssObjects(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return objects
+}
+
+func nssAttrTypes(o *nssObject) []uint32 {
+	var types []uint32
+	for typ := range o.attrs {
+		types = append(types, typ)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+// checkNSSSignatures checks that the trust settings in the cert9.db database
+// in dir have valid signatures in key4.db, and that there are no others.
+func checkNSSSignatures(t *testing.T, dir string) {
+	t.Helper()
+	passKey, err := nssPassKey(filepath.Join(dir, "key4.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openSQLite(filepath.Join(dir, "key4.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.readTable("metaData")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigs := make(map[string][]byte)
+	for _, row := range rows {
+		if id, _ := row.values["id"].(string); strings.HasPrefix(id, "sig_") {
+			sigs[id], _ = row.values["item1"].([]byte)
+		}
+	}
+
+	var want int
+	for _, o := range nssTestObjects(t, dir) {
+		if nssULong(o.attrs[ckaClass]) != ckoNSSTrust {
+			continue
+		}
+		for _, typ := range nssSignedTrustAttributes {
+			want++
+			name := fmt.Sprintf("sig_cert_%08x_%08x", o.id, typ)
+			var item nssPBEItem
+			var params nssPBEParams
+			if _, err := asn1.Unmarshal(sigs[name], &item); err != nil || !item.Algorithm.Algorithm.Equal(oidPBMAC1) {
+				t.Errorf("%s: missing or invalid signature", name)
+				continue
+			}
+			if _, err := asn1.Unmarshal(item.Algorithm.Parameters.FullBytes, &params); err != nil {
+				t.Errorf("%s: %v", name, err)
+				continue
+			}
+			mac, err := nssMAC(passKey, params, uint32(o.id), typ, o.attrs[typ])
+			if err != nil || !hmac.Equal(mac, item.Data) {
+				t.Errorf("%s: wrong signature: %v", name, err)
+			}
+		}
+	}
+	if len(sigs) != want {
+		t.Errorf("got %d signatures, want %d", len(sigs), want)
+	}
+}
+
+// checkSQLitePages checks that each page of the database is used once, by
+// a b-tree or by the freelist.
+func checkSQLitePages(t *testing.T, path string) {
+	t.Helper()
+	db, err := openSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema, err := db.readSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages := make(map[uint32]bool)
+	if err := db.treePages(1, pages); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range schema {
+		if e.RootPage != 0 {
+			if err := db.treePages(e.RootPage, pages); err != nil {
+				t.Fatalf("%s: %v", e.Name, err)
+			}
+		}
+	}
+	if err := db.freelistPages(pages); err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != len(db.data)/db.pageSize {
+		t.Errorf("%s: %d of %d pages are used", path, len(pages), len(db.data)/db.pageSize)
+	}
+}
+
+// TestSQLiteUpdateRows checks databases rewritten by updateRows with the
+// sqlite3 command. The tables and indexes need interior pages at the smaller
+// page sizes, and some rows overflow.
+func TestSQLiteUpdateRows(t *testing.T) {
+	sqlite3, err := exec.LookPath("sqlite3")
+	if err != nil {
+		t.Skip("sqlite3 not found")
+	}
+	query := func(path, sql string) []string {
+		t.Helper()
+		out, err := exec.Command(sqlite3, path, sql).CombinedOutput()
+		if err != nil {
+			t.Fatalf("sqlite3: %v: %s", err, out)
+		}
+		return strings.Split(strings.TrimSpace(string(out)), "\n")
+	}
+	for _, pageSize := range []int{512, 1024, 4096, 65536} {
+		for _, n := range []int{1, 10, 500} {
+			path := filepath.Join(t.TempDir(), "test.db")
+			query(path, fmt.Sprintf(`PRAGMA page_size = %d;
+				CREATE TABLE t (id PRIMARY KEY UNIQUE ON CONFLICT ABORT, a0, a11);
+				CREATE INDEX i ON t (a0);
+				WITH RECURSIVE n(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM n WHERE x < %d)
+				INSERT INTO t SELECT x * 7919 %% 1000, randomblob(x %% 5 + 1), randomblob(x * 37 %% 3000 + 1) FROM n;`, pageSize, n))
+			before := query(path, "SELECT rowid, id, hex(a0), hex(a11) FROM t ORDER BY rowid")
+
+			// Delete every third row, or all of them, and add some.
+			deleted := make(map[int64]bool)
+			var want []string
+			var last int64
+			for _, line := range before {
+				rowid, _ := strconv.ParseInt(strings.SplitN(line, "|", 2)[0], 10, 64)
+				if rowid%3 == 0 || n == 10 {
+					deleted[rowid] = true
+				} else {
+					want = append(want, line)
+					last = rowid
+				}
+			}
+			var added []map[string]interface{}
+			for i := 0; i < n/3+1; i++ {
+				a0, a11 := []byte{byte(i)}, bytes.Repeat([]byte{byte(i)}, i*997%5000+1)
+				added = append(added, map[string]interface{}{"id": int64(1000 + i), "A0": a0, "a11": a11})
+				want = append(want, fmt.Sprintf("%d|%d|%X|%X", last+int64(i)+1, 1000+i, a0, a11))
+			}
+			tx, err := beginSQLiteTx(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tx.updateRows("t", deleted, added); err != nil {
+				t.Fatal(err)
+			}
+			if err := tx.commit(); err != nil {
+				t.Fatal(err)
+			}
+			tx.close()
+
+			name := fmt.Sprintf("page size %d, %d rows", pageSize, n)
+			if got := query(path, "PRAGMA integrity_check"); len(got) != 1 || got[0] != "ok" {
+				t.Errorf("%s: integrity check: %q", name, got)
+			}
+			got := query(path, "SELECT rowid, id, hex(a0), hex(a11) FROM t ORDER BY rowid")
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: got %d rows, want %d", name, len(got), len(want))
+			}
+			checkSQLitePages(t, path)
+		}
+	}
+}
+
+func TestSQLiteUpdateRowsErrors(t *testing.T) {
+	dir := t.TempDir()
+	copyTestdata(t, dir, "cert9.db")
+	tx, err := beginSQLiteTx(filepath.Join(dir, "cert9.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.close()
+	objects, err := nssObjects(tx.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, added := range [][]map[string]interface{}{
+		{{"id": objects[0].id}},
+		{{"id": int64(1)}, {"id": int64(1)}},
+		{{"id": int64(1), "missing": int64(1)}},
+	} {
+		if err := tx.updateRows("nssPublic", nil, added); err == nil {
+			t.Errorf("%v: expected an error", added)
+		}
+	}
+	// NULLs don't conflict in unique columns.
+	if err := tx.updateRows("nssPublic", nil, []map[string]interface{}{{"a0": []byte{1}}, {"a0": []byte{1}}}); err != nil {
+		t.Error(err)
+	}
+	if err := tx.updateRows("missing", nil, []map[string]interface{}{{"id": int64(1)}}); err == nil {
+		t.Error("added a row to a missing table")
+	}
+}
+
+func TestReadNSSDBCorrupted(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/cert9.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 100; i < len(data); i += 61 {
+		corrupted := append([]byte(nil), data...)
+		corrupted[i] ^= 0xff
+		db, err := parseSQLite(corrupted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nssObjects(db) // must not panic
+		db.treePages(2, make(map[uint32]bool))
+	}
+}
+
+func TestParseSQLiteRecordErrors(t *testing.T) {
+	for _, b := range [][]byte{
+		{},
+		{0x00},             // header size smaller than its varint
+		{0x05, 0x01},       // header past the end
+		{0x02, 0x06, 0x01}, // truncated value
+		{0x02, 0x0a},       // reserved serial type
+		{0x81},             // truncated varint
+	} {
+		if _, err := parseSQLiteRecord(b); err == nil {
+			t.Errorf("%x: expected an error", b)
+		}
+	}
+}
+
+func TestSQLiteRecord(t *testing.T) {
+	values := []interface{}{nil, int64(0), int64(1), int64(-1), int64(127), int64(-129),
+		int64(1 << 40), int64(-1 << 62), 0.5, "text", []byte{0}, []byte{0xa5, 0, 0x5a},
+		strings.Repeat("x", 200)}
+	for _, format4 := range []bool{false, true} {
+		got, err := parseSQLiteRecord(sqliteRecord(values, format4))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, values) {
+			t.Errorf("format4=%v: got %v", format4, got)
+		}
+	}
+	for _, x := range []uint64{0, 0x7f, 0x80, 0x3fff, 0x4000, 1<<56 - 1, 1 << 56, 1<<64 - 1} {
+		b := appendSQLiteVarint(nil, x)
+		if got, n := sqliteVarint(b); got != x || n != len(b) {
+			t.Errorf("%x: got %x, %d bytes of %d", x, got, n, len(b))
+		}
+	}
+}
+
+func TestSQLiteSchemaDefs(t *testing.T) {
+	columns, autoindexes, err := sqliteTableDef("CREATE TABLE nssPublic (id PRIMARY KEY UNIQUE ON CONFLICT ABORT, a0, a1, a81)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(columns, []string{"id", "a0", "a1", "a81"}) || !reflect.DeepEqual(autoindexes, []int{0}) {
+		t.Errorf("got columns %v, automatic indexes %v", columns, autoindexes)
+	}
+	if idx, err := sqliteIndexDef("CREATE INDEX issuer ON nssPublic (A81)", columns); err != nil || !reflect.DeepEqual(idx, []int{3}) {
+		t.Errorf("got index columns %v, %v", idx, err)
+	}
+
+	for _, sql := range []string{
+		"CREATE TABLE t (id INTEGER PRIMARY KEY, a)",
+		"CREATE TABLE t (id PRIMARY KEY, a) WITHOUT ROWID",
+		"CREATE TABLE t (a, b, UNIQUE (a, b))",
+		"CREATE TABLE t (a TEXT COLLATE NOCASE)",
+		"CREATE TABLE t (a DEFAULT 'x')",
+		"CREATE TABLE t (a REAL)",
+	} {
+		if _, _, err := sqliteTableDef(sql); err == nil {
+			t.Errorf("%s: expected an error", sql)
+		}
+	}
+	for _, sql := range []string{
+		"CREATE INDEX i ON nssPublic (a0 DESC)",
+		"CREATE INDEX i ON nssPublic (a0 COLLATE NOCASE)",
+		"CREATE INDEX i ON nssPublic (a0) WHERE a1 IS NOT NULL",
+		"CREATE INDEX i ON nssPublic (length(a0))",
+		"CREATE INDEX i ON nssPublic (missing)",
+	} {
+		if _, err := sqliteIndexDef(sql, columns); err == nil {
+			t.Errorf("%s: expected an error", sql)
+		}
+	}
+}
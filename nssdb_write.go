@@ -0,0 +1,1056 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// This file deletes and adds rows in SQLite databases, which is all mkcert
+// needs to add and remove certificates in NSS databases without certutil.
+//
+// Firefox might have the database open, so changes follow the SQLite locking
+// protocol, and are made atomic with a rollback journal like SQLite does, see
+// https://www.sqlite.org/lockingv3.html. Instead of changing cells in place,
+// the b-trees of the table and of its indexes are rebuilt from the new set of
+// rows, keeping their root pages, and their other pages are reused or added
+// to the freelist. Only the schemas that NSS uses are supported, as anything
+// more, like collations or partial indexes, would change the index contents.
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The byte ranges that SQLite locks, in the page starting at 1GiB, which
+// never holds data.
+const (
+	sqlitePendingByte  = 0x40000000
+	sqliteReservedByte = sqlitePendingByte + 1
+	sqliteSharedFirst  = sqlitePendingByte + 2
+	sqliteSharedSize   = 510
+)
+
+// sqliteBusyTimeout is how long to wait for other processes, like Firefox,
+// to release their locks on a database.
+const sqliteBusyTimeout = 5 * time.Second
+
+var errSQLiteBusy = errors.New("the database is locked by another process")
+
+// sqliteJournalMagic starts the header of rollback journals.
+var sqliteJournalMagic = []byte{0xd9, 0xd5, 0x05, 0xf9, 0x20, 0xa1, 0x63, 0xd7}
+
+// sqliteTx is a write transaction on a SQLite database. It holds a SHARED
+// lock from beginSQLiteTx until close, so db doesn't change under it.
+type sqliteTx struct {
+	f    *os.File
+	path string
+	db   *sqliteDB // the database as it was read
+	data []byte    // the database with the changes made so far
+}
+
+// beginSQLiteTx opens the database at path for writing, and reads it.
+func beginSQLiteTx(path string) (*sqliteTx, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	tx := &sqliteTx{f: f, path: path}
+	err = sqliteRetry(func() error {
+		if err := sqliteLockShared(f); err != nil {
+			return err
+		}
+		// A journal is either being written by a process that holds a
+		// RESERVED lock, or left behind by one that crashed, in which case
+		// SQLite rolls it back the next time it opens the database.
+		if sqliteHotJournal(path + "-journal") {
+			sqliteUnlock(f)
+			return fmt.Errorf("%w (it has a rollback journal)", errSQLiteBusy)
+		}
+		return nil
+	})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := tx.read(); err != nil {
+		tx.close()
+		return nil, err
+	}
+	return tx, nil
+}
+
+func (tx *sqliteTx) read() error {
+	// Closing any other file descriptor for the database would release our
+	// locks, so read it through f.
+	info, err := tx.f.Stat()
+	if err != nil {
+		return err
+	}
+	data := make([]byte, info.Size())
+	if n, err := tx.f.ReadAt(data, 0); n != len(data) {
+		return err
+	}
+	if wal, err := os.Stat(tx.path + "-wal"); err == nil && wal.Size() > 0 {
+		return errors.New("the database has changes in its write-ahead log")
+	}
+	db, err := parseSQLite(data)
+	if err != nil {
+		return err
+	}
+	switch {
+	case data[18] != 1 || data[19] != 1:
+		return errors.New("the database is in WAL mode")
+	case data[20] != 0:
+		return errors.New("the database reserves space in its pages")
+	case binary.BigEndian.Uint32(data[52:]) != 0:
+		return errors.New("the database uses auto-vacuum")
+	case len(data) >= sqlitePendingByte:
+		return errors.New("the database is too large")
+	}
+	// The page count in the header is only valid if it was written by the
+	// same version that last changed the database.
+	if binary.BigEndian.Uint32(data[24:]) == binary.BigEndian.Uint32(data[92:]) &&
+		int(binary.BigEndian.Uint32(data[28:])) != len(data)/db.pageSize {
+		return errors.New("the database size doesn't match its header")
+	}
+	tx.db = db
+	tx.data = append([]byte(nil), data...)
+	return nil
+}
+
+// close releases the locks, and discards any changes that were not
+// committed. It can be called more than once.
+func (tx *sqliteTx) close() {
+	if tx.f == nil {
+		return
+	}
+	sqliteUnlock(tx.f)
+	tx.f.Close()
+	tx.f = nil
+}
+
+// sqliteRetry calls f until it doesn't return errSQLiteBusy, or until
+// sqliteBusyTimeout passes.
+func sqliteRetry(f func() error) error {
+	deadline := time.Now().Add(sqliteBusyTimeout)
+	for {
+		err := f()
+		if !errors.Is(err, errSQLiteBusy) || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// sqliteHotJournal reports whether the rollback journal at path has a
+// header, which the persistent journal mode zeroes instead of deleting the
+// file.
+func sqliteHotJournal(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	hdr := make([]byte, 8)
+	if _, err := io.ReadFull(f, hdr); err != nil {
+		return false
+	}
+	return !bytes.Equal(hdr, make([]byte, 8))
+}
+
+// commit writes the changes to the database. The original pages are saved
+// in the rollback journal first, so that if mkcert is interrupted, SQLite
+// restores them the next time it opens the database.
+func (tx *sqliteTx) commit() error {
+	orig, data, pageSize := tx.db.data, tx.data, tx.db.pageSize
+	if bytes.Equal(orig, data) {
+		return nil
+	}
+	counter := binary.BigEndian.Uint32(data[24:]) + 1
+	binary.BigEndian.PutUint32(data[24:], counter)
+	binary.BigEndian.PutUint32(data[92:], counter)
+	binary.BigEndian.PutUint32(data[28:], uint32(len(data)/pageSize))
+
+	var changed, written []uint32
+	for off := 0; off < len(data); off += pageSize {
+		if off >= len(orig) || !bytes.Equal(orig[off:off+pageSize], data[off:off+pageSize]) {
+			written = append(written, uint32(off/pageSize)+1)
+			if off < len(orig) {
+				changed = append(changed, uint32(off/pageSize)+1)
+			}
+		}
+	}
+
+	if err := sqliteLockReserved(tx.f); err != nil {
+		return err
+	}
+	journal := tx.path + "-journal"
+	if err := tx.writeJournal(journal, changed); err != nil {
+		os.Remove(journal)
+		return fmt.Errorf("failed to write the rollback journal: %w", err)
+	}
+	// Wait for the readers to finish. New ones are kept out by the PENDING
+	// lock taken by sqliteLockExclusive.
+	if err := sqliteRetry(func() error { return sqliteLockExclusive(tx.f) }); err != nil {
+		os.Remove(journal)
+		return err
+	}
+
+	if err := tx.writePages(data, written); err != nil {
+		// Put the original pages back, or leave the journal for SQLite to
+		// do it if that fails too.
+		if tx.writePages(orig, changed) == nil && tx.f.Truncate(int64(len(orig))) == nil {
+			os.Remove(journal)
+		}
+		return err
+	}
+	// Deleting the journal is what commits the transaction.
+	if err := os.Remove(journal); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(tx.path))
+	return nil
+}
+
+// writePages writes the given pages of data to the database.
+func (tx *sqliteTx) writePages(data []byte, pages []uint32) error {
+	pageSize := tx.db.pageSize
+	for _, n := range pages {
+		off := int(n-1) * pageSize
+		if _, err := tx.f.WriteAt(data[off:off+pageSize], int64(off)); err != nil {
+			return err
+		}
+	}
+	return tx.f.Sync()
+}
+
+// writeJournal saves the original contents of pages in a rollback journal,
+// see https://www.sqlite.org/fileformat.html#the_rollback_journal.
+func (tx *sqliteTx) writeJournal(path string, pages []uint32) error {
+	orig, pageSize := tx.db.data, tx.db.pageSize
+	const sectorSize = 512
+	var nonce [4]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return err
+	}
+	buf := make([]byte, sectorSize)
+	copy(buf, sqliteJournalMagic)
+	binary.BigEndian.PutUint32(buf[8:], uint32(len(pages)))
+	copy(buf[12:], nonce[:])
+	binary.BigEndian.PutUint32(buf[16:], uint32(len(orig)/pageSize))
+	binary.BigEndian.PutUint32(buf[20:], sectorSize)
+	binary.BigEndian.PutUint32(buf[24:], uint32(pageSize))
+	for _, n := range pages {
+		page := orig[int(n-1)*pageSize : int(n)*pageSize]
+		checksum := binary.BigEndian.Uint32(nonce[:])
+		for i := pageSize - 200; i > 0; i -= 200 {
+			checksum += uint32(page[i])
+		}
+		buf = appendUint32(buf, n)
+		buf = append(buf, page...)
+		buf = appendUint32(buf, checksum)
+	}
+
+	info, err := tx.f.Stat()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// deleteRows removes the rows of the table with the given rowids.
+func (tx *sqliteTx) deleteRows(table string, rowids map[int64]bool) error {
+	return tx.updateRows(table, rowids, nil)
+}
+
+// updateRows removes the rows of the table with the given rowids, and adds
+// rows with the given values by column name. The other columns are NULL, and
+// the new rows get the rowids after the largest one, like SQLite does.
+func (tx *sqliteTx) updateRows(table string, rowids map[int64]bool, added []map[string]interface{}) error {
+	db, err := parseSQLite(tx.data)
+	if err != nil {
+		return err
+	}
+	schema, err := db.readSchema()
+	if err != nil {
+		return err
+	}
+	var t *sqliteSchemaEntry
+	for _, e := range schema {
+		if e.Type == "table" && e.Name == table {
+			t = e
+		}
+	}
+	if t == nil || t.RootPage == 0 {
+		return fmt.Errorf("table %s not found", table)
+	}
+	columns, autoindexes, err := sqliteTableDef(t.SQL)
+	if err != nil {
+		return err
+	}
+	var indexes []*sqliteIndex
+	for _, e := range schema {
+		if !strings.EqualFold(e.Table, table) {
+			continue
+		}
+		switch {
+		case e.Type == "trigger":
+			return fmt.Errorf("table %s has triggers", table)
+		case e.Type != "index":
+			continue
+		case e.RootPage == 0:
+			return fmt.Errorf("invalid index %s", e.Name)
+		}
+		idx := &sqliteIndex{root: e.RootPage, name: e.Name}
+		if e.SQL == "" {
+			n, err := strconv.Atoi(strings.TrimPrefix(e.Name, "sqlite_autoindex_"+t.Name+"_"))
+			if err != nil || n < 1 || n > len(autoindexes) {
+				return fmt.Errorf("unexpected automatic index %s", e.Name)
+			}
+			idx.columns, idx.unique = []int{autoindexes[n-1]}, true
+		} else if idx.columns, err = sqliteIndexDef(e.SQL, columns); err != nil {
+			return err
+		} else {
+			idx.unique = sqliteUniqueIndexRegexp.MatchString(e.SQL)
+		}
+		indexes = append(indexes, idx)
+	}
+
+	type row struct {
+		rowid   int64
+		payload []byte
+		values  []interface{}
+	}
+	var rows []row
+	var deleted int
+	var last int64
+	err = db.walkTable(t.RootPage, make(map[uint32]bool), func(rowid int64, payload []byte) error {
+		if rowids[rowid] {
+			deleted++
+			return nil
+		}
+		values, err := parseSQLiteRecord(payload)
+		if err != nil {
+			return err
+		}
+		rows = append(rows, row{rowid, payload, values})
+		last = rowid
+		return nil
+	})
+	if err != nil || deleted == 0 && len(added) == 0 {
+		return err
+	}
+
+	format4 := binary.BigEndian.Uint32(tx.data[44:]) >= 4
+	for _, a := range added {
+		values := make([]interface{}, len(columns))
+		for name, v := range a {
+			i := 0
+			for i < len(columns) && !strings.EqualFold(columns[i], name) {
+				i++
+			}
+			if i == len(columns) {
+				return fmt.Errorf("table %s has no column %s", table, name)
+			}
+			values[i] = v
+		}
+		if last == math.MaxInt64 {
+			return errors.New("no rowids left")
+		}
+		last++
+		rows = append(rows, row{last, sqliteRecord(values, format4), values})
+	}
+
+	// All the pages of the table and its indexes are reused, except for
+	// their roots, which are referenced by the schema.
+	pages := make(map[uint32]bool)
+	if err := db.treePages(t.RootPage, pages); err != nil {
+		return err
+	}
+	for _, idx := range indexes {
+		if err := db.treePages(idx.root, pages); err != nil {
+			return err
+		}
+	}
+	if err := db.freelistPages(pages); err != nil {
+		return err
+	}
+	delete(pages, t.RootPage)
+	for _, idx := range indexes {
+		delete(pages, idx.root)
+	}
+	// The changes are made in a copy, so tx.data is left as is on errors.
+	w := &sqliteWriter{db: db, data: append([]byte(nil), tx.data...)}
+	for n := range pages {
+		w.free = append(w.free, n)
+	}
+	sort.Slice(w.free, func(i, j int) bool { return w.free[i] < w.free[j] })
+
+	var cells [][]byte
+	var keys []int64
+	for _, r := range rows {
+		cell := appendSQLiteVarint(nil, uint64(len(r.payload)))
+		cell = appendSQLiteVarint(cell, uint64(r.rowid))
+		cells = append(cells, w.spill(cell, r.payload, false))
+		keys = append(keys, r.rowid)
+	}
+	if err := w.buildTable(t.RootPage, keys, cells); err != nil {
+		return err
+	}
+
+	for _, idx := range indexes {
+		entries := make([][]interface{}, 0, len(rows))
+		for _, r := range rows {
+			entry := make([]interface{}, 0, len(idx.columns)+1)
+			for _, c := range idx.columns {
+				// Columns added by ALTER TABLE are NULL in older rows.
+				var v interface{}
+				if c < len(r.values) {
+					v = r.values[c]
+				}
+				entry = append(entry, v)
+			}
+			entries = append(entries, append(entry, r.rowid))
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			for k := range entries[i] {
+				if c := sqliteCompare(entries[i][k], entries[j][k]); c != 0 {
+					return c < 0
+				}
+			}
+			return false
+		})
+		cells := make([][]byte, 0, len(entries))
+		for i, e := range entries {
+			// NULLs are distinct from each other in UNIQUE columns.
+			if idx.unique && i > 0 && sqliteUniqueConflict(entries[i-1], e) {
+				return fmt.Errorf("duplicate entry in unique index %s", idx.name)
+			}
+			record := sqliteRecord(e, format4)
+			cells = append(cells, w.spill(appendSQLiteVarint(nil, uint64(len(record))), record, true))
+		}
+		if err := w.buildIndex(idx.root, cells); err != nil {
+			return err
+		}
+	}
+
+	w.writeFreelist()
+	if len(w.data) >= sqlitePendingByte {
+		return errors.New("the database is too large")
+	}
+	tx.data = w.data
+	return nil
+}
+
+// A sqliteIndex is an index of a table, with the positions of its columns.
+type sqliteIndex struct {
+	name    string
+	root    uint32
+	columns []int
+	unique  bool
+}
+
+// sqliteUniqueConflict reports whether two index entries, which end with
+// their rowids, break a UNIQUE constraint.
+func sqliteUniqueConflict(a, b []interface{}) bool {
+	for k := 0; k < len(a)-1; k++ {
+		if a[k] == nil || sqliteCompare(a[k], b[k]) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// sqliteTableDef parses a CREATE TABLE statement, and returns its column
+// names, and the column of each automatic index, in order. It only supports
+// typeless or simply typed columns, which can be PRIMARY KEY, UNIQUE or NOT
+// NULL, like in the NSS schemas.
+func sqliteTableDef(sql string) (columns []string, autoindexes []int, err error) {
+	start, end := strings.Index(sql, "("), strings.LastIndex(sql, ")")
+	if start < 0 || end < start || strings.TrimSpace(sql[end+1:]) != "" {
+		return nil, nil, errors.New("unsupported table definition")
+	}
+	for _, def := range strings.Split(sql[start+1:end], ",") {
+		if strings.ContainsAny(def, "()'") {
+			return nil, nil, errors.New("unsupported table definition")
+		}
+		fields := strings.Fields(strings.ToUpper(def))
+		if len(fields) == 0 {
+			return nil, nil, errors.New("unsupported table definition")
+		}
+		switch fields[0] {
+		case "CONSTRAINT", "PRIMARY", "UNIQUE", "CHECK", "FOREIGN":
+			return nil, nil, errors.New("unsupported table constraint")
+		}
+		name := strings.Trim(strings.Fields(def)[0], "\"`[]")
+
+		var typ []string
+		tokens := fields[1:]
+		for len(tokens) > 0 && !sqliteConstraintKeywords[tokens[0]] {
+			typ = append(typ, tokens[0])
+			tokens = tokens[1:]
+		}
+		var unique bool
+		for len(tokens) > 0 {
+			switch {
+			case len(tokens) >= 2 && tokens[0] == "PRIMARY" && tokens[1] == "KEY":
+				unique, tokens = true, tokens[2:]
+			case tokens[0] == "UNIQUE":
+				unique, tokens = true, tokens[1:]
+			case len(tokens) >= 2 && tokens[0] == "NOT" && tokens[1] == "NULL":
+				tokens = tokens[2:]
+			case len(tokens) >= 3 && tokens[0] == "ON" && tokens[1] == "CONFLICT":
+				tokens = tokens[3:]
+			default:
+				return nil, nil, fmt.Errorf("unsupported column constraint %s", tokens[0])
+			}
+		}
+		// REAL columns store integral values as integers, and INTEGER
+		// PRIMARY KEY columns are an alias for the rowid.
+		t := strings.Join(typ, " ")
+		if !strings.Contains(t, "INT") && (strings.Contains(t, "REAL") || strings.Contains(t, "FLOA") || strings.Contains(t, "DOUB")) {
+			return nil, nil, errors.New("unsupported REAL column")
+		}
+		if t == "INTEGER" && unique {
+			return nil, nil, errors.New("unsupported INTEGER PRIMARY KEY column")
+		}
+
+		// PRIMARY KEY and UNIQUE on the same column share an index.
+		if unique && (len(autoindexes) == 0 || autoindexes[len(autoindexes)-1] != len(columns)) {
+			autoindexes = append(autoindexes, len(columns))
+		}
+		columns = append(columns, name)
+	}
+	return columns, autoindexes, nil
+}
+
+var sqliteConstraintKeywords = map[string]bool{
+	"CONSTRAINT": true, "PRIMARY": true, "UNIQUE": true, "NOT": true,
+	"NULL": true, "ON": true, "CHECK": true, "DEFAULT": true, "COLLATE": true,
+	"REFERENCES": true, "GENERATED": true, "AS": true,
+}
+
+var sqliteUniqueIndexRegexp = regexp.MustCompile(`(?is)^\s*CREATE\s+UNIQUE\s`)
+
+var sqliteIndexRegexp = regexp.MustCompile(`(?is)^\s*CREATE\s+(?:UNIQUE\s+)?INDEX\s+(?:IF\s+NOT\s+EXISTS\s+)?\S+\s+ON\s+[^(\s]+\s*\(([^()]*)\)\s*$`)
+
+// sqliteIndexDef parses a CREATE INDEX statement, and returns the positions
+// of its columns in the table. It only supports plain column names.
+func sqliteIndexDef(sql string, columns []string) ([]int, error) {
+	match := sqliteIndexRegexp.FindStringSubmatch(sql)
+	if match == nil {
+		return nil, errors.New("unsupported index definition")
+	}
+	var positions []int
+	for _, name := range strings.Split(match[1], ",") {
+		name = strings.Trim(strings.TrimSpace(name), "\"`[]")
+		i := 0
+		for i < len(columns) && !strings.EqualFold(columns[i], name) {
+			i++
+		}
+		if i == len(columns) {
+			return nil, fmt.Errorf("unsupported index column %q", name)
+		}
+		positions = append(positions, i)
+	}
+	return positions, nil
+}
+
+// treePages adds to pages the pages of the b-tree at root, including the
+// overflow pages. It fails if any of them is already in pages.
+func (db *sqliteDB) treePages(root uint32, pages map[uint32]bool) error {
+	if pages[root] {
+		return errors.New("SQLite page used twice")
+	}
+	pages[root] = true
+	p, hdr, err := db.page(root)
+	if err != nil {
+		return err
+	}
+	if len(p) < hdr+12 {
+		return errors.New("truncated SQLite page")
+	}
+	kind := p[hdr]
+	ptrs := hdr + 8
+	switch kind {
+	case 0x02, 0x05:
+		ptrs = hdr + 12
+	case 0x0a, 0x0d:
+	default:
+		return fmt.Errorf("invalid SQLite page type %d", kind)
+	}
+	cells := int(binary.BigEndian.Uint16(p[hdr+3:]))
+	if ptrs+2*cells > len(p) {
+		return errors.New("truncated SQLite page")
+	}
+	for i := 0; i < cells; i++ {
+		off := int(binary.BigEndian.Uint16(p[ptrs+2*i:]))
+		if off+4 > len(p) {
+			return errors.New("invalid SQLite cell offset")
+		}
+		if kind == 0x02 || kind == 0x05 {
+			if err := db.treePages(binary.BigEndian.Uint32(p[off:]), pages); err != nil {
+				return err
+			}
+			if kind == 0x05 {
+				continue
+			}
+			off += 4
+		}
+		size, n := sqliteVarint(p[off:])
+		if n == 0 {
+			return errors.New("invalid SQLite cell")
+		}
+		off += n
+		if kind == 0x0d {
+			if _, n = sqliteVarint(p[off:]); n == 0 {
+				return errors.New("invalid SQLite cell")
+			}
+			off += n
+		}
+		if size > uint64(len(db.data)) {
+			return errors.New("invalid SQLite payload size")
+		}
+		local := db.localPayload(size, kind != 0x0d)
+		if local == size {
+			continue
+		}
+		if off+int(local)+4 > len(p) {
+			return errors.New("truncated SQLite cell")
+		}
+		next := binary.BigEndian.Uint32(p[off+int(local):])
+		for left := size - local; left > 0; {
+			if pages[next] {
+				return errors.New("SQLite page used twice")
+			}
+			pages[next] = true
+			op, _, err := db.page(next)
+			if err != nil {
+				return err
+			}
+			if chunk := uint64(db.usableSize - 4); left > chunk {
+				left -= chunk
+			} else {
+				left = 0
+			}
+			next = binary.BigEndian.Uint32(op)
+		}
+	}
+	if kind == 0x02 || kind == 0x05 {
+		return db.treePages(binary.BigEndian.Uint32(p[hdr+8:]), pages)
+	}
+	return nil
+}
+
+// freelistPages adds to pages the pages of the freelist, failing if any of
+// them is already in pages.
+func (db *sqliteDB) freelistPages(pages map[uint32]bool) error {
+	add := func(n uint32) error {
+		if _, _, err := db.page(n); err != nil {
+			return err
+		}
+		if pages[n] {
+			return errors.New("SQLite page used twice")
+		}
+		pages[n] = true
+		return nil
+	}
+	var count uint32
+	for trunk := binary.BigEndian.Uint32(db.data[32:]); trunk != 0; {
+		if err := add(trunk); err != nil {
+			return err
+		}
+		p, _, _ := db.page(trunk)
+		leaves := binary.BigEndian.Uint32(p[4:])
+		if leaves > uint32(db.usableSize/4-2) {
+			return errors.New("invalid SQLite freelist page")
+		}
+		for i := 0; i < int(leaves); i++ {
+			if err := add(binary.BigEndian.Uint32(p[8+4*i:])); err != nil {
+				return err
+			}
+		}
+		count += 1 + leaves
+		trunk = binary.BigEndian.Uint32(p)
+	}
+	if count != binary.BigEndian.Uint32(db.data[36:]) {
+		return errors.New("invalid SQLite freelist count")
+	}
+	return nil
+}
+
+// sqliteWriter builds b-trees in data, taking pages from free first.
+type sqliteWriter struct {
+	db   *sqliteDB // for the page sizes
+	data []byte
+	free []uint32
+}
+
+func (w *sqliteWriter) alloc() uint32 {
+	if len(w.free) > 0 {
+		n := w.free[0]
+		w.free = w.free[1:]
+		return n
+	}
+	w.data = append(w.data, make([]byte, w.db.pageSize)...)
+	return uint32(len(w.data) / w.db.pageSize)
+}
+
+// page returns page n, cleared.
+func (w *sqliteWriter) page(n uint32) []byte {
+	p := w.data[int(n-1)*w.db.pageSize : int(n)*w.db.pageSize]
+	for i := range p {
+		p[i] = 0
+	}
+	return p
+}
+
+// spill appends to cell as much of payload as is stored in the page, and
+// writes the rest to overflow pages.
+func (w *sqliteWriter) spill(cell, payload []byte, index bool) []byte {
+	local := int(w.db.localPayload(uint64(len(payload)), index))
+	cell = append(cell, payload[:local]...)
+	if local == len(payload) {
+		return cell
+	}
+	rest, chunk := payload[local:], w.db.usableSize-4
+	first := w.alloc()
+	for n := first; len(rest) > 0; {
+		var next uint32
+		if len(rest) > chunk {
+			next = w.alloc()
+		}
+		p := w.page(n)
+		binary.BigEndian.PutUint32(p, next)
+		rest = rest[copy(p[4:w.db.usableSize], rest):]
+		n = next
+	}
+	return appendUint32(cell, first)
+}
+
+// writePage writes a b-tree page of the given kind. Interior pages have a
+// right-most child.
+func (w *sqliteWriter) writePage(n uint32, kind byte, cells [][]byte, right uint32) {
+	p := w.page(n)
+	p[0] = kind
+	ptrs := 8
+	if kind == 0x02 || kind == 0x05 {
+		binary.BigEndian.PutUint32(p[8:], right)
+		ptrs = 12
+	}
+	binary.BigEndian.PutUint16(p[3:], uint16(len(cells)))
+	content := w.db.usableSize
+	for i, c := range cells {
+		content -= len(c)
+		copy(p[content:], c)
+		binary.BigEndian.PutUint16(p[ptrs+2*i:], uint16(content))
+	}
+	binary.BigEndian.PutUint16(p[5:], uint16(content)) // 65536 is stored as 0
+}
+
+// A sqliteChild is a page of a b-tree level, with the key that separates
+// it from the next one: a rowid for tables, or the cell of an entry for
+// indexes.
+type sqliteChild struct {
+	page uint32
+	key  []byte
+}
+
+// buildTable writes the table b-tree at root, from its leaf cells and
+// their rowids, in order.
+func (w *sqliteWriter) buildTable(root uint32, rowids []int64, cells [][]byte) error {
+	runs, err := sqliteSplitCells(cells, w.db.usableSize-8, false)
+	if err != nil {
+		return err
+	}
+	if len(runs) == 1 {
+		w.writePage(root, 0x0d, cells, 0)
+		return nil
+	}
+	var children []sqliteChild
+	for _, r := range runs {
+		n := w.alloc()
+		w.writePage(n, 0x0d, cells[r[0]:r[1]], 0)
+		children = append(children, sqliteChild{n, appendSQLiteVarint(nil, uint64(rowids[r[1]-1]))})
+	}
+	return w.buildInterior(root, 0x05, children)
+}
+
+// buildIndex writes the index b-tree at root, from the cells of its
+// entries, in order. Unlike in tables, the entries that separate the leaves
+// are moved up to the interior pages.
+func (w *sqliteWriter) buildIndex(root uint32, cells [][]byte) error {
+	runs, err := sqliteSplitCells(cells, w.db.usableSize-8, true)
+	if err != nil {
+		return err
+	}
+	if len(runs) == 1 {
+		w.writePage(root, 0x0a, cells, 0)
+		return nil
+	}
+	var children []sqliteChild
+	for _, r := range runs {
+		n := w.alloc()
+		w.writePage(n, 0x0a, cells[r[0]:r[1]], 0)
+		var key []byte
+		if r[1] < len(cells) {
+			key = cells[r[1]]
+		}
+		children = append(children, sqliteChild{n, key})
+	}
+	return w.buildInterior(root, 0x02, children)
+}
+
+// buildInterior writes the interior levels above children. The key of the
+// last child is unused, as it's the right-most one.
+func (w *sqliteWriter) buildInterior(root uint32, kind byte, children []sqliteChild) error {
+	cells := make([][]byte, len(children)-1)
+	for i, c := range children[:len(children)-1] {
+		cells[i] = append(appendUint32(nil, c.page), c.key...)
+	}
+	// Each page holds the cells of a run of children, and the child after
+	// them is its right-most one, whose key moves up to the next level.
+	runs, err := sqliteSplitCells(cells, w.db.usableSize-12, true)
+	if err != nil {
+		return err
+	}
+	if len(runs) == 1 {
+		w.writePage(root, kind, cells, children[len(children)-1].page)
+		return nil
+	}
+	var parents []sqliteChild
+	for _, r := range runs {
+		n := w.alloc()
+		w.writePage(n, kind, cells[r[0]:r[1]], children[r[1]].page)
+		parents = append(parents, sqliteChild{n, children[r[1]].key})
+	}
+	return w.buildInterior(root, kind, parents)
+}
+
+// sqliteSplitCells splits cells into runs that fit in pages of the given
+// capacity, returned as [start, end) ranges. If skip is true, the cell after
+// each run is left out of the runs, to separate them at the level above.
+func sqliteSplitCells(cells [][]byte, capacity int, skip bool) ([][2]int, error) {
+	var runs [][2]int
+	for start := 0; ; {
+		end, used := start, 0
+		for end < len(cells) && used+len(cells[end])+2 <= capacity {
+			used += len(cells[end]) + 2
+			end++
+		}
+		if end == len(cells) {
+			return append(runs, [2]int{start, end}), nil
+		}
+		if !skip {
+			if end == start {
+				return nil, errors.New("SQLite cell too large")
+			}
+			runs = append(runs, [2]int{start, end})
+			start = end
+			continue
+		}
+		// Leave at least one cell for the last run.
+		if end+1 == len(cells) {
+			end--
+		}
+		if end <= start {
+			return nil, errors.New("SQLite cell too large")
+		}
+		runs = append(runs, [2]int{start, end})
+		start = end + 1
+	}
+}
+
+// writeFreelist adds the unused free pages to the freelist, replacing it.
+func (w *sqliteWriter) writeFreelist() {
+	// Older versions of SQLite only accept this many leaves per trunk.
+	perTrunk := w.db.usableSize/4 - 8
+	binary.BigEndian.PutUint32(w.data[32:], 0)
+	binary.BigEndian.PutUint32(w.data[36:], uint32(len(w.free)))
+	var prev []byte
+	for free := w.free; len(free) > 0; {
+		trunk := w.page(free[0])
+		if prev == nil {
+			binary.BigEndian.PutUint32(w.data[32:], free[0])
+		} else {
+			binary.BigEndian.PutUint32(prev, free[0])
+		}
+		leaves := free[1:]
+		if len(leaves) > perTrunk {
+			leaves = leaves[:perTrunk]
+		}
+		binary.BigEndian.PutUint32(trunk[4:], uint32(len(leaves)))
+		for i, n := range leaves {
+			binary.BigEndian.PutUint32(trunk[8+4*i:], n)
+			w.page(n) // don't leave the deleted rows around
+		}
+		prev = trunk
+		free = free[1+len(leaves):]
+	}
+	w.free = nil
+}
+
+// sqliteRecord encodes values, of the types returned by parseSQLiteRecord,
+// as a record. The serial types for 0 and 1 need schema format 4.
+func sqliteRecord(values []interface{}, format4 bool) []byte {
+	var types, body []byte
+	for _, v := range values {
+		switch v := v.(type) {
+		case nil:
+			types = appendSQLiteVarint(types, 0)
+		case int64:
+			switch {
+			case format4 && v == 0:
+				types = appendSQLiteVarint(types, 8)
+			case format4 && v == 1:
+				types = appendSQLiteVarint(types, 9)
+			default:
+				var typ uint64
+				size := 8
+				for i, bits := range []int{8, 16, 24, 32, 48} {
+					if v >= -1<<(bits-1) && v < 1<<(bits-1) {
+						typ, size = uint64(i+1), bits/8
+						break
+					}
+				}
+				if typ == 0 {
+					typ = 6
+				}
+				types = appendSQLiteVarint(types, typ)
+				var b [8]byte
+				binary.BigEndian.PutUint64(b[:], uint64(v))
+				body = append(body, b[8-size:]...)
+			}
+		case float64:
+			types = appendSQLiteVarint(types, 7)
+			var b [8]byte
+			binary.BigEndian.PutUint64(b[:], math.Float64bits(v))
+			body = append(body, b[:]...)
+		case []byte:
+			types = appendSQLiteVarint(types, uint64(len(v))*2+12)
+			body = append(body, v...)
+		case string:
+			types = appendSQLiteVarint(types, uint64(len(v))*2+13)
+			body = append(body, v...)
+		}
+	}
+	// The header size includes its own varint.
+	size := uint64(len(types)) + 1
+	for uint64(len(appendSQLiteVarint(nil, size)))+uint64(len(types)) != size {
+		size++
+	}
+	record := appendSQLiteVarint(nil, size)
+	record = append(record, types...)
+	return append(record, body...)
+}
+
+// sqliteCompare compares two values like SQLite does with the BINARY
+// collation: NULLs first, then numbers, text and blobs.
+func sqliteCompare(a, b interface{}) int {
+	class := func(v interface{}) int {
+		switch v.(type) {
+		case nil:
+			return 0
+		case int64, float64:
+			return 1
+		case string:
+			return 2
+		default:
+			return 3
+		}
+	}
+	if ca, cb := class(a), class(b); ca != cb {
+		return ca - cb
+	}
+	switch a := a.(type) {
+	case int64:
+		if b, ok := b.(int64); ok {
+			switch {
+			case a < b:
+				return -1
+			case a > b:
+				return 1
+			}
+			return 0
+		}
+		return compareFloat(float64(a), b.(float64))
+	case float64:
+		if b, ok := b.(int64); ok {
+			return compareFloat(a, float64(b))
+		}
+		return compareFloat(a, b.(float64))
+	case string:
+		return strings.Compare(a, b.(string))
+	case []byte:
+		return bytes.Compare(a, b.([]byte))
+	}
+	return 0
+}
+
+func compareFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// appendSQLiteVarint appends x as a SQLite varint, the inverse of
+// sqliteVarint.
+func appendSQLiteVarint(b []byte, x uint64) []byte {
+	if x >= 1<<56 {
+		var buf [9]byte
+		buf[8] = byte(x)
+		x >>= 8
+		for i := 7; i >= 0; i-- {
+			buf[i] = byte(x&0x7f) | 0x80
+			x >>= 7
+		}
+		return append(b, buf[:]...)
+	}
+	var buf [8]byte
+	n := len(buf)
+	for {
+		n--
+		buf[n] = byte(x&0x7f) | 0x80
+		x >>= 7
+		if x == 0 {
+			break
+		}
+	}
+	buf[len(buf)-1] &= 0x7f
+	return append(b, buf[n:]...)
+}
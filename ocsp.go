@@ -0,0 +1,86 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"filippo.io/mkcert/ca"
+	"golang.org/x/crypto/ocsp"
+)
+
+// serveOCSP runs an OCSP (RFC 6960) responder over HTTP on m.ocspAddr,
+// answering with the issuance and revocation state recorded in CAROOT.
+func (m *mkcert) serveOCSP() {
+	m.checkSigner()
+
+	srv := &http.Server{
+		Addr:              m.ocspAddr,
+		Handler:           http.HandlerFunc(m.handleOCSP),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	log.Printf("The OCSP responder is listening on %q 🔐\n", m.ocspAddr)
+	log.Printf("Use \"-ocsp-url http://HOST:PORT\" to include it in new certificates ℹ️\n\n")
+	fatalIfErr(srv.ListenAndServe(), "failed to run the OCSP responder")
+}
+
+// handleOCSP answers an OCSP request sent with POST, or with GET as the
+// base64 encoded path, as described in RFC 6960, Appendix A.1.
+func (m *mkcert) handleOCSP(w http.ResponseWriter, r *http.Request) {
+	var der []byte
+	switch r.Method {
+	case http.MethodPost:
+		if ct := r.Header.Get("Content-Type"); ct != "application/ocsp-request" {
+			http.Error(w, "unexpected Content-Type", http.StatusUnsupportedMediaType)
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<14))
+		if err != nil {
+			http.Error(w, "failed to read request", http.StatusBadRequest)
+			return
+		}
+		der = body
+	case http.MethodGet:
+		path, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/"))
+		if err != nil {
+			http.Error(w, "invalid request path", http.StatusBadRequest)
+			return
+		}
+		der, _ = base64.StdEncoding.DecodeString(path)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := ocsp.MalformedRequestErrorResponse
+	if req, err := ocsp.ParseRequest(der); err == nil {
+		resp, err = m.ca.OCSPResponse(req)
+		if err != nil {
+			log.Printf("Warning: failed to answer an OCSP request: %s ⚠️", err)
+			resp = ocsp.InternalErrorErrorResponse
+		} else {
+			log.Printf("Answered an OCSP request for serial %s 📜", ca.FormatSerial(req.SerialNumber))
+		}
+	}
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(resp)
+}
+
+// ocspServers returns the OCSP responder URLs for new certificates, if
+// -ocsp-url was set.
+func (m *mkcert) ocspServers() []string {
+	if m.ocspURL == "" {
+		return nil
+	}
+	return []string{m.ocspURL}
+}
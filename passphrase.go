@@ -0,0 +1,68 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"golang.org/x/term"
+)
+
+// readPassphrase returns the CA key passphrase from $MKCERT_CA_PASSPHRASE,
+// from the file descriptor in $MKCERT_CA_PASSPHRASE_FD, or by prompting on the
+// terminal, in that order. If confirm is true, the terminal prompt is repeated
+// to catch typos.
+func readPassphrase(confirm bool) ([]byte, error) {
+	if env := os.Getenv("MKCERT_CA_PASSPHRASE"); env != "" {
+		return []byte(env), nil
+	}
+
+	if env := os.Getenv("MKCERT_CA_PASSPHRASE_FD"); env != "" {
+		fd, err := strconv.Atoi(env)
+		if err != nil {
+			return nil, fmt.Errorf("invalid $MKCERT_CA_PASSPHRASE_FD: %w", err)
+		}
+		f := os.NewFile(uintptr(fd), "passphrase")
+		if f == nil {
+			return nil, fmt.Errorf("invalid $MKCERT_CA_PASSPHRASE_FD: %d", fd)
+		}
+		defer f.Close()
+		line, err := bufio.NewReader(f).ReadBytes('\n')
+		if err != nil && len(line) == 0 {
+			return nil, fmt.Errorf("failed to read from $MKCERT_CA_PASSPHRASE_FD: %w", err)
+		}
+		return bytes.TrimRight(line, "\r\n"), nil
+	}
+
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, errors.New("set $MKCERT_CA_PASSPHRASE or $MKCERT_CA_PASSPHRASE_FD, or run mkcert in a terminal")
+	}
+	fmt.Fprint(os.Stderr, "Enter the CA key passphrase: ")
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	if confirm {
+		fmt.Fprint(os.Stderr, "Confirm the CA key passphrase: ")
+		again, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(passphrase, again) {
+			return nil, errors.New("the passphrases don't match")
+		}
+	}
+	return passphrase, nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+)
+
+// prune removes the mkcert roots from other CAROOTs, as listed by -status,
+// from the trust stores.
+func (m *mkcert) prune() {
+	var pruned int
+	for _, s := range enabledTrustStores() {
+		err := s.Available()
+		var missingTool *missingToolError
+		switch {
+		case err == errNoStore || err == errUnsupported:
+			continue
+		case err != nil && !errors.As(err, &missingTool):
+			log.Printf("Warning: can't remove roots from %s: %s ⚠️", s.Description(), err)
+			continue
+		}
+
+		// Locations that need the missing tool report it in loc.Err.
+		for _, loc := range s.List(m) {
+			where := strings.TrimSpace(s.Name() + " " + loc.Path)
+			if errors.As(loc.Err, &missingTool) {
+				log.Printf(`Warning: %s, so roots can't be removed from %s! ⚠️`, loc.Err, where)
+				if missingTool.Help != "" {
+					log.Printf(`Install %q with "%s" and re-run "mkcert -prune" 👈`, missingTool.Tool, missingTool.Help)
+				}
+				continue
+			}
+			if loc.Err != nil {
+				log.Printf("Warning: failed to list the roots in %s: %s ⚠️", where, loc.Err)
+				continue
+			}
+			stale := m.staleRoots(loc.Roots)
+			if len(stale) == 0 {
+				continue
+			}
+			removed, err := s.Remove(m, loc, stale)
+			for _, r := range removed {
+				log.Printf("Removed %q (created by %s, serial %s) from %s",
+					r.Name, strings.Join(r.Cert.Subject.OrganizationalUnit, ", "), r.Cert.SerialNumber, where)
+			}
+			pruned += len(removed)
+			if err != nil {
+				log.Printf("Warning: failed to remove roots from %s: %s ⚠️", where, err)
+			}
+		}
+	}
+
+	switch pruned {
+	case 0:
+		log.Println("No roots from other CAROOTs found in the trust stores 👍")
+	case 1:
+		log.Println("Removed 1 root from another CAROOT from the trust stores! 🧹")
+	default:
+		log.Printf("Removed %d roots from other CAROOTs from the trust stores! 🧹", pruned)
+	}
+}
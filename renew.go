@@ -0,0 +1,140 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"filippo.io/mkcert/ca"
+)
+
+// renew re-issues the certificate at certPath, and exits if that fails.
+func (m *mkcert) renew(certPath string) {
+	if err := m.renewCert(certPath); err != nil {
+		log.Fatalln("ERROR:", err)
+	}
+}
+
+// renewCert re-issues the certificate at certPath for the same names and
+// EKUs, with a new serial number and validity period. The key is read from,
+// or saved to, the file next to it that makeCert would use.
+func (m *mkcert) renewCert(certPath string) error {
+	cert, err := readLeaf(certPath)
+	if err != nil {
+		return fmt.Errorf("failed to read the certificate: %w", err)
+	}
+	if !m.issuedByCA(cert) {
+		return fmt.Errorf("%q was not issued by the local CA", certPath)
+	}
+
+	certFile, keyFile := certPath, renewKeyFile(certPath)
+	if m.certFile != "" {
+		certFile = m.certFile
+	}
+	if m.keyFile != "" {
+		keyFile = m.keyFile
+	}
+
+	opts := &ca.LeafOptions{
+		Hosts:       ca.CertificateNames(cert),
+		CommonName:  cert.Subject.CommonName,
+		ExtKeyUsage: cert.ExtKeyUsage,
+		KeyType:     m.keyType,
+	}
+	if opts.KeyType == "" && isKeyType(ca.KeyTypeOf(cert.PublicKey)) {
+		opts.KeyType = ca.KeyTypeOf(cert.PublicKey)
+	}
+	if len(opts.Hosts) == 0 {
+		return fmt.Errorf("%q has no names to renew it for", certPath)
+	}
+
+	var key crypto.PrivateKey
+	if m.reuseKey {
+		signer, err := readPrivateKey(keyFile)
+		if err != nil {
+			return fmt.Errorf("failed to read the certificate key: %w", err)
+		}
+		pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+		if !ok || !pub.Equal(cert.PublicKey) {
+			return fmt.Errorf("the key at %q does not match the certificate", keyFile)
+		}
+		opts.PublicKey = cert.PublicKey
+		key = signer
+	}
+
+	return m.issueCert(opts, key, ca.SourceRenewed, certFile, keyFile, "")
+}
+
+// renewAll renews every certificate issued by the CA in a PEM file under
+// dir that expires within m.within, or 30 days if not set. If some fail, it
+// renews the others, and then exits with an error.
+func (m *mkcert) renewAll(dir string) {
+	within := m.within
+	if within < 0 {
+		within = 30 * 24 * time.Hour
+	}
+
+	var paths []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, ".pem") || strings.HasSuffix(path, "-key.pem") {
+			return nil
+		}
+		cert, err := readLeaf(path)
+		if err != nil || cert.IsCA || !m.issuedByCA(cert) {
+			return nil
+		}
+		if cert.NotAfter.After(time.Now().Add(within)) {
+			return nil
+		}
+		if m.reuseKey {
+			if _, err := os.Stat(renewKeyFile(path)); err != nil {
+				log.Printf("Warning: skipping %q because its key is missing ⚠️", path)
+				return nil
+			}
+		}
+		paths = append(paths, path)
+		return nil
+	})
+	fatalIfErr(err, "failed to walk the directory")
+
+	if len(paths) == 0 {
+		log.Println("No certificates need to be renewed.")
+		return
+	}
+	// Ask for the passphrase once, before renewing anything.
+	m.checkSigner()
+	var failed []string
+	for _, path := range paths {
+		log.Printf("Renewing %q...", path)
+		if err := m.renewCert(path); err != nil {
+			log.Printf("ERROR: failed to renew %q: %s", path, err)
+			failed = append(failed, path)
+		}
+	}
+	if len(failed) > 0 {
+		log.Fatalf("ERROR: failed to renew %d of %d certificates: %s", len(failed), len(paths), strings.Join(failed, ", "))
+	}
+	log.Printf("Renewed %d certificates ✅\n", len(paths))
+}
+
+// renewKeyFile returns the key file makeCert would have used along with
+// certPath, or certPath itself if it also contains the key.
+func renewKeyFile(certPath string) string {
+	if certPEM, err := ioutil.ReadFile(certPath); err == nil && bytes.Contains(certPEM, []byte("PRIVATE KEY-----")) {
+		return certPath
+	}
+	return strings.TrimSuffix(certPath, ".pem") + "-key.pem"
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"filippo.io/mkcert/ca"
+)
+
+// revoke records the revocation of the certificate identified by arg, which
+// is either the path of a PEM certificate issued by the CA, or the serial
+// number of a certificate in the CA index.
+func (m *mkcert) revoke(arg string) {
+	var serial *big.Int
+	if _, err := os.Stat(arg); err == nil {
+		cert := readCertificate(arg)
+		if !m.ca.IssuedBy(cert) {
+			log.Fatalf("ERROR: %q was not issued by the local CA", arg)
+		}
+		serial = cert.SerialNumber
+	} else {
+		serial, err = ca.ParseSerial(arg)
+		if err != nil {
+			log.Fatalf("ERROR: %q is not a certificate file or a serial number", arg)
+		}
+		records, err := m.ca.Inventory()
+		fatalIfErr(err, "failed to read the CA index")
+		var found bool
+		for _, r := range records {
+			if r.Serial == ca.FormatSerial(serial) {
+				found = true
+			}
+		}
+		if !found {
+			log.Fatalf("ERROR: no certificate with serial %s in the CA index, revoke it by file instead", ca.FormatSerial(serial))
+		}
+	}
+
+	fatalIfErr(m.ca.Revoke(serial, 0), "failed to revoke the certificate")
+
+	log.Printf("Revoked the certificate with serial %s 🚫\n", ca.FormatSerial(serial))
+	if !m.crl {
+		log.Printf("Run \"mkcert -crl\" to generate an updated CRL ℹ️\n")
+	}
+}
+
+// crlDistributionPoints returns the CRL Distribution Points for new
+// certificates, if -crl-url was set.
+func (m *mkcert) crlDistributionPoints() []string {
+	if m.crlURL == "" {
+		return nil
+	}
+	return []string{m.crlURL}
+}
+
+// readCertificate reads the first certificate in a PEM file.
+func readCertificate(path string) *x509.Certificate {
+	cert, err := readLeaf(path)
+	fatalIfErr(err, "failed to read the certificate")
+	return cert
+}
+
+// readLeaf parses the first certificate in a PEM file, if any.
+func readLeaf(path string) (*x509.Certificate, error) {
+	certPEMBlock, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, certPEMBlock = pem.Decode(certPEMBlock)
+		if block == nil {
+			return nil, errors.New("no CERTIFICATE block in " + path)
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// writeCRL generates a CRL of the revoked certificates and saves it in CAROOT
+// in DER and PEM format.
+func (m *mkcert) writeCRL() {
+	der, err := m.ca.CRL()
+	fatalIfErr(err, "failed to generate the CRL")
+
+	derFile := filepath.Join(m.CAROOT, ca.CRLName+".der")
+	pemFile := filepath.Join(m.CAROOT, ca.CRLName+".pem")
+	err = ioutil.WriteFile(derFile, der, 0644)
+	fatalIfErr(err, "failed to save the CRL")
+	err = ioutil.WriteFile(pemFile, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0644)
+	fatalIfErr(err, "failed to save the CRL")
+
+	log.Printf("The CRL is at \"%s\" and \"%s\" ✅\n", derFile, pemFile)
+	log.Printf("It must be regenerated by %s 🗓\n", time.Now().Add(ca.CRLValidity).Format("2 January 2006"))
+}
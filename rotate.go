@@ -0,0 +1,197 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"filippo.io/mkcert/ca"
+)
+
+// defaultGrace is how long the previous root stays installed after
+// -rotate-ca, if -grace is not set.
+const defaultGrace = 30 * 24 * time.Hour
+
+// rotate replaces the root with a new one, installs it next to the previous
+// one, and re-issues the certificates tracked in the CA index. If a rotation
+// is already in progress, it finishes it instead, once the grace period is
+// over.
+func (m *mkcert) rotate() {
+	if m.previous != nil {
+		m.finishRotation()
+		return
+	}
+
+	grace := m.grace
+	if grace < 0 {
+		grace = defaultGrace
+	}
+	next, err := m.ca.Rotate(&ca.RotateOptions{
+		Options:   ca.Options{KeyType: m.keyType, NameConstraints: m.parseNameConstraints()},
+		CrossSign: m.crossSign,
+		Grace:     grace,
+	})
+	var missingKey *ca.MissingKeyError
+	if errors.As(err, &missingKey) {
+		log.Fatalf("ERROR: can't rotate the CA because %s", err)
+	}
+	fatalIfErr(err, "failed to rotate the CA")
+	m.ca = next
+	m.previous, m.rotation, err = m.ca.Previous()
+	fatalIfErr(err, "failed to load the CA rotation")
+
+	log.Printf("Created a new local CA 💥\n")
+	warnKeyType("the local CA", m.ca.Cert.PublicKey)
+	if names := m.ca.NameConstraints(); names != nil {
+		log.Printf("It can only issue certificates for %s ℹ️\n", strings.Join(names, ", "))
+	}
+	if m.ca.CrossCert != nil {
+		log.Printf("It's cross-signed by the previous root, so new certificates are also trusted where only that one is installed ℹ️\n")
+	}
+	log.Printf("The previous root was moved to %q ℹ️\n", filepath.Join(m.CAROOT, ca.PreviousDirName))
+	log.Print("")
+
+	m.install()
+	m.reissueTracked()
+
+	log.Printf("The previous root stays installed until %s 🗓\n", m.rotation.FinishAfter.Format("2 January 2006"))
+	log.Println(`Run "mkcert -rotate-ca" again after then to uninstall and delete it.`)
+}
+
+// finishRotation uninstalls the previous root from the trust stores and
+// deletes it, if the grace period is over. If m.grace is set, it overrides
+// the one chosen when the rotation started.
+func (m *mkcert) finishRotation() {
+	finishAfter := m.rotation.FinishAfter
+	if m.grace >= 0 {
+		finishAfter = m.rotation.Started.Add(m.grace)
+	}
+	if time.Now().Before(finishAfter) {
+		log.Printf("The local CA is being rotated, and the previous root stays installed until %s 🗓\n",
+			finishAfter.Format("2 January 2006"))
+		log.Println(`Run "mkcert -rotate-ca" again after then to uninstall and delete it, or add "-grace 0" to do it now.`)
+		return
+	}
+
+	log.Printf("Uninstalling the previous root %q...", m.previous.UniqueName())
+	// Forget the previous root first, so that the stores generated from
+	// CAROOT, like the Node.js bundle, are rewritten with the current one only.
+	prev := m.previous
+	m.previous = nil
+	m.removeRootFromStores(prev.Cert)
+	log.Print("")
+
+	fatalIfErr(m.ca.FinishRotation(), "failed to finish the rotation")
+	m.rotation = nil
+	log.Println("The rotation is complete, and the previous root was deleted 🎉")
+}
+
+// removeRootFromStores removes cert from all the trust stores that list it.
+func (m *mkcert) removeRootFromStores(cert *x509.Certificate) {
+	for _, s := range enabledTrustStores() {
+		err := s.Available()
+		var missingTool *missingToolError
+		switch {
+		case err == errNoStore || err == errUnsupported:
+			continue
+		case err != nil && !errors.As(err, &missingTool):
+			log.Printf("Warning: can't uninstall the previous root from %s: %s ⚠️", s.Description(), err)
+			continue
+		}
+
+		for _, loc := range s.List(m) {
+			where := strings.TrimSpace(s.Name() + " " + loc.Path)
+			if errors.As(loc.Err, &missingTool) {
+				log.Printf(`Warning: %s, so the previous root can't be automatically uninstalled from %s! ⚠️`, loc.Err, where)
+				continue
+			}
+			if loc.Err != nil {
+				log.Printf("Warning: failed to list the roots in %s: %s ⚠️", where, loc.Err)
+				continue
+			}
+			var roots []storeRoot
+			for _, r := range loc.Roots {
+				if r.Cert.Equal(cert) {
+					roots = append(roots, r)
+				}
+			}
+			if len(roots) == 0 {
+				continue
+			}
+			removed, err := s.Remove(m, loc, roots)
+			if err != nil {
+				log.Printf("Warning: failed to uninstall the previous root from %s: %s ⚠️", where, err)
+			} else if len(removed) > 0 {
+				log.Printf("The previous root is now uninstalled from %s 👋", where)
+			}
+		}
+	}
+}
+
+// reissueTracked re-issues the certificates in the CA index that are still
+// saved in their files and were issued by the previous root, unless they
+// expired or were revoked. Their keys are kept, if present.
+func (m *mkcert) reissueTracked() {
+	records, err := m.ca.Inventory()
+	fatalIfErr(err, "failed to read the CA index")
+
+	// Go from the most recent record, which has the current key file.
+	seen := make(map[string]bool)
+	var reissued int
+	for i := len(records) - 1; i >= 0; i-- {
+		r := records[i]
+		if len(r.Files) == 0 || seen[r.Files[0]] {
+			continue
+		}
+		certPath := r.Files[0]
+		seen[certPath] = true
+		if isPKCS12File(certPath) {
+			log.Printf("Warning: skipping the PKCS #12 file %q, regenerate it with -pkcs12 if it's from the previous root ⚠️", certPath)
+			continue
+		}
+
+		// The file might have been replaced since, so check what it holds.
+		cert, err := readLeaf(certPath)
+		if err != nil || !m.previous.IssuedBy(cert) || cert.NotAfter.Before(time.Now()) {
+			continue
+		}
+		if revoked, err := m.ca.Revocation(cert.SerialNumber); err != nil || revoked != nil {
+			continue
+		}
+
+		log.Printf("Re-issuing %q...", certPath)
+		renewer := *m
+		renewer.keyType = ""
+		renewer.keyFile = renewKeyFile(certPath)
+		if len(r.Files) > 1 {
+			renewer.keyFile = r.Files[1]
+		}
+		renewer.reuseKey = pathExists(renewer.keyFile)
+		renewer.renew(certPath)
+		reissued++
+	}
+	if reissued == 0 {
+		log.Println("No certificates from the previous root needed to be re-issued.")
+		return
+	}
+	log.Printf("Re-issued %d certificates ✅\n", reissued)
+	log.Print("")
+}
+
+// issuedByCA reports whether cert was issued by the local CA or, during a
+// rotation, by the previous root.
+func (m *mkcert) issuedByCA(cert *x509.Certificate) bool {
+	return m.ca.IssuedBy(cert) || m.previous != nil && m.previous.IssuedBy(cert)
+}
+
+func isPKCS12File(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".p12" || ext == ".pfx"
+}
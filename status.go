@@ -0,0 +1,167 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"filippo.io/mkcert/ca"
+)
+
+// A storeStatus is a row of the -status table, for a trust store or for one
+// of its locations.
+type storeStatus struct {
+	store, location string
+	installed       string // "yes", "no", or why it's unknown
+	roots           []storeRoot
+	err             error // from listing the roots
+}
+
+// status prints whether the local CA is installed in each location of each
+// trust store, like NSS profiles, and which roots from other CAROOTs are installed alongside it.
+func (m *mkcert) status() {
+	var rows []*storeStatus
+	for _, s := range enabledTrustStores() {
+		// Missing tools might only be needed to make changes.
+		var missingTool *missingToolError
+		if err := s.Available(); err != nil && !errors.As(err, &missingTool) {
+			rows = append(rows, &storeStatus{store: s.Name(), installed: "unknown (" + err.Error() + ")"})
+			continue
+		}
+		locs := s.List(m)
+		if len(locs) == 0 {
+			rows = append(rows, &storeStatus{store: s.Name(), installed: "unknown (no locations found)"})
+		}
+		for _, loc := range locs {
+			row := &storeStatus{store: s.Name(), location: loc.Path,
+				installed: yesNo(loc.Installed), roots: loc.Roots, err: loc.Err}
+			if loc.Err != nil {
+				row.installed = "unknown"
+			}
+			rows = append(rows, row)
+		}
+	}
+
+	log.Printf("The local CA is %q, in %s", m.caUniqueName(), m.CAROOT)
+	if m.previous != nil {
+		log.Printf("It's being rotated, and the previous root %q stays installed until %s",
+			m.previous.UniqueName(), m.rotation.FinishAfter.Format("2 January 2006"))
+	}
+	log.Print("")
+
+	var stale []*storeStatus
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "STORE\tLOCATION\tLOCAL CA\tOTHER MKCERT ROOTS")
+	for _, row := range rows {
+		others := "-"
+		switch {
+		case row.err != nil:
+			others = "unknown"
+		case row.installed == "yes" || row.installed == "no":
+			n := len(m.staleRoots(row.roots))
+			others = strconv.Itoa(n)
+			if n > 0 {
+				stale = append(stale, row)
+			}
+		}
+		location := row.location
+		if location == "" {
+			location = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", row.store, location, row.installed, others)
+	}
+	tw.Flush()
+
+	for _, row := range rows {
+		if row.err != nil {
+			where := strings.TrimSpace(row.store + " " + row.location)
+			log.Printf("Warning: failed to list the roots in %s: %s ⚠️", where, row.err)
+		}
+	}
+
+	if len(stale) == 0 {
+		return
+	}
+	fmt.Println()
+	fmt.Println("Roots from other CAROOTs:")
+	fmt.Println()
+	tw = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "STORE\tLOCATION\tNAME\tCREATED BY\tEXPIRES")
+	for _, row := range stale {
+		for _, r := range m.staleRoots(row.roots) {
+			expires := r.Cert.NotAfter.Format("2006-01-02")
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", row.store, row.location, r.Name,
+				strings.Join(r.Cert.Subject.OrganizationalUnit, ", "), expires)
+		}
+	}
+	tw.Flush()
+	log.Print("")
+	log.Println(`Run "mkcert -prune" to remove them 👈`)
+}
+
+// staleRoots returns the roots that are not the local CA or, during a
+// rotation, the previous root.
+func (m *mkcert) staleRoots(roots []storeRoot) []storeRoot {
+	var stale []storeRoot
+	for _, r := range roots {
+		if r.Cert.SerialNumber.Cmp(m.ca.Cert.SerialNumber) == 0 {
+			continue
+		}
+		if m.previous != nil && r.Cert.SerialNumber.Cmp(m.previous.Cert.SerialNumber) == 0 {
+			continue
+		}
+		stale = append(stale, r)
+	}
+	return stale
+}
+
+// isMkcertRoot reports whether cert is the root certificate of a mkcert CA,
+// including those from other CAROOTs.
+func isMkcertRoot(cert *x509.Certificate) bool {
+	if !cert.IsCA || !bytes.Equal(cert.RawSubject, cert.RawIssuer) {
+		return false
+	}
+	for _, o := range cert.Subject.Organization {
+		if o == ca.Organization {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCertificates returns the certificates in the PEM blocks in data,
+// skipping anything it can't parse.
+func parseCertificates(data []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
@@ -0,0 +1,172 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"filippo.io/mkcert/ca"
+)
+
+// A TrustStore is a set of roots trusted by some clients, like the system
+// store or Firefox, that the local CA can be installed in. Stores are listed
+// in trustStores, and are selected by name with $TRUST_STORES.
+type TrustStore interface {
+	// Name is the name of the store in $TRUST_STORES, like "nss".
+	Name() string
+
+	// Description is used in messages, like "the system trust store".
+	Description() string
+
+	// Available returns nil if the store can be managed, errNoStore if it's
+	// not present, errUnsupported if it's not supported on this platform,
+	// or a *missingToolError if a tool needed to manage it is missing.
+	Available() error
+
+	// Check reports whether the local CA is installed.
+	Check(m *mkcert) bool
+
+	// Install installs the local CA, and logs a message if it succeeds. It
+	// returns a *missingToolError if it needed the tool for some locations.
+	Install(m *mkcert) error
+
+	// Uninstall removes the local CA, if it's installed. It's also called if
+	// Available returns a *missingToolError, and returns one if it needed
+	// the tool for all the locations where the CA might be installed.
+	Uninstall(m *mkcert) error
+
+	// List returns the locations of the store, like NSS profiles, with the
+	// mkcert roots in each. Like Check and Remove, it's also called if
+	// Available returns a *missingToolError, so it must report that in
+	// storeLocation.Err if it needs the tool.
+	List(m *mkcert) []*storeLocation
+
+	// Remove deletes roots, as returned by List, from loc. It returns the
+	// roots it removed, which might not be all of them.
+	Remove(m *mkcert, loc *storeLocation, roots []storeRoot) ([]storeRoot, error)
+}
+
+// A storeLocation is a database, file or directory of a TrustStore.
+type storeLocation struct {
+	Path      string
+	Installed bool        // whether the local CA is installed in it
+	Roots     []storeRoot // the mkcert roots in it, including the local CA
+	Err       error       // from listing Roots
+}
+
+// A storeRoot is a mkcert root CA found in a trust store.
+type storeRoot struct {
+	// Name identifies the root within the store, like an NSS nickname, a
+	// Java alias or a file path.
+	Name string
+	Cert *x509.Certificate
+}
+
+var (
+	errNoStore     = errors.New("not found")
+	errUnsupported = errors.New("not supported on this platform")
+)
+
+// A missingToolError is returned by TrustStore.Available if a tool needed to
+// manage the store, like certutil, is not installed.
+type missingToolError struct {
+	Tool string
+	Help string // the command to install it, if known
+}
+
+func (e *missingToolError) Error() string {
+	return fmt.Sprintf("%q is not available", e.Tool)
+}
+
+// trustStores are the supported stores, in the order they are installed in.
+var trustStores = []TrustStore{
+	systemStore{},
+	nssStore{},
+	javaStore{},
+	nodeStore{},
+}
+
+// A fileSystem is how the trust stores access the files they manage, so that
+// they can be tested against a fake one.
+type fileSystem interface {
+	ReadFile(name string) ([]byte, error)
+
+	// WriteFile atomically replaces name, or creates it, with data.
+	WriteFile(name string, data []byte, perm os.FileMode) error
+
+	Stat(name string) (os.FileInfo, error)
+	Remove(name string) error
+	EvalSymlinks(name string) (string, error)
+}
+
+// storeFS is the fileSystem of the trust stores.
+var storeFS fileSystem = osFS{}
+
+type osFS struct{}
+
+func (osFS) ReadFile(name string) ([]byte, error)  { return ioutil.ReadFile(name) }
+func (osFS) Stat(name string) (os.FileInfo, error) { return os.Stat(name) }
+func (osFS) Remove(name string) error              { return os.Remove(name) }
+
+func (osFS) EvalSymlinks(name string) (string, error) { return filepath.EvalSymlinks(name) }
+
+func (osFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return ca.WriteFileAtomic(name, data, perm)
+}
+
+// enabledTrustStores returns the registered stores selected by $TRUST_STORES.
+func enabledTrustStores() []TrustStore {
+	var stores []TrustStore
+	for _, s := range trustStores {
+		if storeEnabled(s.Name()) {
+			stores = append(stores, s)
+		}
+	}
+	return stores
+}
+
+// systemStore is the trust store of the operating system, implemented by
+// the platform-specific functions in truststore_$GOOS.go.
+type systemStore struct{}
+
+func (systemStore) Name() string        { return "system" }
+func (systemStore) Description() string { return "the system trust store" }
+func (systemStore) Available() error    { return platformAvailable() }
+
+func (systemStore) Check(m *mkcert) bool {
+	return m.checkPlatform()
+}
+
+func (systemStore) Install(m *mkcert) error {
+	// The system cert pool is cached, so checks would keep failing.
+	defer func() { m.ignoreCheckFailure = true }() // TODO: replace with a check for a successful install
+	if !m.installPlatform() {
+		return errors.New("installation failed")
+	}
+	log.Print("The local CA is now installed in the system trust store! ⚡️")
+	return nil
+}
+
+func (systemStore) Uninstall(m *mkcert) error {
+	if !m.uninstallPlatform() {
+		return errors.New("uninstallation failed")
+	}
+	return nil
+}
+
+func (systemStore) List(m *mkcert) []*storeLocation {
+	path, roots, err := platformRoots()
+	return []*storeLocation{{Path: path, Installed: m.checkPlatform(), Roots: roots, Err: err}}
+}
+
+func (systemStore) Remove(m *mkcert, loc *storeLocation, roots []storeRoot) ([]storeRoot, error) {
+	return deletePlatformRoots(roots)
+}
@@ -6,10 +6,13 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"encoding/asn1"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
 	"path/filepath"
 
 	"howett.net/plist"
@@ -49,6 +52,10 @@ var trustSettingsData = []byte(`
 </array>
 `)
 
+func platformAvailable() error {
+	return nil
+}
+
 func (m *mkcert) installPlatform() bool {
 	cmd := commandWithSudo("security", "add-trusted-cert", "-d", "-k", "/Library/Keychains/System.keychain", filepath.Join(m.CAROOT, rootName))
 	out, err := cmd.CombinedOutput()
@@ -71,7 +78,7 @@ func (m *mkcert) installPlatform() bool {
 	_, err = plist.Unmarshal(plistData, &plistRoot)
 	fatalIfErr(err, "failed to parse trust settings")
 
-	rootSubjectASN1, _ := asn1.Marshal(m.caCert.Subject.ToRDNSequence())
+	rootSubjectASN1, _ := asn1.Marshal(m.ca.Cert.Subject.ToRDNSequence())
 
 	if plistRoot["trustVersion"].(uint64) != 1 {
 		log.Fatalln("ERROR: unsupported trust settings version:", plistRoot["trustVersion"])
@@ -109,3 +116,39 @@ func (m *mkcert) uninstallPlatform() bool {
 
 	return true
 }
+
+// platformRoots returns the system keychain, and the mkcert root CAs in it,
+// by common name.
+func platformRoots() (string, []storeRoot, error) {
+	const keychain = "/Library/Keychains/System.keychain"
+	out, err := exec.Command("security", "find-certificate", "-a", "-p", "-c", "mkcert", keychain).CombinedOutput()
+	if err != nil && bytes.Contains(out, []byte("could not be found")) {
+		return keychain, nil, nil
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("security find-certificate failed: %v: %s", err, bytes.TrimSpace(out))
+	}
+	var roots []storeRoot
+	for _, cert := range parseCertificates(out) {
+		if isMkcertRoot(cert) {
+			roots = append(roots, storeRoot{Name: cert.Subject.CommonName, Cert: cert})
+		}
+	}
+	return keychain, roots, nil
+}
+
+// deletePlatformRoots removes roots, as returned by platformRoots, from the
+// system keychain. It returns the roots it removed, and stops at the first
+// error.
+func deletePlatformRoots(roots []storeRoot) ([]storeRoot, error) {
+	var removed []storeRoot
+	for _, r := range roots {
+		hash := fmt.Sprintf("%X", sha1.Sum(r.Cert.Raw))
+		cmd := commandWithSudo("security", "delete-certificate", "-Z", hash, "/Library/Keychains/System.keychain")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return removed, fmt.Errorf("security delete-certificate failed: %v: %s", err, bytes.TrimSpace(out))
+		}
+		removed = append(removed, r)
+	}
+	return removed, nil
+}
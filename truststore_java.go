@@ -10,7 +10,11 @@ import (
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"hash"
+	"io/ioutil"
+	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -18,44 +22,275 @@ import (
 	"strings"
 )
 
-var (
-	hasJava    bool
-	hasKeytool bool
+// A javaInstall is a JDK or JRE with a cacerts trust store.
+type javaInstall struct {
+	Home    string
+	Cacerts string
+	Keytool string // empty if the installation doesn't ship keytool
+}
 
-	javaHome    string
-	cacertsPath string
-	keytoolPath string
-	storePass   string = "changeit"
+var (
+	javaInstalls []*javaInstall
+	storePass    string = "changeit"
 )
 
 func init() {
+	home := os.Getenv("HOME")
 	if runtime.GOOS == "windows" {
-		keytoolPath = filepath.Join("bin", "keytool.exe")
-	} else {
-		keytoolPath = filepath.Join("bin", "keytool")
+		home = os.Getenv("USERPROFILE")
+	}
+	asdfDir := os.Getenv("ASDF_DATA_DIR")
+	if asdfDir == "" {
+		asdfDir = filepath.Join(home, ".asdf")
 	}
 
+	// $JAVA_HOME goes first, followed by the usual installation directories.
+	var homes []string
 	if v := os.Getenv("JAVA_HOME"); v != "" {
-		hasJava = true
-		javaHome = v
+		homes = append(homes, v)
+	}
+	for _, pattern := range []string{
+		filepath.Join(home, ".sdkman", "candidates", "java", "*"), // SDKMAN!
+		filepath.Join(asdfDir, "installs", "java", "*"),           // asdf
+		filepath.Join(home, ".gradle", "jdks", "*"),               // Gradle toolchains
+		filepath.Join(home, ".gradle", "jdks", "*", "*"),          // older Gradle toolchains
+		"/usr/lib/jvm/*",                                      // Linux packages
+		"/Library/Java/JavaVirtualMachines/*",                 // macOS
+		filepath.Join(os.Getenv("ProgramFiles"), "Java", "*"), // Windows
+	} {
+		matches, _ := filepath.Glob(pattern)
+		homes = append(homes, matches...)
+	}
 
-		if pathExists(filepath.Join(v, keytoolPath)) {
-			hasKeytool = true
-			keytoolPath = filepath.Join(v, keytoolPath)
+	// Installations often share a cacerts file, for example through the
+	// "current" symlink of SDKMAN! or the system one on Debian, so only the
+	// first one found is kept.
+	seen := make(map[string]bool)
+	for _, h := range homes {
+		j := findJavaInstall(h)
+		if j == nil {
+			continue
+		}
+		cacerts, err := filepath.EvalSymlinks(j.Cacerts)
+		if err != nil || seen[cacerts] {
+			continue
+		}
+		seen[cacerts] = true
+		javaInstalls = append(javaInstalls, j)
+	}
+}
+
+// findJavaInstall returns the installation at home, or nil if it has no
+// cacerts. Some distributions, like the macOS ones, nest the actual home.
+func findJavaInstall(home string) *javaInstall {
+	keytool := filepath.Join("bin", "keytool")
+	if runtime.GOOS == "windows" {
+		keytool = filepath.Join("bin", "keytool.exe")
+	}
+	for _, h := range []string{home, filepath.Join(home, "Contents", "Home")} {
+		for _, cacerts := range []string{
+			filepath.Join(h, "lib", "security", "cacerts"),
+			filepath.Join(h, "jre", "lib", "security", "cacerts"),
+		} {
+			if !pathExists(cacerts) {
+				continue
+			}
+			j := &javaInstall{Home: h, Cacerts: cacerts}
+			if pathExists(filepath.Join(h, keytool)) {
+				j.Keytool = filepath.Join(h, keytool)
+			}
+			return j
 		}
+	}
+	return nil
+}
 
-		if pathExists(filepath.Join(v, "lib", "security", "cacerts")) {
-			cacertsPath = filepath.Join(v, "lib", "security", "cacerts")
+// javaInstallAt returns the installation with the given cacerts path.
+func javaInstallAt(cacerts string) *javaInstall {
+	for _, j := range javaInstalls {
+		if j.Cacerts == cacerts {
+			return j
 		}
+	}
+	return nil
+}
+
+// manageable reports whether the trust store of j can be edited, either
+// directly or with keytool.
+func (j *javaInstall) manageable() bool {
+	if j.Keytool != "" {
+		return true
+	}
+	_, err := j.loadCacerts()
+	return err == nil
+}
+
+// javaStore is the cacerts keystores of the Java installations, starting
+// with the one at $JAVA_HOME. They are edited directly if their format is
+// supported, or with keytool. Each installation is a location.
+type javaStore struct{}
 
-		if pathExists(filepath.Join(v, "jre", "lib", "security", "cacerts")) {
-			cacertsPath = filepath.Join(v, "jre", "lib", "security", "cacerts")
+func (javaStore) Name() string        { return "java" }
+func (javaStore) Description() string { return "Java's trust store" }
+
+func (javaStore) Available() error {
+	if len(javaInstalls) == 0 {
+		return errNoStore
+	}
+	for _, j := range javaInstalls {
+		if j.manageable() {
+			return nil
 		}
 	}
+	return &missingToolError{Tool: "keytool"}
 }
 
+func (javaStore) Check(m *mkcert) bool {
+	return m.checkJava()
+}
+
+func (javaStore) Install(m *mkcert) error {
+	var installed int
+	for _, j := range javaInstalls {
+		if m.checkJavaInstall(j) {
+			installed++
+			continue
+		}
+		if !j.manageable() {
+			log.Printf(`Warning: "keytool" is not available, so the CA can't be installed in %s ⚠️`, j.Cacerts)
+			continue
+		}
+		m.installJava(j)
+		installed++
+		log.Printf("The local CA is now installed in Java's trust store at %s! ☕️", j.Cacerts)
+	}
+	if installed == 0 {
+		return errors.New("no Java installation could be updated")
+	}
+	return nil
+}
+
+func (javaStore) Uninstall(m *mkcert) error {
+	var skipped []string
+	for _, j := range javaInstalls {
+		if !j.manageable() {
+			skipped = append(skipped, j.Cacerts)
+			continue
+		}
+		m.uninstallJava(j)
+	}
+	if len(skipped) == len(javaInstalls) {
+		return &missingToolError{Tool: "keytool"}
+	}
+	for _, cacerts := range skipped {
+		log.Printf(`Warning: "keytool" is not available, so the CA can't be uninstalled from %s ⚠️`, cacerts)
+	}
+	return nil
+}
+
+func (javaStore) List(m *mkcert) []*storeLocation {
+	var locs []*storeLocation
+	for _, j := range javaInstalls {
+		loc := &storeLocation{Path: j.Cacerts, Installed: m.checkJavaInstall(j)}
+		loc.Roots, loc.Err = javaRoots(j)
+		locs = append(locs, loc)
+	}
+	return locs
+}
+
+func (javaStore) Remove(m *mkcert, loc *storeLocation, roots []storeRoot) ([]storeRoot, error) {
+	j := javaInstallAt(loc.Path)
+	if j == nil {
+		return nil, fmt.Errorf("no Java installation uses %s", loc.Path)
+	}
+	var removed []storeRoot
+	for _, r := range roots {
+		if err := deleteJavaRoot(j, r); err != nil {
+			return removed, err
+		}
+		removed = append(removed, r)
+	}
+	return removed, nil
+}
+
+// loadCacerts reads the trust store of j, if its format is supported.
+func (j *javaInstall) loadCacerts() (*javaKeyStore, error) {
+	data, err := storeFS.ReadFile(j.Cacerts)
+	if err != nil {
+		return nil, err
+	}
+	return parseJavaKeyStore(data, storePass)
+}
+
+// saveCacerts replaces the trust store of j with ks, keeping its mode, with
+// sudo if needed. Like with ca.WriteFileAtomic, a temporary file is renamed
+// over it, so a failed write doesn't leave Java without roots.
+func (j *javaInstall) saveCacerts(ks *javaKeyStore) error {
+	data, err := ks.Marshal(storePass)
+	if err != nil {
+		return err
+	}
+	// On Debian, cacerts is a symlink to the trust store shared by all the
+	// installations, which is the file to replace.
+	cacerts, err := storeFS.EvalSymlinks(j.Cacerts)
+	if err != nil {
+		return err
+	}
+	info, err := storeFS.Stat(cacerts)
+	if err != nil {
+		return err
+	}
+	err = storeFS.WriteFile(cacerts, data, info.Mode().Perm())
+	if !errors.Is(err, os.ErrPermission) || runtime.GOOS == "windows" {
+		return err
+	}
+
+	out, err := commandWithSudo("mktemp", cacerts+".XXXXXX").Output()
+	if err != nil {
+		return fmt.Errorf("mktemp failed: %v", err)
+	}
+	tmp := strings.TrimSpace(string(out))
+	for _, args := range [][]string{
+		{"tee", tmp},
+		{"chmod", fmt.Sprintf("%o", info.Mode().Perm()), tmp},
+		{"mv", "-f", tmp, cacerts},
+	} {
+		cmd := commandWithSudo(args...)
+		if args[0] == "tee" {
+			cmd.Stdin = bytes.NewReader(data)
+			cmd.Stdout = ioutil.Discard
+		}
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			commandWithSudo("rm", "-f", tmp).Run()
+			return fmt.Errorf("%s failed: %v: %s", args[0], err, bytes.TrimSpace(stderr.Bytes()))
+		}
+	}
+	return nil
+}
+
+// checkJava reports whether the local CA is installed in all the Java
+// installations.
 func (m *mkcert) checkJava() bool {
-	if !hasKeytool {
+	for _, j := range javaInstalls {
+		if !m.checkJavaInstall(j) {
+			return false
+		}
+	}
+	return len(javaInstalls) > 0
+}
+
+func (m *mkcert) checkJavaInstall(j *javaInstall) bool {
+	if ks, err := j.loadCacerts(); err == nil {
+		for _, e := range ks.TrustedCerts() {
+			if e.Cert.Equal(m.ca.Cert) {
+				return true
+			}
+		}
+		return false
+	}
+	if j.Keytool == "" {
 		return false
 	}
 
@@ -67,7 +302,7 @@ func (m *mkcert) checkJava() bool {
 		return bytes.Contains(keytoolOutput, []byte(fp))
 	}
 
-	keytoolOutput, err := exec.Command(keytoolPath, "-list", "-keystore", cacertsPath, "-storepass", storePass).CombinedOutput()
+	keytoolOutput, err := exec.Command(j.Keytool, "-list", "-keystore", j.Cacerts, "-storepass", storePass).CombinedOutput()
 	fatalIfCmdErr(err, "keytool -list", keytoolOutput)
 	// keytool outputs SHA1 and SHA256 (Java 9+) certificates in uppercase hex
 	// with each octet pair delimitated by ":". Drop them from the keytool output
@@ -75,46 +310,128 @@ func (m *mkcert) checkJava() bool {
 
 	// pre-Java 9 uses SHA1 fingerprints
 	s1, s256 := sha1.New(), sha256.New()
-	return exists(m.caCert, s1, keytoolOutput) || exists(m.caCert, s256, keytoolOutput)
+	return exists(m.ca.Cert, s1, keytoolOutput) || exists(m.ca.Cert, s256, keytoolOutput)
 }
 
-func (m *mkcert) installJava() {
+func (m *mkcert) installJava(j *javaInstall) {
+	if ks, err := j.loadCacerts(); err == nil {
+		ks.SetTrustedCert(m.caUniqueName(), m.ca.Cert)
+		fatalIfErr(j.saveCacerts(ks), "failed to save the Java trust store")
+		return
+	}
+
 	args := []string{
 		"-importcert", "-noprompt",
-		"-keystore", cacertsPath,
+		"-keystore", j.Cacerts,
 		"-storepass", storePass,
 		"-file", filepath.Join(m.CAROOT, rootName),
 		"-alias", m.caUniqueName(),
 	}
 
-	out, err := execKeytool(exec.Command(keytoolPath, args...))
+	out, err := j.execKeytool(exec.Command(j.Keytool, args...))
 	fatalIfCmdErr(err, "keytool -importcert", out)
 }
 
-func (m *mkcert) uninstallJava() {
+func (m *mkcert) uninstallJava(j *javaInstall) {
+	if ks, err := j.loadCacerts(); err == nil {
+		// Also look for the root under other aliases, since the check
+		// doesn't go by alias either.
+		removed := ks.Delete(m.caUniqueName())
+		for _, e := range ks.TrustedCerts() {
+			if e.Cert.Equal(m.ca.Cert) {
+				removed = ks.Delete(e.Alias) || removed
+			}
+		}
+		if removed {
+			fatalIfErr(j.saveCacerts(ks), "failed to save the Java trust store")
+		}
+		return
+	}
+
 	args := []string{
 		"-delete",
 		"-alias", m.caUniqueName(),
-		"-keystore", cacertsPath,
+		"-keystore", j.Cacerts,
 		"-storepass", storePass,
 	}
-	out, err := execKeytool(exec.Command(keytoolPath, args...))
+	out, err := j.execKeytool(exec.Command(j.Keytool, args...))
 	if bytes.Contains(out, []byte("does not exist")) {
 		return // cert didn't exist
 	}
 	fatalIfCmdErr(err, "keytool -delete", out)
 }
 
+// javaRoots returns the mkcert root CAs in the trust store of j, by alias.
+func javaRoots(j *javaInstall) ([]storeRoot, error) {
+	ks, err := j.loadCacerts()
+	if err == nil {
+		var roots []storeRoot
+		for _, e := range ks.TrustedCerts() {
+			if isMkcertRoot(e.Cert) {
+				roots = append(roots, storeRoot{Name: e.Alias, Cert: e.Cert})
+			}
+		}
+		return roots, nil
+	}
+	if j.Keytool == "" {
+		return nil, &missingToolError{Tool: "keytool"}
+	}
+
+	out, err := exec.Command(j.Keytool, "-list", "-rfc", "-keystore", j.Cacerts, "-storepass", storePass).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("keytool -list failed: %v: %s", err, bytes.TrimSpace(out))
+	}
+	var roots []storeRoot
+	// Each entry starts with "Alias name: ALIAS", followed by its PEM.
+	for _, entry := range bytes.Split(out, []byte("Alias name: "))[1:] {
+		alias, _, _ := strings.Cut(string(entry), "\n")
+		for _, cert := range parseCertificates(entry) {
+			if isMkcertRoot(cert) {
+				roots = append(roots, storeRoot{Name: strings.TrimSpace(alias), Cert: cert})
+			}
+		}
+	}
+	return roots, nil
+}
+
+// deleteJavaRoot removes r, as returned by javaRoots, from the trust store
+// of j.
+func deleteJavaRoot(j *javaInstall, r storeRoot) error {
+	if ks, err := j.loadCacerts(); err == nil {
+		if !ks.Delete(r.Name) {
+			return nil
+		}
+		if err := j.saveCacerts(ks); err != nil {
+			return fmt.Errorf("failed to save the Java trust store: %w", err)
+		}
+		return nil
+	}
+	if j.Keytool == "" {
+		return &missingToolError{Tool: "keytool"}
+	}
+
+	args := []string{
+		"-delete",
+		"-alias", r.Name,
+		"-keystore", j.Cacerts,
+		"-storepass", storePass,
+	}
+	if out, err := j.execKeytool(exec.Command(j.Keytool, args...)); err != nil {
+		return fmt.Errorf("keytool -delete failed: %v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
 // execKeytool will execute a "keytool" command and if needed re-execute
 // the command with commandWithSudo to work around file permissions.
-func execKeytool(cmd *exec.Cmd) ([]byte, error) {
+func (j *javaInstall) execKeytool(cmd *exec.Cmd) ([]byte, error) {
 	out, err := cmd.CombinedOutput()
 	if err != nil && bytes.Contains(out, []byte("java.io.FileNotFoundException")) && runtime.GOOS != "windows" {
 		origArgs := cmd.Args[1:]
 		cmd = commandWithSudo(cmd.Path)
 		cmd.Args = append(cmd.Args, origArgs...)
 		cmd.Env = []string{
-			"JAVA_HOME=" + javaHome,
+			"JAVA_HOME=" + j.Home,
 		}
 		out, err = cmd.CombinedOutput()
 	}
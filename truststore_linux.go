@@ -6,9 +6,9 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
@@ -52,13 +52,14 @@ func (m *mkcert) systemTrustFilename() string {
 	return fmt.Sprintf(SystemTrustFilename, strings.Replace(m.caUniqueName(), " ", "_", -1))
 }
 
-func (m *mkcert) installPlatform() bool {
+func platformAvailable() error {
 	if SystemTrustCommand == nil {
-		log.Printf("Installing to the system store is not yet supported on this Linux 😣 but %s will still work.", NSSBrowsers)
-		log.Printf("You can also manually install the root certificate at %q.", filepath.Join(m.CAROOT, rootName))
-		return false
+		return errUnsupported
 	}
+	return nil
+}
 
+func (m *mkcert) installPlatform() bool {
 	cert, err := ioutil.ReadFile(filepath.Join(m.CAROOT, rootName))
 	fatalIfErr(err, "failed to read root certificate")
 
@@ -97,3 +98,48 @@ func (m *mkcert) uninstallPlatform() bool {
 
 	return true
 }
+
+// platformRoots returns the directory of the system trust store anchors, and
+// the mkcert root CAs in it, by file path.
+func platformRoots() (string, []storeRoot, error) {
+	if SystemTrustFilename == "" {
+		return "", nil, errors.New("not supported on this Linux")
+	}
+	paths, err := filepath.Glob(fmt.Sprintf(SystemTrustFilename, "*"))
+	if err != nil {
+		return "", nil, err
+	}
+	var roots []storeRoot
+	for _, path := range paths {
+		pemBytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", nil, err
+		}
+		for _, cert := range parseCertificates(pemBytes) {
+			if isMkcertRoot(cert) {
+				roots = append(roots, storeRoot{Name: path, Cert: cert})
+			}
+		}
+	}
+	return filepath.Dir(SystemTrustFilename), roots, nil
+}
+
+// deletePlatformRoots removes the files of roots, as returned by
+// platformRoots, from the system trust store. It returns the roots it
+// removed, and stops at the first error.
+func deletePlatformRoots(roots []storeRoot) ([]storeRoot, error) {
+	var removed []storeRoot
+	for _, r := range roots {
+		cmd := commandWithSudo("rm", "-f", r.Name)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return removed, fmt.Errorf("rm failed: %v: %s", err, bytes.TrimSpace(out))
+		}
+		removed = append(removed, r)
+	}
+
+	cmd := commandWithSudo(SystemTrustCommand...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return removed, fmt.Errorf("%s failed: %v: %s", strings.Join(SystemTrustCommand, " "), err, bytes.TrimSpace(out))
+	}
+	return removed, nil
+}
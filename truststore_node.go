@@ -0,0 +1,361 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// nodeBundleName is the name of the file in CAROOT that NODE_EXTRA_CA_CERTS
+// points to. It holds the root, the previous one during a rotation, and the
+// certificates of the file NODE_EXTRA_CA_CERTS pointed to before.
+const nodeBundleName = "rootCA-node.pem"
+
+// The lines that delimit the snippet added to the shell profile.
+const (
+	nodeSnippetStart = "# Added by mkcert -install, remove with mkcert -uninstall"
+	nodeSnippetEnd   = "# End of mkcert"
+)
+
+// nodeStore is the set of extra roots trusted by Node.js, which ignores the
+// system store. It's a PEM bundle in CAROOT, wired up by setting
+// NODE_EXTRA_CA_CERTS in the shell profile, if the user agrees, or by hand.
+// Node.js only reads a single file, so the bundle includes the certificates
+// of any previous value.
+type nodeStore struct{}
+
+func (nodeStore) Name() string        { return "node" }
+func (nodeStore) Description() string { return "the Node.js trust store" }
+
+func (nodeStore) Available() error {
+	if !binaryExists("node") && os.Getenv("NODE_EXTRA_CA_CERTS") == "" {
+		return errNoStore
+	}
+	return nil
+}
+
+func (nodeStore) Check(m *mkcert) bool {
+	return m.checkNodeBundle() && m.checkNodeEnv()
+}
+
+func (nodeStore) Install(m *mkcert) error {
+	if v := os.Getenv("NODE_EXTRA_CA_CERTS"); v != "" && v != m.nodeBundlePath() {
+		log.Printf("The certificates in %q, which NODE_EXTRA_CA_CERTS is set to, are copied to the local CA bundle ℹ️", v)
+	}
+	if err := m.writeNodeBundle(); err != nil {
+		return err
+	}
+	if npmrc := npmCAFile(); npmrc != "" {
+		log.Printf(`Warning: %q sets "cafile", so npm will ignore NODE_EXTRA_CA_CERTS ⚠️`, npmrc)
+	}
+
+	profile := nodeShellProfile()
+	if profile != "" && !m.checkNodeProfile(profile) &&
+		askYesNo(fmt.Sprintf("Set NODE_EXTRA_CA_CERTS to the local CA bundle in %q?", profile)) {
+		if err := m.addNodeSnippet(profile); err != nil {
+			return err
+		}
+	}
+	if !m.checkNodeEnv() {
+		// Without a terminal to ask, or if the user said no, setting the
+		// variable is left to them. That's expected, not a failure.
+		fish := filepath.Base(os.Getenv("SHELL")) == "fish"
+		log.Printf("The local CA bundle for Node.js is ready at %q ℹ️", m.nodeBundlePath())
+		log.Printf("Run this, and add it to your shell profile, for Node.js to trust it 👈")
+		log.Printf("\t%s", nodeExportCommand(m.nodeBundlePath(), fish))
+		return nil
+	}
+	log.Printf("The local CA is now installed in the Node.js trust store (requires a new shell)! 🐢")
+	return nil
+}
+
+func (nodeStore) Uninstall(m *mkcert) error {
+	if profile := nodeShellProfile(); profile != "" {
+		if err := m.removeNodeSnippet(profile); err != nil {
+			return err
+		}
+	}
+	err := storeFS.Remove(m.nodeBundlePath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if v := os.Getenv("NODE_EXTRA_CA_CERTS"); v == m.nodeBundlePath() {
+		log.Printf("Warning: NODE_EXTRA_CA_CERTS is still set to the removed bundle in this shell ⚠️")
+	}
+	return nil
+}
+
+func (nodeStore) List(m *mkcert) []*storeLocation {
+	loc := &storeLocation{Path: m.nodeBundlePath(), Installed: m.checkNodeBundle() && m.checkNodeEnv()}
+	data, err := storeFS.ReadFile(loc.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return []*storeLocation{loc}
+	}
+	if err != nil {
+		loc.Err = err
+		return []*storeLocation{loc}
+	}
+	for _, cert := range parseCertificates(data) {
+		if isMkcertRoot(cert) {
+			loc.Roots = append(loc.Roots, storeRoot{Name: loc.Path, Cert: cert})
+		}
+	}
+	return []*storeLocation{loc}
+}
+
+func (nodeStore) Remove(m *mkcert, loc *storeLocation, roots []storeRoot) ([]storeRoot, error) {
+	// The bundle only keeps the roots of this CAROOT, so just write it again.
+	if err := m.writeNodeBundle(); err != nil {
+		return nil, err
+	}
+	return roots, nil
+}
+
+func (m *mkcert) nodeBundlePath() string {
+	return filepath.Join(m.CAROOT, nodeBundleName)
+}
+
+// nodeBundle returns the contents of the bundle: the local CA, the previous
+// one during a rotation, and the other certificates already in the bundle or
+// in the file NODE_EXTRA_CA_CERTS points to. Roots from other CAROOTs are
+// left out, like "mkcert -prune" would do.
+func (m *mkcert) nodeBundle() []byte {
+	certs := []*x509.Certificate{m.ca.Cert}
+	if m.previous != nil {
+		certs = append(certs, m.previous.Cert)
+	}
+	var others []*x509.Certificate
+	if data, err := storeFS.ReadFile(m.nodeBundlePath()); err == nil {
+		others = parseCertificates(data)
+	}
+	if v := os.Getenv("NODE_EXTRA_CA_CERTS"); v != "" && v != m.nodeBundlePath() {
+		if data, err := storeFS.ReadFile(v); err == nil {
+			others = append(others, parseCertificates(data)...)
+		}
+	}
+	for _, c := range others {
+		if isMkcertRoot(c) {
+			continue
+		}
+		dup := false
+		for _, cc := range certs {
+			dup = dup || cc.Equal(c)
+		}
+		if !dup {
+			certs = append(certs, c)
+		}
+	}
+
+	var bundle []byte
+	for _, c := range certs {
+		bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+	return bundle
+}
+
+func (m *mkcert) writeNodeBundle() error {
+	if err := storeFS.WriteFile(m.nodeBundlePath(), m.nodeBundle(), 0644); err != nil {
+		return fmt.Errorf("failed to save the Node.js bundle: %w", err)
+	}
+	return nil
+}
+
+// checkNodeBundle reports whether the bundle is up to date, which might not
+// be the case after a rotation.
+func (m *mkcert) checkNodeBundle() bool {
+	data, err := storeFS.ReadFile(m.nodeBundlePath())
+	return err == nil && bytes.Equal(data, m.nodeBundle())
+}
+
+// checkNodeEnv reports whether NODE_EXTRA_CA_CERTS points to the bundle,
+// either in the current environment or in the shell profile.
+func (m *mkcert) checkNodeEnv() bool {
+	if os.Getenv("NODE_EXTRA_CA_CERTS") == m.nodeBundlePath() {
+		return true
+	}
+	profile := nodeShellProfile()
+	return profile != "" && m.checkNodeProfile(profile)
+}
+
+// checkNodeProfile reports whether the shell profile has the snippet.
+func (m *mkcert) checkNodeProfile(profile string) bool {
+	data, err := storeFS.ReadFile(profile)
+	if err != nil {
+		return false
+	}
+	snippet, _ := findNodeSnippet(string(data))
+	return snippet == nodeSnippet(profile, m.nodeBundlePath())
+}
+
+// nodeShellProfile returns the profile of the shell in $SHELL, if it exists,
+// or an empty string.
+func nodeShellProfile() string {
+	if runtime.GOOS == "windows" {
+		return ""
+	}
+	home := os.Getenv("HOME")
+	var profile string
+	switch filepath.Base(os.Getenv("SHELL")) {
+	case "zsh":
+		dir := os.Getenv("ZDOTDIR")
+		if dir == "" {
+			dir = home
+		}
+		profile = filepath.Join(dir, ".zshrc")
+	case "bash":
+		// Terminals on macOS start login shells, which don't read .bashrc.
+		profile = filepath.Join(home, ".bashrc")
+		if runtime.GOOS == "darwin" {
+			profile = filepath.Join(home, ".bash_profile")
+		}
+	case "fish":
+		profile = filepath.Join(home, ".config", "fish", "config.fish")
+	case "sh", "dash", "ksh":
+		profile = filepath.Join(home, ".profile")
+	default:
+		return ""
+	}
+	if _, err := storeFS.Stat(profile); err != nil {
+		return ""
+	}
+	return profile
+}
+
+// askYesNo asks the user a question on the terminal, and returns false if
+// there is no terminal.
+var askYesNo = func(question string) bool {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// nodeSnippet returns the snippet that sets NODE_EXTRA_CA_CERTS to bundle in
+// the shell profile.
+func nodeSnippet(profile, bundle string) string {
+	fish := filepath.Base(profile) == "config.fish"
+	return nodeSnippetStart + "\n" + nodeExportCommand(bundle, fish) + "\n" + nodeSnippetEnd + "\n"
+}
+
+func nodeExportCommand(bundle string, fish bool) string {
+	switch {
+	case runtime.GOOS == "windows":
+		return fmt.Sprintf(`setx NODE_EXTRA_CA_CERTS "%s"`, bundle)
+	case fish:
+		// fish only supports \\ and \' escapes in single quotes.
+		bundle = strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(bundle)
+		return fmt.Sprintf("set -gx NODE_EXTRA_CA_CERTS '%s'", bundle)
+	default:
+		bundle = strings.ReplaceAll(bundle, `'`, `'\''`)
+		return fmt.Sprintf("export NODE_EXTRA_CA_CERTS='%s'", bundle)
+	}
+}
+
+// findNodeSnippet returns the snippet in the profile, if any, and the
+// profile without it.
+func findNodeSnippet(profile string) (snippet, rest string) {
+	start := strings.Index(profile, nodeSnippetStart+"\n")
+	if start < 0 {
+		return "", profile
+	}
+	end := strings.Index(profile[start:], nodeSnippetEnd+"\n")
+	if end < 0 {
+		return "", profile
+	}
+	end += start + len(nodeSnippetEnd) + 1
+	return profile[start:end], profile[:start] + profile[end:]
+}
+
+// addNodeSnippet adds the snippet to the shell profile, replacing any
+// previous one, like from another CAROOT.
+func (m *mkcert) addNodeSnippet(profile string) error {
+	data, err := storeFS.ReadFile(profile)
+	if err != nil {
+		return err
+	}
+	snippet := nodeSnippet(profile, m.nodeBundlePath())
+	old, rest := findNodeSnippet(string(data))
+	if old == snippet {
+		return nil
+	}
+	if rest != "" && !strings.HasSuffix(rest, "\n") {
+		rest += "\n"
+	}
+	if err := writeShellProfile(profile, rest+snippet); err != nil {
+		return err
+	}
+	log.Printf("NODE_EXTRA_CA_CERTS is now set in %q", profile)
+	return nil
+}
+
+// removeNodeSnippet removes the snippet from the shell profile, if it points
+// to the bundle of this CAROOT.
+func (m *mkcert) removeNodeSnippet(profile string) error {
+	data, err := storeFS.ReadFile(profile)
+	if err != nil {
+		return err
+	}
+	snippet, rest := findNodeSnippet(string(data))
+	if snippet != nodeSnippet(profile, m.nodeBundlePath()) {
+		return nil
+	}
+	if err := writeShellProfile(profile, rest); err != nil {
+		return err
+	}
+	log.Printf("NODE_EXTRA_CA_CERTS is no longer set in %q", profile)
+	return nil
+}
+
+// writeShellProfile atomically replaces the contents of the profile. If it's
+// a symlink, like with dotfile managers, its target is replaced instead.
+func writeShellProfile(profile, contents string) error {
+	if target, err := filepath.EvalSymlinks(profile); err == nil {
+		profile = target
+	}
+	info, err := storeFS.Stat(profile)
+	if err != nil {
+		return err
+	}
+	if err := storeFS.WriteFile(profile, []byte(contents), info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to update %q: %w", profile, err)
+	}
+	return nil
+}
+
+// npmCAFile returns the path of the user .npmrc if it sets "cafile", which
+// makes npm replace the Node.js roots, including NODE_EXTRA_CA_CERTS.
+func npmCAFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	npmrc := filepath.Join(home, ".npmrc")
+	data, err := storeFS.ReadFile(npmrc)
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		key, _, ok := strings.Cut(line, "=")
+		if ok && strings.TrimSpace(key) == "cafile" {
+			return npmrc
+		}
+	}
+	return ""
+}
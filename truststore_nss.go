@@ -6,10 +6,13 @@ package main
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strings"
 )
@@ -70,14 +73,101 @@ func init() {
 	}
 }
 
-func (m *mkcert) checkNSS() bool {
-	if !hasCertutil {
-		return false
+// nssStore is the NSS security databases used by Firefox and Chrome on Linux.
+// cert9.db databases are managed directly, except for adding roots to those
+// with a password, and the others with certutil. Each database is a
+// location, as returned by forEachNSSProfile.
+type nssStore struct{}
+
+func (nssStore) Name() string        { return "nss" }
+func (nssStore) Description() string { return fmt.Sprintf("the %s trust store", NSSBrowsers) }
+
+func (nssStore) Available() error {
+	if !hasNSS {
+		return errNoStore
+	}
+	if hasCertutil {
+		return nil
+	}
+	for _, profile := range nssProfiles() {
+		if _, ok := nssProfileDir(profile); ok {
+			continue
+		}
+		if CertutilInstallHelp == "" {
+			return errUnsupported
+		}
+		return &missingToolError{Tool: "certutil", Help: CertutilInstallHelp}
+	}
+	return nil
+}
+
+func (nssStore) Check(m *mkcert) bool {
+	return m.checkNSS()
+}
+
+func (nssStore) Install(m *mkcert) error {
+	if err := m.installNSS(); err != nil {
+		return err
 	}
+	log.Printf("The local CA is now installed in the %s trust store (requires browser restart)! 🦊", NSSBrowsers)
+	return nil
+}
+
+func (nssStore) Uninstall(m *mkcert) error {
+	return m.uninstallNSS()
+}
+
+func (nssStore) List(m *mkcert) []*storeLocation {
+	var locs []*storeLocation
+	m.forEachNSSProfile(func(profile string) {
+		loc := &storeLocation{Path: profile, Installed: m.checkNSSProfile(profile)}
+		loc.Roots, loc.Err = nssRoots(profile)
+		locs = append(locs, loc)
+	})
+	return locs
+}
+
+func (nssStore) Remove(m *mkcert, loc *storeLocation, roots []storeRoot) ([]storeRoot, error) {
+	// Roots imported by hand get a nickname derived from the subject, which
+	// is the same for all CAs of the same user. certutil would pick any of
+	// them, so skip those shared with the local CA.
+	current := make(map[string]bool)
+	for _, r := range loc.Roots {
+		if r.Cert.Equal(m.ca.Cert) {
+			current[r.Name] = true
+		}
+	}
+	var removed []storeRoot
+	for _, r := range roots {
+		if dir, ok := nssProfileDir(loc.Path); ok {
+			_, err := deleteNSSCert(dir, r.Cert)
+			if err == nil {
+				removed = append(removed, r)
+				continue
+			}
+			if !hasCertutil {
+				return removed, err
+			}
+		}
+		if !hasCertutil {
+			return removed, &missingToolError{Tool: "certutil", Help: CertutilInstallHelp}
+		}
+		if current[r.Name] {
+			log.Printf("Warning: can't remove %q from %s, as the local CA has the same nickname ⚠️", r.Name, loc.Path)
+			continue
+		}
+		if err := deleteNSSRoot(loc.Path, r); err != nil {
+			return removed, err
+		}
+		removed = append(removed, r)
+	}
+	return removed, nil
+}
+
+func (m *mkcert) checkNSS() bool {
 	success := true
 	if m.forEachNSSProfile(func(profile string) {
-		err := exec.Command(certutilPath, "-V", "-d", profile, "-u", "L", "-n", m.caUniqueName()).Run()
-		if err != nil {
+		if !m.checkNSSProfile(profile) {
 			success = false
 		}
 	}) == 0 {
@@ -86,33 +176,105 @@ func (m *mkcert) checkNSS() bool {
 	return success
 }
 
-func (m *mkcert) installNSS() bool {
-	if m.forEachNSSProfile(func(profile string) {
+// checkNSSProfile reports whether the local CA is installed in the NSS
+// database profile, as passed by forEachNSSProfile. cert9.db databases are
+// read directly, the others with certutil.
+func (m *mkcert) checkNSSProfile(profile string) bool {
+	if dir, ok := nssProfileDir(profile); ok {
+		if certs, err := readNSSDB(dir); err == nil {
+			for _, c := range certs {
+				if c.TrustedCA && c.Cert.Equal(m.ca.Cert) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	if !hasCertutil {
+		return false
+	}
+	err := exec.Command(certutilPath, "-V", "-d", profile, "-u", "L", "-n", m.caUniqueName()).Run()
+	return err == nil
+}
+
+// installNSS adds the local CA to cert9.db databases directly, and to the
+// others, or if that fails, with certutil.
+func (m *mkcert) installNSS() error {
+	var skipped []string
+	var failed bool
+	found := m.forEachNSSProfile(func(profile string) {
+		if dir, ok := nssProfileDir(profile); ok {
+			err := addNSSCert(dir, m.caUniqueName(), m.ca.Cert)
+			if err == nil {
+				return
+			}
+			if !hasCertutil && err != errNSSNeedsCertutil {
+				log.Printf("ERROR: failed to install the local CA in %s: %s", profile, err)
+				failed = true
+				return
+			}
+		}
+		if !hasCertutil {
+			skipped = append(skipped, profile)
+			return
+		}
 		cmd := exec.Command(certutilPath, "-A", "-d", profile, "-t", "C,,", "-n", m.caUniqueName(), "-i", filepath.Join(m.CAROOT, rootName))
 		out, err := execCertutil(cmd)
 		fatalIfCmdErr(err, "certutil -A -d "+profile, out)
-	}) == 0 {
+	})
+	if found == 0 {
 		log.Printf("ERROR: no %s security databases found", NSSBrowsers)
-		return false
+		return errors.New("installation failed")
 	}
-	if !m.checkNSS() {
+	for _, profile := range skipped {
+		log.Printf(`Warning: "certutil" is not available, so the CA can't be installed in %s ⚠️`, profile)
+	}
+	switch {
+	case len(skipped) > 0:
+		return &missingToolError{Tool: "certutil", Help: CertutilInstallHelp}
+	case failed:
+		return errors.New("installation failed")
+	case !m.checkNSS():
 		log.Printf("Installing in %s failed. Please report the issue with details about your environment at https://github.com/FiloSottile/mkcert/issues/new 👎", NSSBrowsers)
 		log.Printf("Note that if you never started %s, you need to do that at least once.", NSSBrowsers)
-		return false
+		return errors.New("installation failed")
 	}
-	return true
+	return nil
 }
 
-func (m *mkcert) uninstallNSS() {
-	m.forEachNSSProfile(func(profile string) {
-		err := exec.Command(certutilPath, "-V", "-d", profile, "-u", "L", "-n", m.caUniqueName()).Run()
-		if err != nil {
+// uninstallNSS removes the local CA from cert9.db databases directly, and
+// from the others, or if that fails, with certutil.
+func (m *mkcert) uninstallNSS() error {
+	var skipped []string
+	found := m.forEachNSSProfile(func(profile string) {
+		if dir, ok := nssProfileDir(profile); ok {
+			_, err := deleteNSSCert(dir, m.ca.Cert)
+			if err == nil {
+				return
+			}
+			if !hasCertutil {
+				log.Printf("Warning: failed to uninstall the local CA from %s: %s ⚠️", profile, err)
+				return
+			}
+		}
+		if !hasCertutil {
+			skipped = append(skipped, profile)
+			return
+		}
+		if !m.checkNSSProfile(profile) {
 			return
 		}
 		cmd := exec.Command(certutilPath, "-D", "-d", profile, "-n", m.caUniqueName())
 		out, err := execCertutil(cmd)
 		fatalIfCmdErr(err, "certutil -D -d "+profile, out)
 	})
+	if found > 0 && len(skipped) == found {
+		return &missingToolError{Tool: "certutil", Help: CertutilInstallHelp}
+	}
+	for _, profile := range skipped {
+		log.Printf(`Warning: "certutil" is not available, so the CA can't be uninstalled from %s ⚠️`, profile)
+	}
+	return nil
 }
 
 // execCertutil will execute a "certutil" command and if needed re-execute
@@ -128,24 +290,97 @@ func execCertutil(cmd *exec.Cmd) ([]byte, error) {
 	return out, err
 }
 
+// certutilListRegexp matches the lines of "certutil -L" that list a
+// certificate nickname and its trust attributes, like "foo    C,,".
+var certutilListRegexp = regexp.MustCompile(`^(\S.*?)\s+([a-zA-Z]*,[a-zA-Z]*,[a-zA-Z]*)\s*$`)
+
+// nssRoots returns the mkcert root CAs in the NSS database profile, as
+// passed by forEachNSSProfile, by nickname. cert9.db databases are read
+// directly, the others with certutil.
+func nssRoots(profile string) ([]storeRoot, error) {
+	if dir, ok := nssProfileDir(profile); ok {
+		certs, err := readNSSDB(dir)
+		if err == nil {
+			var roots []storeRoot
+			for _, c := range certs {
+				if isMkcertRoot(c.Cert) {
+					roots = append(roots, storeRoot{Name: c.Nickname, Cert: c.Cert})
+				}
+			}
+			return roots, nil
+		}
+		if !hasCertutil {
+			return nil, fmt.Errorf("failed to read cert9.db: %w", err)
+		}
+	}
+	if !hasCertutil {
+		return nil, &missingToolError{Tool: "certutil", Help: CertutilInstallHelp}
+	}
+	out, err := exec.Command(certutilPath, "-L", "-d", profile).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("certutil -L failed: %v: %s", err, bytes.TrimSpace(out))
+	}
+	var roots []storeRoot
+	for _, line := range strings.Split(string(out), "\n") {
+		match := certutilListRegexp.FindStringSubmatch(line)
+		// Dumping every certificate is slow, and Firefox databases can hold
+		// hundreds of cached intermediates. mkcert roots have either our
+		// nickname or one derived from the subject, which includes "mkcert".
+		if match == nil || !strings.Contains(strings.ToLower(match[1]), "mkcert") {
+			continue
+		}
+		nickname := match[1]
+		pemBytes, err := exec.Command(certutilPath, "-L", "-d", profile, "-n", nickname, "-a").CombinedOutput()
+		if err != nil {
+			return nil, fmt.Errorf("certutil -L -n %q failed: %v: %s", nickname, err, bytes.TrimSpace(pemBytes))
+		}
+		for _, cert := range parseCertificates(pemBytes) {
+			if isMkcertRoot(cert) {
+				roots = append(roots, storeRoot{Name: nickname, Cert: cert})
+			}
+		}
+	}
+	return roots, nil
+}
+
+// deleteNSSRoot removes r, as returned by nssRoots, from the NSS database
+// profile with certutil. If more than one certificate has the same nickname,
+// certutil removes one of them.
+func deleteNSSRoot(profile string, r storeRoot) error {
+	cmd := exec.Command(certutilPath, "-D", "-d", profile, "-n", r.Name)
+	if out, err := execCertutil(cmd); err != nil {
+		return fmt.Errorf("certutil -D failed: %v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
 func (m *mkcert) forEachNSSProfile(f func(profile string)) (found int) {
-	var profiles []string
-	profiles = append(profiles, nssDBs...)
+	for _, profile := range nssProfiles() {
+		f(profile)
+		found++
+	}
+	return
+}
+
+// nssProfiles returns the NSS databases of Chrome and Firefox, prefixed with
+// "sql:" for cert9.db ones and "dbm:" for cert8.db ones, like certutil
+// expects them.
+func nssProfiles() []string {
+	var dirs, profiles []string
+	dirs = append(dirs, nssDBs...)
 	for _, ff := range FirefoxProfiles {
 		pp, _ := filepath.Glob(ff)
-		profiles = append(profiles, pp...)
+		dirs = append(dirs, pp...)
 	}
-	for _, profile := range profiles {
-		if stat, err := os.Stat(profile); err != nil || !stat.IsDir() {
+	for _, dir := range dirs {
+		if stat, err := storeFS.Stat(dir); err != nil || !stat.IsDir() {
 			continue
 		}
-		if pathExists(filepath.Join(profile, "cert9.db")) {
-			f("sql:" + profile)
-			found++
-		} else if pathExists(filepath.Join(profile, "cert8.db")) {
-			f("dbm:" + profile)
-			found++
+		if _, err := storeFS.Stat(filepath.Join(dir, "cert9.db")); err == nil {
+			profiles = append(profiles, "sql:"+dir)
+		} else if _, err := storeFS.Stat(filepath.Join(dir, "cert8.db")); err == nil {
+			profiles = append(profiles, "dbm:"+dir)
 		}
 	}
-	return
+	return profiles
 }
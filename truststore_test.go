@@ -0,0 +1,396 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/mkcert/ca"
+)
+
+// memFS is an in-memory fileSystem. Directories exist implicitly if they
+// contain files.
+type memFS map[string]*memFile
+
+type memFile struct {
+	data []byte
+	mode os.FileMode
+	link string // the target, if the file is a symlink
+}
+
+// withFakeFS replaces storeFS with a memFS holding files for the duration of
+// the test.
+func withFakeFS(t *testing.T, files map[string][]byte) memFS {
+	fsys := make(memFS)
+	for name, data := range files {
+		fsys[name] = &memFile{data: data, mode: 0644}
+	}
+	prev := storeFS
+	storeFS = fsys
+	t.Cleanup(func() { storeFS = prev })
+	return fsys
+}
+
+func (fsys memFS) ReadFile(name string) ([]byte, error) {
+	if target, err := fsys.EvalSymlinks(name); err == nil {
+		name = target
+	}
+	f, ok := fsys[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return append([]byte{}, f.data...), nil
+}
+
+func (fsys memFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	fsys[name] = &memFile{data: append([]byte{}, data...), mode: perm}
+	return nil
+}
+
+func (fsys memFS) Stat(name string) (os.FileInfo, error) {
+	if target, err := fsys.EvalSymlinks(name); err == nil {
+		name = target
+	}
+	if f, ok := fsys[name]; ok {
+		return memFileInfo{name: path.Base(name), size: int64(len(f.data)), mode: f.mode}, nil
+	}
+	for n := range fsys {
+		if strings.HasPrefix(n, strings.TrimSuffix(name, "/")+"/") {
+			return memFileInfo{name: path.Base(name), mode: os.ModeDir | 0755}, nil
+		}
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (fsys memFS) Remove(name string) error {
+	if _, ok := fsys[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(fsys, name)
+	return nil
+}
+
+// EvalSymlinks follows symlinks to files. Unlike filepath.EvalSymlinks, it
+// doesn't check that the target exists.
+func (fsys memFS) EvalSymlinks(name string) (string, error) {
+	for i := 0; i < 10; i++ {
+		f, ok := fsys[name]
+		if !ok || f.link == "" {
+			return name, nil
+		}
+		name = f.link
+	}
+	return "", &os.PathError{Op: "lstat", Path: name, Err: errors.New("too many links")}
+}
+
+type memFileInfo struct {
+	name string
+	size int64
+	mode os.FileMode
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+// newTestCA creates a CA in a temporary directory. P-256 keys are used
+// because they are quick to generate.
+func newTestCA(t *testing.T) *ca.CA {
+	t.Helper()
+	c, err := ca.NewCA(t.TempDir(), &ca.Options{KeyType: "p256"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func newTestMkcert(t *testing.T) *mkcert {
+	t.Helper()
+	c := newTestCA(t)
+	return &mkcert{CAROOT: c.Dir, ca: c}
+}
+
+func rootNames(roots []storeRoot) []string {
+	var names []string
+	for _, r := range roots {
+		names = append(names, r.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestTrustStoresOrder(t *testing.T) {
+	var names []string
+	for _, s := range trustStores {
+		names = append(names, s.Name())
+	}
+	if got, want := strings.Join(names, ","), "system,nss,java,node"; got != want {
+		t.Errorf("got stores %s, want %s", got, want)
+	}
+}
+
+func TestEnabledTrustStores(t *testing.T) {
+	t.Setenv("TRUST_STORES", "java,node")
+	var names []string
+	for _, s := range enabledTrustStores() {
+		names = append(names, s.Name())
+	}
+	if got, want := strings.Join(names, ","), "java,node"; got != want {
+		t.Errorf("got stores %s, want %s", got, want)
+	}
+}
+
+func TestJavaStore(t *testing.T) {
+	other := newTestCA(t)
+	for _, pkcs12 := range []bool{false, true} {
+		m := newTestMkcert(t)
+		ks := &javaKeyStore{pkcs12: pkcs12}
+		ks.SetTrustedCert("other mkcert", other.Cert)
+		data, err := ks.Marshal(storePass)
+		if err != nil {
+			t.Fatal(err)
+		}
+		const cacerts = "/jdk/lib/security/cacerts"
+		fsys := withFakeFS(t, map[string][]byte{cacerts: data})
+		fsys[cacerts].mode = 0664
+		prev := javaInstalls
+		javaInstalls = []*javaInstall{{Home: "/jdk", Cacerts: cacerts}}
+		t.Cleanup(func() { javaInstalls = prev })
+
+		s := javaStore{}
+		if err := s.Available(); err != nil {
+			t.Fatalf("pkcs12=%v: Available: %v", pkcs12, err)
+		}
+		if s.Check(m) {
+			t.Errorf("pkcs12=%v: installed before Install", pkcs12)
+		}
+		if err := s.Install(m); err != nil {
+			t.Fatalf("pkcs12=%v: Install: %v", pkcs12, err)
+		}
+		if !s.Check(m) {
+			t.Errorf("pkcs12=%v: not installed after Install", pkcs12)
+		}
+		if mode := fsys[cacerts].mode; mode != 0664 {
+			t.Errorf("pkcs12=%v: got mode %o after Install, want 664", pkcs12, mode)
+		}
+		locs := s.List(m)
+		if len(locs) != 1 || locs[0].Err != nil || !locs[0].Installed || len(locs[0].Roots) != 2 {
+			t.Fatalf("pkcs12=%v: List: got %+v", pkcs12, locs[0])
+		}
+
+		var stale []storeRoot
+		for _, r := range locs[0].Roots {
+			if r.Cert.Equal(other.Cert) {
+				stale = append(stale, r)
+			}
+		}
+		removed, err := s.Remove(m, locs[0], stale)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(removed) != 1 {
+			t.Errorf("pkcs12=%v: Remove: got %v", pkcs12, rootNames(removed))
+		}
+		if _, err := s.Remove(m, &storeLocation{Path: "/other/cacerts"}, stale); err == nil {
+			t.Errorf("pkcs12=%v: Remove: no error for an unknown location", pkcs12)
+		}
+		if roots := s.List(m)[0].Roots; len(roots) != 1 || !roots[0].Cert.Equal(m.ca.Cert) {
+			t.Errorf("pkcs12=%v: after Remove: got %v", pkcs12, rootNames(roots))
+		}
+
+		if err := s.Uninstall(m); err != nil {
+			t.Fatal(err)
+		}
+		if s.Check(m) {
+			t.Errorf("pkcs12=%v: installed after Uninstall", pkcs12)
+		}
+		ks, err = parseJavaKeyStore(fsys[cacerts].data, storePass)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ks.pkcs12 != pkcs12 || len(ks.entries) != 0 {
+			t.Errorf("pkcs12=%v: got %d entries, pkcs12=%v", pkcs12, len(ks.entries), ks.pkcs12)
+		}
+	}
+}
+
+func TestJavaStoreSymlink(t *testing.T) {
+	m := newTestMkcert(t)
+	data, err := (&javaKeyStore{}).Marshal(storePass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Like the Debian packages, which share /etc/ssl/certs/java/cacerts.
+	const cacerts, shared = "/jdk/lib/security/cacerts", "/etc/ssl/certs/java/cacerts"
+	fsys := withFakeFS(t, map[string][]byte{shared: data})
+	fsys[cacerts] = &memFile{link: shared, mode: os.ModeSymlink | 0777}
+	prev := javaInstalls
+	javaInstalls = []*javaInstall{{Home: "/jdk", Cacerts: cacerts}}
+	t.Cleanup(func() { javaInstalls = prev })
+
+	if err := (javaStore{}).Install(m); err != nil {
+		t.Fatal(err)
+	}
+	if fsys[cacerts].link != shared {
+		t.Fatal("the symlink was replaced")
+	}
+	ks, err := parseJavaKeyStore(fsys[shared].data, storePass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ks.entries) != 1 {
+		t.Errorf("got %d entries in the shared trust store, want 1", len(ks.entries))
+	}
+}
+
+func TestNodeStoreBundle(t *testing.T) {
+	m := newTestMkcert(t)
+	leaf, err := newTestCA(t).IssueLeaf(&ca.LeafOptions{Hosts: []string{"corp.test"}, KeyType: "p256"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := newTestCA(t)
+	fsys := withFakeFS(t, map[string][]byte{
+		"/etc/corp.pem": append(pemCert(leaf.Cert), pemCert(other.Cert)...),
+	})
+	t.Setenv("NODE_EXTRA_CA_CERTS", "/etc/corp.pem")
+	t.Setenv("SHELL", "")
+	if err := m.writeNodeBundle(); err != nil {
+		t.Fatal(err)
+	}
+	if !m.checkNodeBundle() {
+		t.Errorf("bundle not up to date after writing it")
+	}
+
+	// During a rotation, the bundle has both roots. The certificates of the
+	// previous NODE_EXTRA_CA_CERTS are kept, except for other mkcert roots.
+	m.previous = newTestCA(t)
+	if m.checkNodeBundle() {
+		t.Errorf("bundle up to date without the previous root")
+	}
+	t.Setenv("NODE_EXTRA_CA_CERTS", m.nodeBundlePath())
+	if _, err := (nodeStore{}).Remove(m, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	certs := parseCertificates(fsys[m.nodeBundlePath()].data)
+	if !equalCertList(certs, []*x509.Certificate{m.ca.Cert, m.previous.Cert, leaf.Cert}) {
+		t.Errorf("got %d certificates in the bundle, want the roots and the other certificate", len(certs))
+	}
+	locs := (nodeStore{}).List(m)
+	if len(locs) != 1 || len(locs[0].Roots) != 2 || !locs[0].Installed {
+		t.Errorf("List: got %+v", locs)
+	}
+}
+
+func TestNodeStoreProfile(t *testing.T) {
+	m := newTestMkcert(t)
+	const zshrc, bashrc = "/home/u/.zshrc", "/home/u/.bashrc"
+	fsys := withFakeFS(t, map[string][]byte{
+		zshrc:  []byte("export EDITOR=vi\n"),
+		bashrc: []byte("export EDITOR=vi\n"),
+	})
+	t.Setenv("HOME", "/home/u")
+	t.Setenv("ZDOTDIR", "")
+	t.Setenv("SHELL", "/bin/zsh")
+	t.Setenv("NODE_EXTRA_CA_CERTS", "")
+	var asked []string
+	answer := false
+	prev := askYesNo
+	askYesNo = func(q string) bool { asked = append(asked, q); return answer }
+	t.Cleanup(func() { askYesNo = prev })
+
+	s := nodeStore{}
+	if err := s.Install(m); err != nil {
+		t.Errorf("Install without setting NODE_EXTRA_CA_CERTS: %v", err)
+	}
+	if len(asked) != 1 || !strings.Contains(asked[0], zshrc) {
+		t.Errorf("got questions %q", asked)
+	}
+	if string(fsys[zshrc].data) != "export EDITOR=vi\n" || s.Check(m) {
+		t.Errorf("the profile was changed without asking")
+	}
+
+	answer = true
+	if err := s.Install(m); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Check(m) {
+		t.Errorf("not installed after Install")
+	}
+	if want := "export EDITOR=vi\n" + nodeSnippet(zshrc, m.nodeBundlePath()); string(fsys[zshrc].data) != want {
+		t.Errorf("got profile %q", fsys[zshrc].data)
+	}
+	if string(fsys[bashrc].data) != "export EDITOR=vi\n" {
+		t.Errorf("the profile of another shell was changed")
+	}
+	asked = nil
+	if err := s.Install(m); err != nil || len(asked) != 0 {
+		t.Errorf("Install again: got %v, questions %q", err, asked)
+	}
+
+	if err := s.Uninstall(m); err != nil {
+		t.Fatal(err)
+	}
+	if string(fsys[zshrc].data) != "export EDITOR=vi\n" {
+		t.Errorf("got profile %q after Uninstall", fsys[zshrc].data)
+	}
+	if _, ok := fsys[m.nodeBundlePath()]; ok || s.Check(m) {
+		t.Errorf("installed after Uninstall")
+	}
+
+	// With NODE_EXTRA_CA_CERTS already set, there is nothing to ask.
+	delete(fsys, zshrc)
+	t.Setenv("NODE_EXTRA_CA_CERTS", m.nodeBundlePath())
+	asked = nil
+	if err := s.Install(m); err != nil || len(asked) != 0 || !s.Check(m) {
+		t.Errorf("Install with NODE_EXTRA_CA_CERTS set: got %v, questions %q", err, asked)
+	}
+}
+
+func TestNodeSnippet(t *testing.T) {
+	for _, profile := range []string{"/home/u/.bashrc", "/home/u/.config/fish/config.fish"} {
+		for _, contents := range []string{"", "alias ll='ls -l'\n", "no trailing newline"} {
+			snippet := nodeSnippet(profile, "/ca/it's here/"+nodeBundleName)
+			found, rest := findNodeSnippet(contents + "\n" + snippet + "echo after\n")
+			if found != snippet {
+				t.Errorf("%s: got snippet %q", profile, found)
+			}
+			if rest != contents+"\necho after\n" {
+				t.Errorf("%s: got rest %q", profile, rest)
+			}
+		}
+	}
+	if found, rest := findNodeSnippet(nodeSnippetStart + "\nunterminated\n"); found != "" || rest == "" {
+		t.Errorf("unterminated snippet: got %q, %q", found, rest)
+	}
+}
+
+func pemCert(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+func equalCertList(a, b []*x509.Certificate) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i].Raw, b[i].Raw) {
+			return false
+		}
+	}
+	return true
+}
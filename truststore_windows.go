@@ -28,10 +28,13 @@ var (
 	procCertCloseStore                   = modcrypt32.NewProc("CertCloseStore")
 	procCertDeleteCertificateFromStore   = modcrypt32.NewProc("CertDeleteCertificateFromStore")
 	procCertDuplicateCertificateContext  = modcrypt32.NewProc("CertDuplicateCertificateContext")
-	procCertEnumCertificatesInStore      = modcrypt32.NewProc("CertEnumCertificatesInStore")
 	procCertOpenSystemStoreW             = modcrypt32.NewProc("CertOpenSystemStoreW")
 )
 
+func platformAvailable() error {
+	return nil
+}
+
 func (m *mkcert) installPlatform() bool {
 	// Load cert
 	cert, err := ioutil.ReadFile(filepath.Join(m.CAROOT, rootName))
@@ -58,7 +61,7 @@ func (m *mkcert) uninstallPlatform() bool {
 	fatalIfErr(err, "open root store")
 	defer store.close()
 	// Do the deletion
-	deletedAny, err := store.deleteCertsWithSerial(m.caCert.SerialNumber)
+	deletedAny, err := store.deleteCertsWithSerial(m.ca.Cert.SerialNumber)
 	if err == nil && !deletedAny {
 		err = fmt.Errorf("no certs found")
 	}
@@ -110,15 +113,15 @@ func (w windowsRootStore) deleteCertsWithSerial(serial *big.Int) (bool, error) {
 	deletedAny := false
 	for {
 		// Next enum
-		certPtr, _, err := procCertEnumCertificatesInStore.Call(uintptr(w), uintptr(unsafe.Pointer(cert)))
-		if cert = (*syscall.CertContext)(unsafe.Pointer(certPtr)); cert == nil {
+		var err error
+		if cert, err = syscall.CertEnumCertificatesInStore(syscall.Handle(w), cert); cert == nil {
 			if errno, ok := err.(syscall.Errno); ok && errno == 0x80092004 {
 				break
 			}
 			return deletedAny, fmt.Errorf("failed enumerating certs: %v", err)
 		}
 		// Parse cert
-		certBytes := (*[1 << 20]byte)(unsafe.Pointer(cert.EncodedCert))[:cert.Length]
+		certBytes := unsafe.Slice(cert.EncodedCert, cert.Length)
 		parsedCert, err := x509.ParseCertificate(certBytes)
 		// We'll just ignore parse failures for now
 		if err == nil && parsedCert.SerialNumber != nil && parsedCert.SerialNumber.Cmp(serial) == 0 {
@@ -135,3 +138,65 @@ func (w windowsRootStore) deleteCertsWithSerial(serial *big.Int) (bool, error) {
 	}
 	return deletedAny, nil
 }
+
+// platformRoots returns the name of the Windows root store, and the mkcert
+// root CAs in it, by common name.
+func platformRoots() (string, []storeRoot, error) {
+	store, err := openWindowsRootStore()
+	if err != nil {
+		return "", nil, err
+	}
+	defer store.close()
+	certs, err := store.certs()
+	if err != nil {
+		return "", nil, err
+	}
+	var roots []storeRoot
+	for _, cert := range certs {
+		if isMkcertRoot(cert) {
+			roots = append(roots, storeRoot{Name: cert.Subject.CommonName, Cert: cert})
+		}
+	}
+	return "ROOT", roots, nil
+}
+
+func (w windowsRootStore) certs() ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	var cert *syscall.CertContext
+	for {
+		var err error
+		if cert, err = syscall.CertEnumCertificatesInStore(syscall.Handle(w), cert); cert == nil {
+			if errno, ok := err.(syscall.Errno); ok && errno == 0x80092004 {
+				break
+			}
+			return nil, fmt.Errorf("failed enumerating certs: %v", err)
+		}
+		certBytes := unsafe.Slice(cert.EncodedCert, cert.Length)
+		// Copy the bytes, as the context is freed by the next enum.
+		parsedCert, err := x509.ParseCertificate(append([]byte(nil), certBytes...))
+		// We'll just ignore parse failures for now
+		if err == nil {
+			certs = append(certs, parsedCert)
+		}
+	}
+	return certs, nil
+}
+
+// deletePlatformRoots removes roots, as returned by platformRoots, from the
+// Windows root store. It returns the roots it removed, and stops at the first
+// error.
+func deletePlatformRoots(roots []storeRoot) ([]storeRoot, error) {
+	store, err := openWindowsRootStore()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the root store: %w", err)
+	}
+	defer store.close()
+	var removed []storeRoot
+	for _, r := range roots {
+		if _, err := store.deleteCertsWithSerial(r.Cert.SerialNumber); err != nil {
+			return removed, err
+		}
+		removed = append(removed, r)
+	}
+	return removed, nil
+}